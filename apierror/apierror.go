@@ -0,0 +1,34 @@
+// Package apierror writes errors in the JSON format of the API, which is
+// shared by everything in front of it, like authorization and rate limits.
+package apierror
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"gitlab.com/glatteis/earthwalker/logging"
+)
+
+// Send text as an error with status, e.g.
+// {"error": "text", "request_id": "..."}
+func Send(w http.ResponseWriter, text string, status int) {
+	SendFields(w, text, status, nil)
+}
+
+// SendFields is Send with more fields in the body, e.g. the invalid fields of
+// a request
+func SendFields(w http.ResponseWriter, text string, status int, fields map[string]interface{}) {
+	body := map[string]interface{}{"error": text}
+	for key, value := range fields {
+		body[key] = value
+	}
+	if id := w.Header().Get(logging.RequestIDHeader); len(id) > 0 {
+		body["request_id"] = id
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error writing response: %v\n", err)
+	}
+}
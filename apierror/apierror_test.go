@@ -0,0 +1,28 @@
+package apierror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gitlab.com/glatteis/earthwalker/logging"
+)
+
+func TestSend(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.Header().Set(logging.RequestIDHeader, "abc")
+	SendFields(rec, "invalid map", http.StatusUnprocessableEntity, map[string]interface{}{"fields": map[string]string{"Name": "too long"}})
+	if rec.Code != http.StatusUnprocessableEntity || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("got status %d, Content-Type %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	expected := `{"error":"invalid map","fields":{"Name":"too long"},"request_id":"abc"}` + "\n"
+	if rec.Body.String() != expected {
+		t.Errorf("expected %s, got %s", expected, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	Send(rec, "not found", http.StatusNotFound)
+	if expected := `{"error":"not found"}` + "\n"; rec.Code != http.StatusNotFound || rec.Body.String() != expected {
+		t.Errorf("expected 404 %s, got %d %s", expected, rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,141 @@
+// Package auth handles user passwords and server-side sessions.
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/clientip"
+	"gitlab.com/glatteis/earthwalker/domain"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SessionCookieName is the name of the cookie holding the SessionID
+const SessionCookieName = "earthwalker_session"
+
+const sessionDuration = 30 * 24 * time.Hour
+
+// HashPassword for storage in a domain.User
+func HashPassword(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// CheckPassword returns whether password matches hash
+func CheckPassword(hash []byte, password string) bool {
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// Sessions looks up, creates and ends the Sessions of requests
+type Sessions struct {
+	Store domain.SessionStore
+	// to tell whether the client uses HTTPS behind a proxy, so that cookies
+	// are only sent over HTTPS
+	ClientIP clientip.Resolver
+}
+
+// Get the Session of r.  ok is false if r has no (unexpired) Session.
+func (sessions Sessions) Get(r *http.Request) (session domain.Session, ok bool) {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil || len(cookie.Value) == 0 {
+		return domain.Session{}, false
+	}
+	session, err = sessions.Store.Get(cookie.Value)
+	if err != nil {
+		return domain.Session{}, false
+	}
+	if session.Results == nil {
+		// gob doesn't distinguish empty maps from nil
+		session.Results = make(map[string]string)
+	}
+	return session, true
+}
+
+// Start returns the Session of r, or a new anonymous Session if there is none.
+// Call Save after modifying it.
+func (sessions Sessions) Start(r *http.Request) (domain.Session, error) {
+	if session, ok := sessions.Get(r); ok {
+		return session, nil
+	}
+	return newSession("")
+}
+
+// Save session and (re)set its cookie
+func (sessions Sessions) Save(w http.ResponseWriter, r *http.Request, session domain.Session) error {
+	session.ExpiresAt = time.Now().Add(sessionDuration)
+	err := sessions.Store.Insert(session)
+	if err != nil {
+		return fmt.Errorf("failed to insert session into store: %v", err)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    session.SessionID,
+		MaxAge:   int(sessionDuration.Seconds()),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   sessions.ClientIP.Secure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// Login replaces the Session of r with a new one belonging to userID.
+// Results played anonymously before logging in are carried over.
+func (sessions Sessions) Login(w http.ResponseWriter, r *http.Request, userID string) (domain.Session, error) {
+	session, err := newSession(userID)
+	if err != nil {
+		return session, err
+	}
+	// the ID changes so that a session ID planted before login is worthless
+	if old, ok := sessions.Get(r); ok {
+		session.Results = old.Results
+		session.LastChallengeID = old.LastChallengeID
+		if err := sessions.Store.Delete(old.SessionID); err != nil {
+			return session, fmt.Errorf("failed to delete previous session: %v", err)
+		}
+	}
+	return session, sessions.Save(w, r, session)
+}
+
+// Logout ends the Session of r, if any
+func (sessions Sessions) Logout(w http.ResponseWriter, r *http.Request) error {
+	http.SetCookie(w, &http.Cookie{
+		Name:   SessionCookieName,
+		Value:  "",
+		MaxAge: -1,
+		Path:   "/",
+	})
+	session, ok := sessions.Get(r)
+	if !ok {
+		return nil
+	}
+	return sessions.Store.Delete(session.SessionID)
+}
+
+// ErrNotLoggedIn is returned when a request needs a logged in User
+var ErrNotLoggedIn = errors.New("not logged in")
+
+// CurrentUser returns the User who is logged in with r's Session
+func (sessions Sessions) CurrentUser(r *http.Request, users domain.UserStore) (domain.User, error) {
+	session, ok := sessions.Get(r)
+	if !ok || len(session.UserID) == 0 {
+		return domain.User{}, ErrNotLoggedIn
+	}
+	return users.Get(session.UserID)
+}
+
+func newSession(userID string) (domain.Session, error) {
+	// session IDs are bearer credentials, so they must not be guessable
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return domain.Session{}, fmt.Errorf("failed to generate session ID: %v", err)
+	}
+	return domain.Session{
+		SessionID: base64.RawURLEncoding.EncodeToString(b),
+		UserID:    userID,
+		Results:   make(map[string]string),
+	}, nil
+}
@@ -0,0 +1,248 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/apierror"
+	"gitlab.com/glatteis/earthwalker/clientip"
+	"gitlab.com/glatteis/earthwalker/config"
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+// Action is the enum of things which need authorization
+type Action int
+
+const (
+	// ActionCreateMap is POST /api/maps
+	ActionCreateMap Action = iota
+	// ActionDeleteMap is DELETE /api/maps/{id}
+	ActionDeleteMap
+	// ActionCreateChallenge is POST /api/challenges
+	ActionCreateChallenge
+	// ActionAdmin is everything under /api/admin
+	ActionAdmin
+	// ActionViewMetrics is GET /metrics
+	ActionViewMetrics
+)
+
+func (a Action) String() string {
+	return [...]string{"create maps", "delete maps", "create challenges", "administrate", "view metrics"}[a]
+}
+
+// anyone is the required Role setting which allows anonymous requests
+const anyone = "anyone"
+
+// tokenPrefix is prepended to API tokens, so they're recognizable in scripts
+const tokenPrefix = "ew_"
+
+// Rules map HTTP methods to the Action a request with that method performs
+type Rules map[string]Action
+
+// Policy decides which requests may perform which Actions
+type Policy struct {
+	// the current config, which may be reloaded.  Clients in its AllowedIPs
+	// may create and delete maps, as before there were roles.
+	Config     *config.Provider
+	Sessions   Sessions
+	UserStore  domain.UserStore
+	TokenStore domain.APITokenStore
+	ClientIP   clientip.Resolver
+}
+
+// Protect next so that requests are only passed on if they are authorized to
+// perform the Action given for their method by rules.
+// Requests with methods not in rules are always passed on.
+func (policy Policy) Protect(rules Rules, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action, ok := rules[r.Method]
+		if ok {
+			if err := policy.Authorize(r, action); err != nil {
+				sendError(w, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Require action for every request passed on to next
+func (policy Policy) Require(action Action, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := policy.Authorize(r, action); err != nil {
+			sendError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireClientCert for every request passed on to next.  The certificate is
+// verified by the server's tls.Config, see tlscert.ServerConfig.
+func RequireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			sendError(w, AuthorizationError{
+				Status:  http.StatusForbidden,
+				Message: "you need a trusted client certificate to administrate on this server.",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AuthorizationError explains why a request may not perform an Action
+type AuthorizationError struct {
+	Status  int // http.StatusUnauthorized or http.StatusForbidden
+	Message string
+}
+
+func (err AuthorizationError) Error() string {
+	return err.Message
+}
+
+// Authorize r to perform action, returning an AuthorizationError if it may not
+func (policy Policy) Authorize(r *http.Request, action Action) error {
+	required, anyoneAllowed, legacySetting := policy.requiredRole(action)
+	if anyoneAllowed {
+		return nil
+	}
+	// the allowlist predates accounts, and is only kept for the map settings
+	// it was made for.  It never grants roles or administration.
+	allowlisted := action == ActionCreateMap || action == ActionDeleteMap
+	if allowlisted && policy.fromAllowedIP(r) {
+		return nil
+	}
+	user, err := policy.Principal(r)
+	if len(legacySetting) > 0 && (err != nil || user.Role < required) {
+		who := fmt.Sprintf("users with the role '%s'", required)
+		if allowlisted {
+			who = "clients on this server's AllowedIPs and " + who
+		}
+		return AuthorizationError{
+			Status:  http.StatusForbidden,
+			Message: fmt.Sprintf("only %s may %s, as %s is false.", who, action, legacySetting),
+		}
+	}
+	if errors.Is(err, ErrNotLoggedIn) {
+		return AuthorizationError{
+			Status:  http.StatusUnauthorized,
+			Message: fmt.Sprintf("you need to log in to %s on this server.", action),
+		}
+	}
+	if err != nil {
+		return AuthorizationError{Status: http.StatusUnauthorized, Message: err.Error()}
+	}
+	if user.Role < required {
+		return AuthorizationError{
+			Status:  http.StatusForbidden,
+			Message: fmt.Sprintf("you need the role '%s' to %s on this server.", required, action),
+		}
+	}
+	return nil
+}
+
+// requiredRole for action, or anyoneAllowed if anonymous requests may perform
+// it.  The legacy AllowRemote settings allow anyone if true.  If false, a role
+// setting of "anyone" only allows users with the Role meant for the action
+// (and clients on AllowedIPs for maps), and legacySetting is the name of the
+// setting responsible.
+func (policy Policy) requiredRole(action Action) (required domain.Role, anyoneAllowed bool, legacySetting string) {
+	conf := policy.Config.Get()
+	var setting string
+	var legacy domain.Bool
+	switch action {
+	case ActionCreateMap:
+		setting, legacy, legacySetting = conf.MapCreationRole, conf.AllowRemoteMapCreation, "AllowRemoteMapCreation"
+		required = domain.RoleMapCreator
+	case ActionDeleteMap:
+		setting, legacy, legacySetting = conf.MapDeletionRole, conf.AllowRemoteMapDeletion, "AllowRemoteMapDeletion"
+		required = domain.RoleAdmin
+	case ActionCreateChallenge:
+		setting, legacy, legacySetting = conf.ChallengeCreationRole, conf.AllowRemoteChallengeCreation, "AllowRemoteChallengeCreation"
+		required = domain.RolePlayer
+	case ActionViewMetrics:
+		setting = conf.MetricsRole
+	default:
+		return domain.RoleAdmin, false, ""
+	}
+	if legacy {
+		return domain.RolePlayer, true, ""
+	}
+	if strings.EqualFold(setting, anyone) {
+		if len(legacySetting) > 0 {
+			return required, false, legacySetting
+		}
+		return domain.RolePlayer, true, ""
+	}
+	role, err := domain.ParseRole(setting)
+	if err != nil {
+		log.Printf("Invalid role configured for '%s', only admins are allowed: %v\n", action, err)
+		return domain.RoleAdmin, false, ""
+	}
+	return role, false, ""
+}
+
+// Principal returns the User on whose behalf r is made, authenticated by an
+// API token in the Authorization header or else by the session cookie.
+func (policy Policy) Principal(r *http.Request) (domain.User, error) {
+	header := r.Header.Get("Authorization")
+	if len(header) == 0 {
+		return policy.Sessions.CurrentUser(r, policy.UserStore)
+	}
+	secret := strings.TrimPrefix(header, "Bearer ")
+	if secret == header || policy.TokenStore == nil {
+		return domain.User{}, errors.New("unsupported Authorization header, expected 'Bearer <API token>'.")
+	}
+	token, err := policy.TokenStore.Get(HashToken(secret))
+	if err != nil {
+		return domain.User{}, errors.New("invalid API token.")
+	}
+	return policy.UserStore.Get(token.UserID)
+}
+
+// fromAllowedIP returns whether r comes from an IP in AllowedIPs
+func (policy Policy) fromAllowedIP(r *http.Request) bool {
+	return policy.Config.AllowedIPs().Contains(policy.ClientIP.Resolve(r))
+}
+
+// NewAPIToken for userID.  The secret is returned only this once, the
+// APIToken itself only contains its hash.
+func NewAPIToken(userID string, name string) (secret string, token domain.APIToken, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", token, fmt.Errorf("failed to generate API token: %v", err)
+	}
+	secret = tokenPrefix + hex.EncodeToString(b)
+	token = domain.APIToken{
+		TokenID:   HashToken(secret),
+		UserID:    userID,
+		Name:      name,
+		CreatedAt: time.Now(),
+	}
+	return secret, token, nil
+}
+
+// HashToken returns the TokenID of the APIToken with the given secret
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendError err, with its status if it's an AuthorizationError
+func sendError(w http.ResponseWriter, err error) {
+	status := http.StatusForbidden
+	var authErr AuthorizationError
+	if errors.As(err, &authErr) {
+		status = authErr.Status
+	}
+	apierror.Send(w, err.Error(), status)
+}
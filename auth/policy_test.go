@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gitlab.com/glatteis/earthwalker/config"
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+type memUserStore map[string]domain.User
+
+func (store memUserStore) Insert(user domain.User) error {
+	store[user.UserID] = user
+	return nil
+}
+
+func (store memUserStore) InsertNew(user domain.User) error {
+	if _, ok := store[user.UserID]; ok {
+		return domain.ErrIDExists
+	}
+	return store.Insert(user)
+}
+
+func (store memUserStore) Get(userID string) (domain.User, error) {
+	user, ok := store[userID]
+	if !ok {
+		return user, domain.ErrNotFound
+	}
+	return user, nil
+}
+
+func (store memUserStore) GetByUsername(username string) (domain.User, error) {
+	return domain.User{}, domain.ErrNotFound
+}
+
+func (store memUserStore) GetAll() ([]domain.User, error) {
+	return nil, nil
+}
+
+type memAPITokenStore map[string]domain.APIToken
+
+func (store memAPITokenStore) Insert(token domain.APIToken) error {
+	store[token.TokenID] = token
+	return nil
+}
+
+func (store memAPITokenStore) Get(tokenID string) (domain.APIToken, error) {
+	token, ok := store[tokenID]
+	if !ok {
+		return token, domain.ErrNotFound
+	}
+	return token, nil
+}
+
+func (store memAPITokenStore) GetAll(userID string) ([]domain.APIToken, error) {
+	return nil, nil
+}
+
+func (store memAPITokenStore) Delete(tokenID string) error {
+	delete(store, tokenID)
+	return nil
+}
+
+func TestAuthorizeRemoteClients(t *testing.T) {
+	users := memUserStore{}
+	tokens := memAPITokenStore{}
+	// API tokens of users with each role, by role
+	secrets := make(map[domain.Role]string)
+	for _, role := range []domain.Role{domain.RolePlayer, domain.RoleMapCreator, domain.RoleAdmin} {
+		user := domain.User{UserID: role.String(), Username: role.String(), Role: role}
+		secret, token, err := NewAPIToken(user.UserID, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		users.Insert(user)
+		tokens.Insert(token)
+		secrets[role] = secret
+	}
+
+	type client struct {
+		name   string
+		addr   string
+		secret string
+	}
+	clients := []client{
+		{"local", "127.0.0.1:1234", ""},
+		{"local IPv6", "[::1]:1234", ""},
+		{"allowlisted", "10.1.2.3:1234", ""},
+		{"remote", "203.0.113.7:1234", ""},
+		{"remote player", "203.0.113.7:1234", secrets[domain.RolePlayer]},
+		{"remote mapcreator", "203.0.113.7:1234", secrets[domain.RoleMapCreator]},
+		{"remote admin", "203.0.113.7:1234", secrets[domain.RoleAdmin]},
+	}
+	restricted := domain.Config{
+		AllowedIPs:            []string{"localhost", "10.0.0.0/8"},
+		MapCreationRole:       "anyone",
+		MapDeletionRole:       "anyone",
+		ChallengeCreationRole: "anyone",
+		MetricsRole:           "admin",
+	}
+	open := restricted
+	open.AllowRemoteMapCreation = true
+	open.AllowRemoteMapDeletion = true
+	open.AllowRemoteChallengeCreation = true
+	roles := restricted
+	roles.MapCreationRole = "admin"
+	roles.ChallengeCreationRole = "mapcreator"
+
+	const ok, unauthorized, forbidden = http.StatusOK, http.StatusUnauthorized, http.StatusForbidden
+	tests := []struct {
+		name   string
+		conf   domain.Config
+		action Action
+		// expected status for each of clients
+		expected []int
+	}{
+		{"AllowRemoteMapCreation false", restricted, ActionCreateMap, []int{ok, ok, ok, forbidden, forbidden, ok, ok}},
+		{"AllowRemoteMapCreation true", open, ActionCreateMap, []int{ok, ok, ok, ok, ok, ok, ok}},
+		{"MapCreationRole admin", roles, ActionCreateMap, []int{ok, ok, ok, unauthorized, forbidden, forbidden, ok}},
+		// the allowlist is only for maps
+		{"AllowRemoteChallengeCreation false", restricted, ActionCreateChallenge, []int{forbidden, forbidden, forbidden, forbidden, ok, ok, ok}},
+		{"AllowRemoteChallengeCreation true", open, ActionCreateChallenge, []int{ok, ok, ok, ok, ok, ok, ok}},
+		{"ChallengeCreationRole mapcreator", roles, ActionCreateChallenge, []int{unauthorized, unauthorized, unauthorized, unauthorized, forbidden, ok, ok}},
+		{"AllowRemoteMapDeletion false", restricted, ActionDeleteMap, []int{ok, ok, ok, forbidden, forbidden, forbidden, ok}},
+		{"AllowRemoteMapDeletion true", open, ActionDeleteMap, []int{ok, ok, ok, ok, ok, ok, ok}},
+		{"admin", open, ActionAdmin, []int{unauthorized, unauthorized, unauthorized, unauthorized, forbidden, forbidden, ok}},
+		{"MetricsRole admin", open, ActionViewMetrics, []int{unauthorized, unauthorized, unauthorized, unauthorized, forbidden, forbidden, ok}},
+	}
+	for _, test := range tests {
+		policy := Policy{
+			Config:     config.NewProvider(test.conf),
+			UserStore:  users,
+			TokenStore: tokens,
+		}
+		for i, c := range clients {
+			r := httptest.NewRequest(http.MethodPost, "/api/maps", nil)
+			r.RemoteAddr = c.addr
+			if len(c.secret) > 0 {
+				r.Header.Set("Authorization", "Bearer "+c.secret)
+			}
+			status := ok
+			var authErr AuthorizationError
+			if err := policy.Authorize(r, test.action); errors.As(err, &authErr) {
+				status = authErr.Status
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != test.expected[i] {
+				t.Errorf("%s, %s client: got status %d, expected %d", test.name, c.name, status, test.expected[i])
+			}
+		}
+	}
+}
@@ -2,8 +2,14 @@ package badgerdb
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger"
 	"gitlab.com/glatteis/earthwalker/domain"
@@ -20,36 +26,168 @@ import (
 // Init opens and returns a badger database connection
 // don't forget to close it
 func Init(path string) (*badger.DB, error) {
-	db, err := badger.Open(badger.DefaultOptions(path))
+	db, err := badger.Open(badger.DefaultOptions(path).WithLogger(slogLogger{}))
 	if err != nil {
 		return nil, err
 	}
 	return db, nil
 }
 
+// slogLogger logs badger's messages with slog.Default(), like the rest of
+// earthwalker's
+type slogLogger struct{}
+
+func (slogLogger) Errorf(format string, args ...interface{}) {
+	slog.Error(strings.TrimSpace(fmt.Sprintf(format, args...)), "component", "badger")
+}
+
+func (slogLogger) Warningf(format string, args ...interface{}) {
+	slog.Warn(strings.TrimSpace(fmt.Sprintf(format, args...)), "component", "badger")
+}
+
+// Infof logs at debug level, as badger tells us about every compaction
+func (slogLogger) Infof(format string, args ...interface{}) {
+	slog.Debug(strings.TrimSpace(fmt.Sprintf(format, args...)), "component", "badger")
+}
+
+func (slogLogger) Debugf(format string, args ...interface{}) {
+	slog.Debug(strings.TrimSpace(fmt.Sprintf(format, args...)), "component", "badger")
+}
+
+// SchemaVersion of the data written by this version of earthwalker.  It's
+// incremented with every migration, like ChallengeResultStore.IndexNicknames.
+const SchemaVersion = 1
+
+// healthKey is written by Ping
+const healthKey = "health-check"
+
+// Ping fails if db can't be written to
+func Ping(db *badger.DB) error {
+	err := db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(healthKey), []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+	if err != nil {
+		return fmt.Errorf("db is not writable: %v", err)
+	}
+	return nil
+}
+
 // Close closes the given badger database connection
 // (provided so you don't have to import badger just to do this)
 func Close(db *badger.DB) {
 	db.Close()
 }
 
+// RunGC garbage collects the value log of db every interval until ctx is done
+func RunGC(ctx context.Context, db *badger.DB, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// each run rewrites at most one file, so repeat until there's nothing left
+		for ctx.Err() == nil {
+			err := db.RunValueLogGC(0.5)
+			if errors.Is(err, badger.ErrNoRewrite) || errors.Is(err, badger.ErrRejected) {
+				break
+			}
+			if err != nil {
+				log.Printf("Failed to garbage collect the db: %v\n", err)
+				break
+			}
+		}
+	}
+}
+
+// Stats of a db
+type Stats struct {
+	// bytes on disk
+	LSMSize      int64
+	ValueLogSize int64
+	// number of keys by prefix, e.g. "map-"
+	Keys map[string]int
+	// number of objects of each kind
+	Maps             int
+	Challenges       int
+	ChallengeResults int
+}
+
+// ReadStats of db, iterating over all keys
+func ReadStats(db *badger.DB) (Stats, error) {
+	stats := Stats{Keys: make(map[string]int)}
+	stats.LSMSize, stats.ValueLogSize = db.Size()
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := string(it.Item().Key())
+			if i := strings.Index(key, "-"); i >= 0 {
+				key = key[:i+1]
+			}
+			stats.Keys[key]++
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to count keys: %v", err)
+	}
+	stats.Maps = stats.Keys[mapPrefix]
+	stats.Challenges = stats.Keys[challengePrefix]
+	stats.ChallengeResults = stats.Keys[challengeResultPrefix]
+	return stats, nil
+}
+
 // == Utilities ========
 
 // TODO: make store and get more symmetrical?
 func storeStruct(db *badger.DB, key string, t interface{}) error {
 	err := db.Update(func(txn *badger.Txn) error {
-		var buffer bytes.Buffer
-		gob.Register(map[string]interface{}{})
-		gob.Register([]interface{}{})
-		err := gob.NewEncoder(&buffer).Encode(t)
-		if err != nil {
-			return err
-		}
-		return txn.Set([]byte(key), buffer.Bytes())
+		return setStruct(txn, key, t)
 	})
 	return err
 }
 
+// storeNewStruct is storeStruct, unless there already is a value with key, or
+// another transaction writes one meanwhile
+func storeNewStruct(db *badger.DB, key string, t interface{}) error {
+	err := db.Update(func(txn *badger.Txn) error {
+		return setNewStruct(txn, key, t, domain.ErrIDExists)
+	})
+	if errors.Is(err, badger.ErrConflict) {
+		return fmt.Errorf("key '%s' written concurrently: %w", key, domain.ErrIDExists)
+	}
+	return err
+}
+
+// setNewStruct is setStruct, unless there already is a value with key, in
+// which case the error wraps taken
+func setNewStruct(txn *badger.Txn, key string, t interface{}, taken error) error {
+	_, err := txn.Get([]byte(key))
+	if err == nil {
+		return fmt.Errorf("key '%s': %w", key, taken)
+	}
+	if !errors.Is(err, badger.ErrKeyNotFound) {
+		return err
+	}
+	return setStruct(txn, key, t)
+}
+
+func setStruct(txn *badger.Txn, key string, t interface{}) error {
+	var buffer bytes.Buffer
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+	err := gob.NewEncoder(&buffer).Encode(t)
+	if err != nil {
+		return err
+	}
+	return txn.Set([]byte(key), buffer.Bytes())
+}
+
 func getBytes(db *badger.DB, key string) ([]byte, error) {
 	var byteSlice []byte
 	err := db.View(func(txn *badger.Txn) error {
@@ -89,13 +227,22 @@ const mapIndexGroup = "allMaps"
 
 // Insert a domain.Map into store's badger db
 func (store MapStore) Insert(m domain.Map) error {
-	err := store.Index.append(mapIndexGroup, m.MapID)
+	return store.insert(m, storeStruct)
+}
+
+// InsertNew domain.Map into store's badger db, unless its ID is taken
+func (store MapStore) InsertNew(m domain.Map) error {
+	return store.insert(m, storeNewStruct)
+}
+
+func (store MapStore) insert(m domain.Map, write func(*badger.DB, string, interface{}) error) error {
+	err := write(store.DB, mapPrefix+m.MapID, m)
 	if err != nil {
-		return fmt.Errorf("failed to add map to index: %v", err)
+		return fmt.Errorf("failed to write map to badger DB: %w", err)
 	}
-	err = storeStruct(store.DB, mapPrefix+m.MapID, m)
+	err = store.Index.append(mapIndexGroup, m.MapID)
 	if err != nil {
-		return fmt.Errorf("failed to write map to badger DB: %v", err)
+		return fmt.Errorf("failed to add map to index: %v", err)
 	}
 	return nil
 }
@@ -103,6 +250,9 @@ func (store MapStore) Insert(m domain.Map) error {
 // Get a domain.Map with the given mapID from store's badger db
 func (store MapStore) Get(mapID string) (domain.Map, error) {
 	mapBytes, err := getBytes(store.DB, mapPrefix+mapID)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return domain.Map{}, fmt.Errorf("map '%s': %w", mapID, domain.ErrNotFound)
+	}
 	if err != nil || len(mapBytes) == 0 {
 		return domain.Map{}, fmt.Errorf("failed to read map from badger DB: %v", err)
 	}
@@ -164,13 +314,22 @@ const challengePrefix = "challenge-"
 
 // Insert a domain.Challenge into store's badger db
 func (store ChallengeStore) Insert(c domain.Challenge) error {
-	err := store.Index.append(c.MapID, c.ChallengeID)
+	return store.insert(c, storeStruct)
+}
+
+// InsertNew domain.Challenge into store's badger db, unless its ID is taken
+func (store ChallengeStore) InsertNew(c domain.Challenge) error {
+	return store.insert(c, storeNewStruct)
+}
+
+func (store ChallengeStore) insert(c domain.Challenge, write func(*badger.DB, string, interface{}) error) error {
+	err := write(store.DB, challengePrefix+c.ChallengeID, c)
 	if err != nil {
-		return fmt.Errorf("failed to add challenge to index: %v", err)
+		return fmt.Errorf("failed to write challenge to badger DB: %w", err)
 	}
-	err = storeStruct(store.DB, challengePrefix+c.ChallengeID, c)
+	err = store.Index.append(c.MapID, c.ChallengeID)
 	if err != nil {
-		return fmt.Errorf("failed to write challenge to badger DB: %v", err)
+		return fmt.Errorf("failed to add challenge to index: %v", err)
 	}
 	return nil
 }
@@ -179,6 +338,9 @@ func (store ChallengeStore) Insert(c domain.Challenge) error {
 func (store ChallengeStore) Get(challengeID string) (domain.Challenge, error) {
 	var challengeBytes []byte
 	challengeBytes, err := getBytes(store.DB, challengePrefix+challengeID)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return domain.Challenge{}, fmt.Errorf("challenge '%s': %w", challengeID, domain.ErrNotFound)
+	}
 	if err != nil {
 		return domain.Challenge{}, fmt.Errorf("failed to read challenge from badger DB: %v", err)
 	}
@@ -226,6 +388,8 @@ func (store ChallengeStore) GetAll(mapID string) ([]domain.Challenge, error) {
 }
 
 func (store ChallengeStore) Delete(challengeID string) error {
+	// if the challenge doesn't exist, there is nothing to remove from the index
+	challenge, getErr := store.Get(challengeID)
 	err := deleteKey(store.DB, challengePrefix+challengeID)
 	if err != nil {
 		return fmt.Errorf("failed to delete challenge: %v", err)
@@ -235,6 +399,12 @@ func (store ChallengeStore) Delete(challengeID string) error {
 		return fmt.Errorf("during deletion of Challenge '%s', failed to "+
 			"delete Index of ChallengeResults: %v", challengeID, err)
 	}
+	if getErr == nil {
+		err = store.Index.remove(challenge.MapID, challengeID)
+		if err != nil {
+			return fmt.Errorf("failed to remove challenge from map index: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -265,16 +435,43 @@ type ChallengeResultStore struct {
 }
 
 const challengeResultPrefix = "result-"
+const nicknameIndexPrefix = "nickname-"
+const userIndexPrefix = "userresults-"
+
+// nicknameIndexGroup is the index group of all results of a player
+func nicknameIndexGroup(nickname string) string {
+	return nicknameIndexPrefix + strings.ToLower(strings.TrimSpace(nickname))
+}
 
 // Insert a domain.ChallengeResult into store's badger db
 func (store ChallengeResultStore) Insert(r domain.ChallengeResult) error {
-	err := store.Index.append(r.ChallengeID, r.ChallengeResultID)
+	return store.insert(r, storeStruct)
+}
+
+// InsertNew domain.ChallengeResult into store's badger db, unless its ID is
+// taken
+func (store ChallengeResultStore) InsertNew(r domain.ChallengeResult) error {
+	return store.insert(r, storeNewStruct)
+}
+
+func (store ChallengeResultStore) insert(r domain.ChallengeResult, write func(*badger.DB, string, interface{}) error) error {
+	err := write(store.DB, challengeResultPrefix+r.ChallengeResultID, r)
+	if err != nil {
+		return fmt.Errorf("failed to write challenge result to badger DB: %w", err)
+	}
+	err = store.Index.append(r.ChallengeID, r.ChallengeResultID)
 	if err != nil {
 		return fmt.Errorf("failed to add challenge result to index: %v", err)
 	}
-	err = storeStruct(store.DB, challengeResultPrefix+r.ChallengeResultID, r)
+	err = store.Index.append(nicknameIndexGroup(r.Nickname), r.ChallengeResultID)
 	if err != nil {
-		return fmt.Errorf("failed to write challenge result to badger DB: %v", err)
+		return fmt.Errorf("failed to add challenge result to nickname index: %v", err)
+	}
+	if len(r.UserID) > 0 {
+		err = store.Index.append(userIndexPrefix+r.UserID, r.ChallengeResultID)
+		if err != nil {
+			return fmt.Errorf("failed to add challenge result to user index: %v", err)
+		}
 	}
 	return nil
 }
@@ -282,6 +479,9 @@ func (store ChallengeResultStore) Insert(r domain.ChallengeResult) error {
 // Get a domain.ChallengeResult with the given challengeResultID from store's badger db
 func (store ChallengeResultStore) Get(challengeResultID string) (domain.ChallengeResult, error) {
 	resultBytes, err := getBytes(store.DB, challengeResultPrefix+challengeResultID)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return domain.ChallengeResult{}, fmt.Errorf("result '%s': %w", challengeResultID, domain.ErrNotFound)
+	}
 	if err != nil {
 		return domain.ChallengeResult{}, fmt.Errorf("failed to read result from badger DB: %v", err)
 	}
@@ -313,14 +513,94 @@ func (store ChallengeResultStore) GetAll(challengeID string) ([]domain.Challenge
 	return results, nil
 }
 
+// GetAllByNickname ChallengeResult, in all challenges
+func (store ChallengeResultStore) GetAllByNickname(nickname string) ([]domain.ChallengeResult, error) {
+	return store.getAllInGroup(nicknameIndexGroup(nickname))
+}
+
+// GetAllByUserID ChallengeResult, in all challenges
+func (store ChallengeResultStore) GetAllByUserID(userID string) ([]domain.ChallengeResult, error) {
+	return store.getAllInGroup(userIndexPrefix + userID)
+}
+
+func (store ChallengeResultStore) getAllInGroup(groupID string) ([]domain.ChallengeResult, error) {
+	ind, err := store.Index.get(groupID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get index '%s': %v", groupID, err)
+	}
+	results := make([]domain.ChallengeResult, len(ind.ObjectIDs))
+	i := 0
+	for challengeResultID := range ind.ObjectIDs {
+		challengeResult, err := store.Get(challengeResultID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get a challenge result listed in index '%s': %v", groupID, err)
+		}
+		results[i] = challengeResult
+		i++
+	}
+	return results, nil
+}
+
 func (store ChallengeResultStore) Delete(challengeResultID string) error {
+	// if the result doesn't exist, there is nothing to remove from the index
+	result, getErr := store.Get(challengeResultID)
 	err := deleteKey(store.DB, challengeResultPrefix+challengeResultID)
 	if err != nil {
 		return fmt.Errorf("failed to delete challenge result: %v", err)
 	}
+	if getErr == nil {
+		err = store.Index.remove(result.ChallengeID, challengeResultID)
+		if err != nil {
+			return fmt.Errorf("failed to remove challenge result from challenge index: %v", err)
+		}
+		err = store.Index.remove(nicknameIndexGroup(result.Nickname), challengeResultID)
+		if err != nil {
+			return fmt.Errorf("failed to remove challenge result from nickname index: %v", err)
+		}
+		if len(result.UserID) > 0 {
+			err = store.Index.remove(userIndexPrefix+result.UserID, challengeResultID)
+			if err != nil {
+				return fmt.Errorf("failed to remove challenge result from user index: %v", err)
+			}
+		}
+	}
 	return nil
 }
 
+// IndexNicknames adds every ChallengeResult in the db to the nickname index.
+// Results inserted before the index existed are only found by
+// GetAllByNickname after this has run once.
+func (store ChallengeResultStore) IndexNicknames() error {
+	const doneKey = "migration-nickname-index"
+	if _, err := getBytes(store.DB, doneKey); err == nil {
+		return nil
+	}
+	var resultIDs []string
+	err := store.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+		defer it.Close()
+		prefix := []byte(challengeResultPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			resultIDs = append(resultIDs, string(it.Item().Key()[len(prefix):]))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list challenge results: %v", err)
+	}
+	for _, resultID := range resultIDs {
+		result, err := store.Get(resultID)
+		if err != nil {
+			return err
+		}
+		err = store.Index.append(nicknameIndexGroup(result.Nickname), resultID)
+		if err != nil {
+			return fmt.Errorf("failed to add challenge result to nickname index: %v", err)
+		}
+	}
+	return storeStruct(store.DB, doneKey, true)
+}
+
 // DeleteAll ChallengeResult for a given challengeID
 func (store ChallengeResultStore) DeleteAll(challengeID string) error {
 	ind, err := store.Index.get(challengeID)
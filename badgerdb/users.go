@@ -0,0 +1,257 @@
+package badgerdb
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+// UserStore badger implementation (see domain)
+type UserStore struct {
+	DB    *badger.DB
+	Index *IndexStore
+}
+
+const userPrefix = "user-"
+const userIndexGroup = "allUsers"
+
+// usernamePrefix keys map lowercase usernames to UserIDs
+const usernamePrefix = "username-"
+
+// maxConflictAttempts at a transaction which conflicts with others
+const maxConflictAttempts = 3
+
+// Insert a domain.User into store's badger db
+func (store UserStore) Insert(u domain.User) error {
+	err := storeStruct(store.DB, userPrefix+u.UserID, u)
+	if err != nil {
+		return fmt.Errorf("failed to write user to badger DB: %v", err)
+	}
+	err = storeStruct(store.DB, usernamePrefix+strings.ToLower(u.Username), u.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to write username to badger DB: %v", err)
+	}
+	return store.index(u)
+}
+
+// InsertNew domain.User into store's badger db, unless its ID or username is
+// taken.  Both are written in one transaction, so that of two users
+// registering the same name at once, only one gets it.
+func (store UserStore) InsertNew(u domain.User) error {
+	var err error
+	// a conflict means another transaction wrote one of the keys meanwhile,
+	// so check again
+	for attempt := 0; attempt < maxConflictAttempts; attempt++ {
+		err = store.DB.Update(func(txn *badger.Txn) error {
+			err := setNewStruct(txn, userPrefix+u.UserID, u, domain.ErrIDExists)
+			if err != nil {
+				return err
+			}
+			return setNewStruct(txn, usernamePrefix+strings.ToLower(u.Username), u.UserID, domain.ErrUsernameTaken)
+		})
+		if !errors.Is(err, badger.ErrConflict) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write user to badger DB: %w", err)
+	}
+	return store.index(u)
+}
+
+func (store UserStore) index(u domain.User) error {
+	err := store.Index.append(userIndexGroup, u.UserID)
+	if err != nil {
+		return fmt.Errorf("failed to add user to index: %v", err)
+	}
+	return nil
+}
+
+// Get a domain.User with the given userID from store's badger db
+func (store UserStore) Get(userID string) (domain.User, error) {
+	userBytes, err := getBytes(store.DB, userPrefix+userID)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return domain.User{}, fmt.Errorf("user '%s': %w", userID, domain.ErrNotFound)
+	}
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to read user from badger DB: %v", err)
+	}
+
+	var foundUser domain.User
+	err = gob.NewDecoder(bytes.NewBuffer(userBytes)).Decode(&foundUser)
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to decode user from bytes: %v", err)
+	}
+	return foundUser, nil
+}
+
+// GetByUsername a domain.User from store's badger db
+func (store UserStore) GetByUsername(username string) (domain.User, error) {
+	idBytes, err := getBytes(store.DB, usernamePrefix+strings.ToLower(username))
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return domain.User{}, fmt.Errorf("username '%s': %w", username, domain.ErrNotFound)
+	}
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to read username from badger DB: %v", err)
+	}
+
+	var userID string
+	err = gob.NewDecoder(bytes.NewBuffer(idBytes)).Decode(&userID)
+	if err != nil {
+		return domain.User{}, fmt.Errorf("failed to decode user ID from bytes: %v", err)
+	}
+	return store.Get(userID)
+}
+
+// GetAll registered domain.Users
+func (store UserStore) GetAll() ([]domain.User, error) {
+	ind, err := store.Index.get(userIndexGroup)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users index: %v", err)
+	}
+	users := make([]domain.User, 0, len(ind.ObjectIDs))
+	for userID := range ind.ObjectIDs {
+		user, err := store.Get(userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get a user listed in the index: %v", err)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// SessionStore badger implementation (see domain)
+type SessionStore struct {
+	DB *badger.DB
+}
+
+const sessionPrefix = "session-"
+
+// Insert a domain.Session into store's badger db.
+// badger removes it by itself once it has expired.
+func (store SessionStore) Insert(s domain.Session) error {
+	ttl := time.Until(s.ExpiresAt)
+	if ttl <= 0 {
+		return store.Delete(s.SessionID)
+	}
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %v", err)
+	}
+	err = store.DB.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte(sessionPrefix+s.SessionID), buffer.Bytes()).WithTTL(ttl))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write session to badger DB: %v", err)
+	}
+	return nil
+}
+
+// Get a domain.Session with the given sessionID from store's badger db
+func (store SessionStore) Get(sessionID string) (domain.Session, error) {
+	sessionBytes, err := getBytes(store.DB, sessionPrefix+sessionID)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return domain.Session{}, fmt.Errorf("session: %w", domain.ErrNotFound)
+	}
+	if err != nil {
+		return domain.Session{}, fmt.Errorf("failed to read session from badger DB: %v", err)
+	}
+
+	var foundSession domain.Session
+	err = gob.NewDecoder(bytes.NewBuffer(sessionBytes)).Decode(&foundSession)
+	if err != nil {
+		return domain.Session{}, fmt.Errorf("failed to decode session from bytes: %v", err)
+	}
+	if time.Now().After(foundSession.ExpiresAt) {
+		return domain.Session{}, fmt.Errorf("session: %w", domain.ErrNotFound)
+	}
+	return foundSession, nil
+}
+
+func (store SessionStore) Delete(sessionID string) error {
+	err := deleteKey(store.DB, sessionPrefix+sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %v", err)
+	}
+	return nil
+}
+
+// APITokenStore badger implementation (see domain)
+type APITokenStore struct {
+	DB    *badger.DB
+	Index *IndexStore
+}
+
+const apiTokenPrefix = "apitoken-"
+const apiTokenIndexPrefix = "apitokens-"
+
+// Insert a domain.APIToken into store's badger db
+func (store APITokenStore) Insert(t domain.APIToken) error {
+	err := store.Index.append(apiTokenIndexPrefix+t.UserID, t.TokenID)
+	if err != nil {
+		return fmt.Errorf("failed to add API token to index: %v", err)
+	}
+	err = storeStruct(store.DB, apiTokenPrefix+t.TokenID, t)
+	if err != nil {
+		return fmt.Errorf("failed to write API token to badger DB: %v", err)
+	}
+	return nil
+}
+
+// Get a domain.APIToken with the given tokenID from store's badger db
+func (store APITokenStore) Get(tokenID string) (domain.APIToken, error) {
+	tokenBytes, err := getBytes(store.DB, apiTokenPrefix+tokenID)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return domain.APIToken{}, fmt.Errorf("API token: %w", domain.ErrNotFound)
+	}
+	if err != nil {
+		return domain.APIToken{}, fmt.Errorf("failed to read API token from badger DB: %v", err)
+	}
+
+	var foundToken domain.APIToken
+	err = gob.NewDecoder(bytes.NewBuffer(tokenBytes)).Decode(&foundToken)
+	if err != nil {
+		return domain.APIToken{}, fmt.Errorf("failed to decode API token from bytes: %v", err)
+	}
+	return foundToken, nil
+}
+
+// GetAll domain.APITokens of the given user
+func (store APITokenStore) GetAll(userID string) ([]domain.APIToken, error) {
+	ind, err := store.Index.get(apiTokenIndexPrefix + userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get API token index: %v", err)
+	}
+	tokens := make([]domain.APIToken, 0, len(ind.ObjectIDs))
+	for tokenID := range ind.ObjectIDs {
+		token, err := store.Get(tokenID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get an API token listed in the index: %v", err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (store APITokenStore) Delete(tokenID string) error {
+	token, err := store.Get(tokenID)
+	if err != nil {
+		return err
+	}
+	err = deleteKey(store.DB, apiTokenPrefix+tokenID)
+	if err != nil {
+		return fmt.Errorf("failed to delete API token: %v", err)
+	}
+	err = store.Index.remove(apiTokenIndexPrefix+token.UserID, tokenID)
+	if err != nil {
+		return fmt.Errorf("failed to remove API token from index: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Package clientip resolves the address of the client making a request.
+// Forwarding headers are only believed if they were set by a trusted proxy,
+// otherwise anyone could claim to be connecting from an allowed address.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Nets is a list of IP networks, e.g. an allowlist
+type Nets []*net.IPNet
+
+// ParseNets parses CIDRs ("192.168.0.0/24"), single IPs ("127.0.0.1") and
+// "localhost", which stands for the IPv4 and IPv6 loopback networks.
+func ParseNets(entries []string) (Nets, error) {
+	var nets Nets
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case strings.EqualFold(entry, "localhost"):
+			nets = append(nets, mustParseCIDR("127.0.0.0/8"), mustParseCIDR("::1/128"))
+		case strings.Contains(entry, "/"):
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR '%s': %v", entry, err)
+			}
+			nets = append(nets, ipNet)
+		default:
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address '%s'", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+	}
+	return nets, nil
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
+}
+
+// Contains returns whether ip is in any of nets
+func (nets Nets) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolver finds the client IP of requests
+type Resolver struct {
+	// TrustedProxies may set the Forwarded and X-Forwarded-For headers.
+	// If empty, the headers are ignored and the peer address is the client.
+	TrustedProxies Nets
+}
+
+// Resolve the IP of the client making r, or nil if it can't be determined.
+// Starting at the peer, every hop which is a trusted proxy is replaced by the
+// address it says it forwarded for, until an untrusted hop is reached.
+func (resolver Resolver) Resolve(r *http.Request) net.IP {
+	ip := peerIP(r)
+	if ip == nil || !resolver.TrustedProxies.Contains(ip) {
+		return ip
+	}
+
+	// Forwarded supersedes X-Forwarded-For, but we don't know which one our
+	// proxies set, so we use whichever is present
+	var hops []string
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		hops = parseForwarded(forwarded)
+	} else {
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(header, ",")...)
+		}
+	}
+	// the last hop was added by the proxy closest to us
+	for i := len(hops) - 1; i >= 0; i-- {
+		hopIP := parseHop(hops[i])
+		if hopIP == nil {
+			// e.g. "unknown" or an obfuscated identifier, we can't go on
+			return ip
+		}
+		ip = hopIP
+		if !resolver.TrustedProxies.Contains(ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// Secure is whether the client made r over HTTPS, either to us or to a trusted
+// proxy which says so in the X-Forwarded-Proto or Forwarded header.  Of
+// several protos, the last one, added by the proxy closest to us, counts.
+func (resolver Resolver) Secure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if ip := peerIP(r); ip == nil || !resolver.TrustedProxies.Contains(ip) {
+		return false
+	}
+	proto := ""
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, header := range forwarded {
+			for _, pair := range strings.FieldsFunc(header, func(c rune) bool { return c == ',' || c == ';' }) {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "proto") {
+					proto = strings.Trim(value, "\"")
+				}
+			}
+		}
+	} else {
+		for _, header := range r.Header.Values("X-Forwarded-Proto") {
+			protos := strings.Split(header, ",")
+			proto = protos[len(protos)-1]
+		}
+	}
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// peerIP is the IP r came from directly, or nil
+func peerIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// parseForwarded returns the for= parameters of RFC 7239 Forwarded headers
+func parseForwarded(headers []string) []string {
+	var hops []string
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hop = value
+				}
+			}
+			// keep elements without for=, so that they stop the search
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseHop parses one forwarded address, which may be quoted, bracketed and
+// have a port ("[2001:db8::1]:4711", "192.0.2.43:80", "192.0.2.43")
+func parseHop(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), "\"")
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	return net.ParseIP(hop)
+}
@@ -0,0 +1,132 @@
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseNets(t *testing.T) {
+	nets, err := ParseNets([]string{"localhost", "192.168.0.0/24", "10.0.0.7", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"127.0.0.1":   true,
+		"::1":         true,
+		"192.168.0.3": true,
+		"192.168.1.3": false,
+		"10.0.0.7":    true,
+		"10.0.0.8":    false,
+		"2001:db8::1": true,
+	}
+	for ip, expected := range tests {
+		if nets.Contains(net.ParseIP(ip)) != expected {
+			t.Errorf("got Contains(%s) = %v, expected %v", ip, !expected, expected)
+		}
+	}
+	for _, invalid := range []string{"192.168.0.0/33", "not an ip", "True"} {
+		if _, err := ParseNets([]string{invalid}); err == nil {
+			t.Errorf("expected an error for '%s'", invalid)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	trusted, err := ParseNets([]string{"localhost", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := Resolver{TrustedProxies: trusted}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{"no proxy", "203.0.113.5:1234", nil, "203.0.113.5"},
+		{"spoofed header from untrusted peer", "203.0.113.5:1234",
+			map[string]string{"X-Forwarded-For": "127.0.0.1"}, "203.0.113.5"},
+		{"trusted proxy", "127.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "203.0.113.5"}, "203.0.113.5"},
+		{"client prepends a spoofed hop", "127.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "127.0.0.1, 203.0.113.5"}, "203.0.113.5"},
+		{"chain of trusted proxies", "127.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "198.51.100.7, 203.0.113.5, 10.1.2.3"}, "203.0.113.5"},
+		{"only trusted hops", "127.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "10.1.2.3"}, "10.1.2.3"},
+		{"garbage hop", "127.0.0.1:1234",
+			map[string]string{"X-Forwarded-For": "not-an-ip"}, "127.0.0.1"},
+		{"forwarded", "[::1]:1234",
+			map[string]string{"Forwarded": `for=192.0.2.60;proto=http;by=203.0.113.43`}, "192.0.2.60"},
+		{"forwarded ipv6 with port", "127.0.0.1:1234",
+			map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711"`}, "2001:db8:cafe::17"},
+		{"forwarded chain", "127.0.0.1:1234",
+			map[string]string{"Forwarded": `for=198.51.100.7, for=203.0.113.5;proto=https, for=10.1.2.3`}, "203.0.113.5"},
+		{"forwarded unknown", "127.0.0.1:1234",
+			map[string]string{"Forwarded": `for=unknown`}, "127.0.0.1"},
+		{"forwarded takes precedence", "127.0.0.1:1234",
+			map[string]string{"Forwarded": `for=192.0.2.60`, "X-Forwarded-For": "203.0.113.5"}, "192.0.2.60"},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = test.remoteAddr
+		for key, value := range test.headers {
+			req.Header.Set(key, value)
+		}
+		if ip := resolver.Resolve(req); ip.String() != test.expected {
+			t.Errorf("%s: got %v, expected %s", test.name, ip, test.expected)
+		}
+	}
+
+	// without trusted proxies, headers are ignored entirely
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.5")
+	if ip := (Resolver{}).Resolve(req); ip.String() != "127.0.0.1" {
+		t.Errorf("got %v without trusted proxies, expected 127.0.0.1", ip)
+	}
+}
+
+func TestSecure(t *testing.T) {
+	trusted, err := ParseNets([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := Resolver{TrustedProxies: trusted}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		expected   bool
+	}{
+		{"plain HTTP", "203.0.113.5:1234", nil, false},
+		{"spoofed header from untrusted peer", "203.0.113.5:1234", map[string]string{"X-Forwarded-Proto": "https"}, false},
+		{"trusted proxy", "127.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "https"}, true},
+		{"trusted proxy over HTTP", "127.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "http"}, false},
+		{"closest proxy counts", "127.0.0.1:1234", map[string]string{"X-Forwarded-Proto": "https, http"}, false},
+		{"forwarded", "[::1]:1234", map[string]string{"Forwarded": `for=192.0.2.60;proto=https`}, true},
+		{"forwarded takes precedence", "127.0.0.1:1234",
+			map[string]string{"Forwarded": `for=192.0.2.60;proto=http`, "X-Forwarded-Proto": "https"}, false},
+		{"no header", "127.0.0.1:1234", nil, false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		for key, value := range test.headers {
+			req.Header.Set(key, value)
+		}
+		if secure := resolver.Secure(req); secure != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, secure, test.expected)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/", nil)
+	if !(Resolver{}).Secure(req) {
+		t.Error("a TLS request isn't secure")
+	}
+}
@@ -0,0 +1,20 @@
+// Command fakeupstream serves the recorded Google Maps fixtures of package
+// fakeupstream, for developing the play proxy offline.  Run it and set
+// UpstreamURL = "http://localhost:8081" in earthwalker's config.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"gitlab.com/glatteis/earthwalker/handlers/fakeupstream"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8081", "the address to listen on")
+	flag.Parse()
+
+	log.Printf("Serving fake Google Maps on http://%s\n", *addr)
+	log.Fatal(http.ListenAndServe(*addr, fakeupstream.New()))
+}
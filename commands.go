@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"gitlab.com/glatteis/earthwalker/config"
+)
+
+const usage = `Usage:
+  earthwalker [serve] [flags]                       serve earthwalker, see
+                                                    earthwalker serve -h
+  earthwalker config check|print [flags]            check or print the config
+  earthwalker maps list|show <id>|delete <id>       manage maps
+  earthwalker challenges list [<map id>]|show <id>|delete <id>
+                                                    manage challenges
+  earthwalker results list <challenge id>|delete <id>
+                                                    manage challenge results
+  earthwalker users list|promote <username> [role]  manage users, promote
+                                                    makes them admins or
+                                                    the given role
+  earthwalker db stats                              show database statistics
+
+list, show and stats print tables, or JSON with -json.  Deleting a map or
+challenge also deletes its challenges and results.  All commands but serve
+and config use the database configured for serve, which can only be opened
+while earthwalker isn't running.
+`
+
+// command run with the arguments following its name, returning the exit code
+type command func(args []string) int
+
+var commands = map[string]command{
+	"serve":      serve,
+	"config":     configCommand,
+	"maps":       mapsCommand,
+	"challenges": challengesCommand,
+	"results":    resultsCommand,
+	"users":      usersCommand,
+	"db":         dbCommand,
+}
+
+// run the command named by args[0], or serve if args are only flags
+func run(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return serve(args)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		if args[0] != "help" {
+			fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", args[0])
+		}
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	return cmd(args[1:])
+}
+
+const configUsage = `Usage:
+  earthwalker config check [flags]  validate the configuration, listing every
+                                    problem
+  earthwalker config print [flags]  print the effective configuration, and
+                                    whether each value is the default or from
+                                    the file, env or flags
+`
+
+// configCommand runs "earthwalker config ..."
+func configCommand(args []string) int {
+	if len(args) == 0 || (args[0] != "check" && args[0] != "print") {
+		fmt.Fprint(os.Stderr, configUsage)
+		return 2
+	}
+	conf, sources, err := config.Read(args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read config: %v\n", err)
+		return 1
+	}
+	if args[0] == "print" {
+		if err := config.Print(os.Stdout, conf, sources); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to print config: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if err := config.Validate(conf); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config %s:\n%v\n", conf.ConfigPath, err)
+		return 1
+	}
+	fmt.Printf("Config %s is valid\n", conf.ConfigPath)
+	return 0
+}
+
+// output of list, show and stats commands, as a table or JSON
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+// print v as JSON, or else the rows of a table with the given header
+func (out output) print(v interface{}, header []string, rows [][]string) error {
+	if out.json {
+		encoder := json.NewEncoder(out.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	table := tabwriter.NewWriter(out.w, 0, 4, 2, ' ', 0)
+	if len(header) > 0 {
+		fmt.Fprintln(table, strings.Join(header, "\t"))
+	}
+	for _, row := range rows {
+		fmt.Fprintln(table, strings.Join(row, "\t"))
+	}
+	return table.Flush()
+}
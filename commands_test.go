@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/badgerdb"
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+func TestStoreCommands(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("EARTHWALKER_CONFIG_PATH", filepath.Join(dir, "config.toml"))
+	t.Setenv("EARTHWALKER_DB_PATH", filepath.Join(dir, "badger"))
+
+	db, err := badgerdb.Init(filepath.Join(dir, "badger"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := &badgerdb.IndexStore{DB: db}
+	inserts := []error{
+		badgerdb.MapStore{DB: db, Index: index}.Insert(domain.Map{MapID: "alps", Name: "Alps", NumRounds: 2}),
+		badgerdb.ChallengeStore{DB: db, Index: index}.Insert(domain.Challenge{ChallengeID: "c1", MapID: "alps", Places: []domain.ChallengePlace{
+			{ChallengeID: "c1", RoundNum: 0, Location: domain.Coords{Lat: 47.42, Lng: 10.98}},
+			{ChallengeID: "c1", RoundNum: 1, Location: domain.Coords{Lat: 45.83, Lng: 6.86}},
+		}}),
+		badgerdb.ChallengeResultStore{DB: db, Index: index}.Insert(domain.ChallengeResult{ChallengeResultID: "r1", ChallengeID: "c1", Nickname: "ada", CreatedAt: time.Now()}),
+		badgerdb.ChallengeResultStore{DB: db, Index: index}.Insert(domain.ChallengeResult{ChallengeResultID: "r2", ChallengeID: "c1", Nickname: "bob", CreatedAt: time.Now()}),
+		badgerdb.UserStore{DB: db, Index: index}.Insert(domain.User{UserID: "u1", Username: "Ada", CreatedAt: time.Now()}),
+	}
+	for _, err := range inserts {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	badgerdb.Close(db)
+
+	var buffer bytes.Buffer
+	stdout = &buffer
+	defer func() { stdout = os.Stdout }()
+	runOK := func(args ...string) string {
+		buffer.Reset()
+		if code := run(args); code != 0 {
+			t.Fatalf("earthwalker %s exited with %d", strings.Join(args, " "), code)
+		}
+		return buffer.String()
+	}
+
+	if out := runOK("maps", "list"); !strings.Contains(out, "alps  Alps  2       1") {
+		t.Error("unexpected maps list\n", out)
+	}
+	var challenges []domain.Challenge
+	if err := json.Unmarshal([]byte(runOK("challenges", "list", "-json")), &challenges); err != nil || len(challenges) != 1 {
+		t.Errorf("expected one challenge, got %v (%v)", challenges, err)
+	}
+	if out := runOK("challenges", "list", "alps"); !strings.Contains(out, "c1  alps  2       2") {
+		t.Error("unexpected challenges list of alps\n", out)
+	}
+	if out := runOK("challenges", "show", "c1"); !strings.Contains(out, "2      45.830000  6.860000") {
+		t.Error("unexpected challenge\n", out)
+	}
+	runOK("results", "delete", "r1")
+	if out := runOK("results", "list", "c1"); strings.Contains(out, "ada") || !strings.Contains(out, "bob") {
+		t.Error("expected only r2 to be left\n", out)
+	}
+	if out := runOK("maps", "delete", "alps"); !strings.Contains(out, "and its 1 challenges") {
+		t.Error("unexpected output of maps delete\n", out)
+	}
+	if out := runOK("users", "promote", "ada"); !strings.Contains(out, "Ada (u1) is now admin") {
+		t.Error("unexpected output of users promote\n", out)
+	}
+	runOK("users", "promote", "ada", "mapcreator")
+	if out := runOK("users", "list"); !strings.Contains(out, "u1  Ada       mapcreator") {
+		t.Error("unexpected users list\n", out)
+	}
+	if out := runOK("db", "stats", "-json"); !strings.Contains(out, `"Maps": 0`) || !strings.Contains(out, `"ChallengeResults": 0`) {
+		t.Error("expected everything to be deleted\n", out)
+	}
+
+	for _, args := range [][]string{{"maps", "show"}, {"maps", "rename", "alps"}, {"challenges", "list", "-map", "alps"}, {"frobnicate"}} {
+		if code := run(args); code != 2 {
+			t.Errorf("expected earthwalker %s to exit with 2, got %d", strings.Join(args, " "), code)
+		}
+	}
+	if code := run([]string{"challenges", "show", "c1"}); code != 1 {
+		t.Error("expected the deleted challenge not to be found, got exit code", code)
+	}
+}
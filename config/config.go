@@ -2,55 +2,352 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"math"
+	"net/url"
 	"os"
 	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"gitlab.com/glatteis/earthwalker/clientip"
 	"gitlab.com/glatteis/earthwalker/domain"
 )
 
-// Read a Config from environment variables and TOML file, and return it
-func Read() (domain.Config, error) {
-	// defaults
-	appPath := AppPath()
-	conf := domain.Config{
-		ConfigPath:           getEnv("EARTHWALKER_CONFIG_PATH", appPath+"/config.toml"),
-		StaticPath:           appPath,
-		DBPath:               appPath + "/badger",
-		Port:                 "8080",
-		TileServerURL:        "https://mt.google.com/vt/lyrs=m&hl=en&x={x}&y={y}&z={z}",
-		NoLabelTileServerURL: "https://mt.google.com/vt/lyrs=s&hl=en&x={x}&y={y}&z={z}",
-		AllowRemoteMapDeletion: "False",
-		AllowRemoteMapCreation: "False",
-		IsBehindProxy: "True",
-		AllowedIPs: []string{"localhost", "127.0.0.1", "192.168.0.127"},
+// Source of the value of a config field
+type Source string
+
+const (
+	// SourceDefault means the field wasn't set anywhere
+	SourceDefault Source = "default"
+	// SourceFile means the field was set in the TOML file
+	SourceFile Source = "file"
+	// SourceEnv means the field was set by an environment variable
+	SourceEnv Source = "env"
+	// SourceFlag means the field was set by a command line flag
+	SourceFlag Source = "flag"
+)
+
+// Sources of the values of a Config, by field name
+type Sources map[string]Source
+
+// Default Config, with paths relative to appPath
+func Default(appPath string) domain.Config {
+	return domain.Config{
+		ConfigPath:             appPath + "/config.toml",
+		StaticPath:             "", // embedded frontend
+		DBPath:                 appPath + "/badger",
+		Port:                   "8080",
+		TileServerURL:          "https://mt.google.com/vt/lyrs=m&hl=en&x={x}&y={y}&z={z}",
+		NoLabelTileServerURL:   "https://mt.google.com/vt/lyrs=s&hl=en&x={x}&y={y}&z={z}",
+		AllowRemoteMapDeletion: false,
+		AllowRemoteMapCreation: false,
+		IsBehindProxy:          true,
+		TrustedProxies:         []string{"localhost"},
+		AllowedIPs:             []string{"localhost", "127.0.0.1"},
+		GeoDataPath:            appPath + "/geodata",
+		MapCreationRole:        "anyone",
+		MapDeletionRole:        "admin",
+		ChallengeCreationRole:  "anyone",
+		MetricsRole:            "admin",
+		ProxyCachePath:         appPath + "/cache",
+		ProxyCacheMemoryMB:     64,
+		ProxyCacheDiskMB:       512,
+		ProxyCacheTTL:          domain.Duration(time.Hour),
+		UpstreamURL:            "https://www.google.com",
+		UpstreamTimeout:        domain.Duration(30 * time.Second),
+		UpstreamMaxBodyMB:      32,
+		ReadHeaderTimeout:      domain.Duration(10 * time.Second),
+		ReadTimeout:            domain.Duration(30 * time.Second),
+		WriteTimeout:           domain.Duration(60 * time.Second),
+		IdleTimeout:            domain.Duration(120 * time.Second),
+		ShutdownTimeout:        domain.Duration(30 * time.Second),
+		DBGCInterval:           domain.Duration(10 * time.Minute),
+		ReadinessCheckUpstream: true,
+		LogLevel:               "info",
+		LogFormat:              "json",
+
+		// players must be able to start games on existing maps
+		AllowRemoteChallengeCreation: true,
+
+		// limits against spam
+		MapCreationRateLimit:       domain.RateLimit{Requests: 20, Period: time.Hour},
+		ChallengeCreationRateLimit: domain.RateLimit{Requests: 60, Period: time.Hour},
+		ResultCreationRateLimit:    domain.RateLimit{Requests: 120, Period: time.Hour},
+		GuessRateLimit:             domain.RateLimit{Requests: 600, Period: time.Hour},
+		MaxRequestBodyKB:           4096,
+		MaxPolygonVertices:         100000,
+		MaxRounds:                  100,
+
+		// IDs of results are credentials, so they're long
+		IDLength:   16,
+		IDAlphabet: "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789",
+	}
+}
+
+// Read a Config from the command line flags in args, environment variables
+// and TOML file, and return it with where each value came from.  It isn't
+// validated, see Validate.
+func Read(args []string) (domain.Config, Sources, error) {
+	conf := Default(AppPath())
+	sources := make(Sources)
+	for _, f := range fields {
+		sources[f.Name] = SourceDefault
+	}
+	// flags are applied last, but may set the ConfigPath
+	flagValues, err := parseFlags(args, conf)
+	if err != nil {
+		return conf, sources, err
 	}
+	var problems []error
+	apply := func(f field, text string, source Source, from string) {
+		if err := set(&conf, f.Name, text); err != nil {
+			problems = append(problems, fmt.Errorf("%s: %v", from, err))
+			return
+		}
+		sources[f.Name] = source
+	}
+	applyEnv := func(f field) {
+		// empty variables are ignored, so that unset variables passed on
+		// (e.g. by docker compose) don't override anything
+		if v, ok := os.LookupEnv(f.Env); ok && len(v) > 0 {
+			apply(f, v, SourceEnv, f.Env)
+		}
+	}
+	applyFlag := func(f field) {
+		if v, ok := flagValues[f.Name]; ok {
+			apply(f, v, SourceFlag, "-"+f.Flag)
+		}
+	}
+	applyEnv(fields[0])
+	applyFlag(fields[0])
 
 	// TOML
 	tomlData, err := ioutil.ReadFile(conf.ConfigPath)
-	if err != nil {
+	if os.IsNotExist(err) {
 		log.Printf("No config file at '%s', using default configuration.\n", conf.ConfigPath)
+	} else if err != nil {
+		return conf, sources, fmt.Errorf("failed to read config file: %v", err)
 	}
-	if err := toml.Unmarshal(tomlData, &conf); err != nil {
-		return conf, fmt.Errorf("error parsing TOML config file: %v", err)
+	meta, err := toml.Decode(string(tomlData), &conf)
+	if err != nil {
+		return conf, sources, fmt.Errorf("error parsing TOML config file: %v", err)
+	}
+	for _, key := range meta.Keys() {
+		if name, ok := fieldName(key.String()); ok {
+			sources[name] = SourceFile
+		}
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		var keys []string
+		for _, key := range undecoded {
+			keys = append(keys, key.String())
+		}
+		return conf, sources, fmt.Errorf("unknown keys in config file %s: %s", conf.ConfigPath, strings.Join(keys, ", "))
+	}
+
+	// env vars, then flags
+	for _, f := range fields[1:] {
+		applyEnv(f)
+	}
+	for _, f := range fields[1:] {
+		applyFlag(f)
 	}
 
-	// env vars
-	conf.Port = getEnv("EARTHWALKER_PORT", conf.Port)
-	conf.DBPath = getEnv("EARTHWALKER_DB_PATH", conf.DBPath)
-	conf.StaticPath = getEnv("EARTHWALKER_STATIC_PATH", conf.StaticPath)
+	return conf, sources, errors.Join(problems...)
+}
 
-	return conf, nil
+const (
+	// characters IDAlphabet may have
+	idCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_"
+	minIDBits    = 64
+	// fewer words would collide too often, more are too long to share
+	minShareIDWords = 3
+	maxShareIDWords = 8
+)
+
+// Validate conf, returning an error which lists every invalid setting
+func Validate(conf domain.Config) error {
+	var problems []error
+	invalid := func(name string, format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+	}
+
+	if len(conf.Port) == 0 {
+		invalid("Port", "must be set")
+	}
+	for i, port := range []string{conf.Port, conf.HTTPRedirectPort} {
+		if len(port) == 0 {
+			continue
+		}
+		if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+			invalid([]string{"Port", "HTTPRedirectPort"}[i], "'%s' is not a port number", port)
+		}
+	}
+	if len(conf.HTTPRedirectPort) > 0 && conf.HTTPRedirectPort == conf.Port {
+		invalid("HTTPRedirectPort", "must differ from Port")
+	}
+	if len(conf.TileServerURL) == 0 {
+		invalid("TileServerURL", "must be set")
+	}
+	if len(conf.NoLabelTileServerURL) == 0 {
+		invalid("NoLabelTileServerURL", "must be set")
+	}
+
+	roles := []struct {
+		name    string
+		setting string
+	}{
+		{"MapCreationRole", conf.MapCreationRole},
+		{"MapDeletionRole", conf.MapDeletionRole},
+		{"ChallengeCreationRole", conf.ChallengeCreationRole},
+		{"MetricsRole", conf.MetricsRole},
+	}
+	for _, role := range roles {
+		if strings.EqualFold(role.setting, "anyone") {
+			continue
+		}
+		if _, err := domain.ParseRole(role.setting); err != nil {
+			invalid(role.name, "%v, or anyone", err)
+		}
+	}
+	if _, err := clientip.ParseNets(conf.TrustedProxies); err != nil {
+		invalid("TrustedProxies", "%v", err)
+	}
+	if _, err := clientip.ParseNets(conf.AllowedIPs); err != nil {
+		invalid("AllowedIPs", "%v", err)
+	}
+
+	if conf.ProxyCacheMemoryMB < 0 {
+		invalid("ProxyCacheMemoryMB", "must not be negative")
+	}
+	if conf.ProxyCacheDiskMB < 0 {
+		invalid("ProxyCacheDiskMB", "must not be negative")
+	}
+	limits := []struct {
+		name  string
+		limit int
+	}{
+		{"UpstreamMaxBodyMB", conf.UpstreamMaxBodyMB},
+		{"MaxRequestBodyKB", conf.MaxRequestBodyKB},
+		{"MaxPolygonVertices", conf.MaxPolygonVertices},
+		{"MaxRounds", conf.MaxRounds},
+	}
+	for _, l := range limits {
+		if l.limit < 0 {
+			invalid(l.name, "must not be negative")
+		}
+	}
+	durations := []struct {
+		name     string
+		duration domain.Duration
+	}{
+		{"ProxyCacheTTL", conf.ProxyCacheTTL},
+		{"UpstreamTimeout", conf.UpstreamTimeout},
+		{"ReadHeaderTimeout", conf.ReadHeaderTimeout},
+		{"ReadTimeout", conf.ReadTimeout},
+		{"WriteTimeout", conf.WriteTimeout},
+		{"IdleTimeout", conf.IdleTimeout},
+		{"ShutdownTimeout", conf.ShutdownTimeout},
+		{"DBGCInterval", conf.DBGCInterval},
+	}
+	for _, d := range durations {
+		if d.duration < 0 {
+			invalid(d.name, "%s must not be negative", d.duration)
+		}
+	}
+	if conf.WriteTimeout > 0 && conf.WriteTimeout <= conf.UpstreamTimeout {
+		invalid("WriteTimeout", "%s must be longer than UpstreamTimeout %s, or slow Street View pages are cut off",
+			conf.WriteTimeout, conf.UpstreamTimeout)
+	}
+
+	upstream, err := url.Parse(conf.UpstreamURL)
+	if err != nil || (upstream.Scheme != "http" && upstream.Scheme != "https") || len(upstream.Host) == 0 {
+		invalid("UpstreamURL", "'%s' must be http(s)://host", conf.UpstreamURL)
+	}
+
+	if (len(conf.TLSCertPath) > 0) != (len(conf.TLSKeyPath) > 0) {
+		invalid("TLSCertPath", "TLSCertPath and TLSKeyPath must be set together")
+	}
+	if len(conf.TLSCertPath) == 0 {
+		if len(conf.HTTPRedirectPort) > 0 {
+			invalid("HTTPRedirectPort", "needs TLSCertPath and TLSKeyPath to be set")
+		}
+		if len(conf.AdminClientCAPath) > 0 {
+			invalid("AdminClientCAPath", "needs TLSCertPath and TLSKeyPath to be set")
+		}
+	}
+
+	// IDs are in paths, cookies and db keys, and IDs of results are
+	// credentials
+	alphabet := make(map[rune]bool)
+	for _, c := range conf.IDAlphabet {
+		if !strings.ContainsRune(idCharacters, c) {
+			invalid("IDAlphabet", "'%c' is not a letter, digit, - or _", c)
+		} else if alphabet[c] {
+			invalid("IDAlphabet", "'%c' is in it more than once", c)
+		}
+		alphabet[c] = true
+	}
+	if len(alphabet) < 2 {
+		invalid("IDAlphabet", "must have at least 2 characters")
+	} else if bits := float64(conf.IDLength) * math.Log2(float64(len(alphabet))); bits < minIDBits {
+		invalid("IDLength", "%d characters of IDAlphabet are %.0f random bits, at least %d are needed so that IDs can't be guessed",
+			conf.IDLength, bits, minIDBits)
+	}
+	if conf.ShareIDWords != 0 && (conf.ShareIDWords < minShareIDWords || conf.ShareIDWords > maxShareIDWords) {
+		invalid("ShareIDWords", "must be 0 or between %d and %d", minShareIDWords, maxShareIDWords)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(conf.LogLevel)); err != nil {
+		invalid("LogLevel", "'%s' is not debug, info, warn or error", conf.LogLevel)
+	}
+	if format := strings.ToLower(conf.LogFormat); format != "json" && format != "text" {
+		invalid("LogFormat", "'%s' is not json or text", conf.LogFormat)
+	}
+
+	return errors.Join(problems...)
+}
+
+// Print conf in TOML, with the source of each value as a comment
+func Print(w io.Writer, conf domain.Config, sources Sources) error {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	value := reflect.ValueOf(conf)
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+		var line strings.Builder
+		encoder := toml.NewEncoder(&line)
+		if err := encoder.Encode(map[string]interface{}{name: value.Field(i).Interface()}); err != nil {
+			return fmt.Errorf("failed to encode %s: %v", name, err)
+		}
+		source, ok := sources[name]
+		if !ok {
+			source = SourceDefault
+		}
+		fmt.Fprintf(table, "%s\t# %s\n", strings.TrimSpace(line.String()), source)
+	}
+	return table.Flush()
 }
 
-func getEnv(key string, fallback string) string {
-	if v, ok := os.LookupEnv(key); ok && len(v) > 0 {
-		return v
+// fieldName of TOML key, which is matched case-insensitively like the
+// decoder does
+func fieldName(key string) (string, bool) {
+	for _, f := range fields {
+		if strings.EqualFold(f.Name, key) {
+			return f.Name, true
+		}
 	}
-	return fallback
+	return "", false
 }
 
 // AppPath gets the executable's path.
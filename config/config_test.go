@@ -0,0 +1,221 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+func writeConfig(t *testing.T, content string) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EARTHWALKER_CONFIG_PATH", path)
+}
+
+func TestRead(t *testing.T) {
+	writeConfig(t, `
+IsBehindProxy = "False"
+allowremotemapcreation = true
+UpstreamTimeout = "5s"
+GuessRateLimit = "10/1m"
+MapCreationRateLimit = ""
+AllowedIPs = ["10.0.0.0/8"]
+`)
+	t.Setenv("EARTHWALKER_PORT", "9000")
+
+	conf, sources, err := Read(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.IsBehindProxy || !conf.AllowRemoteMapCreation {
+		t.Error("expected booleans from the file, got", conf.IsBehindProxy, conf.AllowRemoteMapCreation)
+	}
+	if time.Duration(conf.UpstreamTimeout) != 5*time.Second {
+		t.Error("expected UpstreamTimeout 5s, got", conf.UpstreamTimeout)
+	}
+	if conf.GuessRateLimit != (domain.RateLimit{Requests: 10, Period: time.Minute}) || conf.MapCreationRateLimit.Requests != 0 {
+		t.Error("expected rate limits from the file, got", conf.GuessRateLimit, conf.MapCreationRateLimit)
+	}
+	if conf.Port != "9000" || len(conf.AllowedIPs) != 1 {
+		t.Errorf("unexpected config %+v", conf)
+	}
+	expected := Sources{
+		"ConfigPath":             SourceEnv,
+		"Port":                   SourceEnv,
+		"IsBehindProxy":          SourceFile,
+		"AllowRemoteMapCreation": SourceFile,
+		"UpstreamTimeout":        SourceFile,
+		"AllowedIPs":             SourceFile,
+		"DBPath":                 SourceDefault,
+		"ReadTimeout":            SourceDefault,
+	}
+	for name, source := range expected {
+		if sources[name] != source {
+			t.Errorf("expected %s from %s, got %s", name, source, sources[name])
+		}
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	for _, content := range []string{
+		`IsBehindProxy = "True",`,
+		`IsBehindProxy = "maybe"`,
+		`UpstreamTimeout = "30"`,
+		`UpstreamTimout = "30s"`,
+		`GuessRateLimit = "10"`,
+		`GuessRateLimit = "0/1h"`,
+	} {
+		writeConfig(t, content)
+		if _, _, err := Read(nil); err == nil {
+			t.Errorf("expected %s to be rejected", content)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate(Default("/app")); err != nil {
+		t.Error("expected the default config to be valid, got", err)
+	}
+
+	conf := Default("/app")
+	conf.Port = "http"
+	conf.MapCreationRole = "everyone"
+	conf.AllowedIPs = []string{"192.168.0.0/33"}
+	conf.ProxyCacheTTL = domain.Duration(-time.Second)
+	conf.UpstreamURL = "www.google.com"
+	conf.TLSCertPath = "cert.pem"
+	conf.LogFormat = "xml"
+	err := Validate(conf)
+	if err == nil {
+		t.Fatal("expected the config to be invalid")
+	}
+	for _, name := range []string{"Port", "MapCreationRole", "AllowedIPs", "ProxyCacheTTL", "UpstreamURL", "TLSCertPath", "LogFormat"} {
+		if !strings.Contains(err.Error(), name+": ") {
+			t.Errorf("expected a problem with %s, got %v", name, err)
+		}
+	}
+
+	conf = Default("/app")
+	conf.WriteTimeout = conf.UpstreamTimeout
+	conf.HTTPRedirectPort = "80"
+	err = Validate(conf)
+	if err == nil || !strings.Contains(err.Error(), "WriteTimeout: ") || !strings.Contains(err.Error(), "HTTPRedirectPort: ") {
+		t.Error("expected WriteTimeout and HTTPRedirectPort to be invalid, got", err)
+	}
+
+	ids := []struct {
+		length   int
+		alphabet string
+		words    int
+		invalid  string
+	}{
+		{10, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ", 0, "IDLength"},
+		{64, "01", 4, ""},
+		{16, "abc/", 0, "IDAlphabet"},
+		{40, "abca", 0, "IDAlphabet"},
+		{40, "a", 0, "IDAlphabet"},
+		{16, conf.IDAlphabet, 2, "ShareIDWords"},
+	}
+	for _, test := range ids {
+		conf = Default("/app")
+		conf.IDLength, conf.IDAlphabet, conf.ShareIDWords = test.length, test.alphabet, test.words
+		err = Validate(conf)
+		if len(test.invalid) == 0 && err != nil {
+			t.Errorf("expected %d of %s and %d words to be valid, got %v", test.length, test.alphabet, test.words, err)
+		} else if len(test.invalid) > 0 && (err == nil || !strings.Contains(err.Error(), test.invalid+": ")) {
+			t.Errorf("expected %s to be invalid with %d of %s and %d words, got %v", test.invalid, test.length, test.alphabet, test.words, err)
+		}
+	}
+}
+
+func TestPrint(t *testing.T) {
+	conf := Default("/app")
+	conf.Port = "9000"
+	var buffer bytes.Buffer
+	if err := Print(&buffer, conf, Sources{"Port": SourceEnv}); err != nil {
+		t.Fatal(err)
+	}
+	output := buffer.String()
+	for _, line := range []string{
+		`Port = "9000" +# env`,
+		`IsBehindProxy = true +# default`,
+		`UpstreamTimeout = "30s" +# default`,
+		`AllowedIPs = \["localhost", "127.0.0.1"\] +# default`,
+	} {
+		if !regexp.MustCompile("(?m)^" + line + "$").MatchString(output) {
+			t.Errorf("expected a line matching %s, got\n%s", line, output)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	configType := reflect.TypeOf(domain.Config{})
+	if len(fields) != configType.NumField() {
+		t.Errorf("expected %d fields, got %d", configType.NumField(), len(fields))
+	}
+	envs := make(map[string]bool)
+	flags := make(map[string]bool)
+	for i, f := range fields {
+		if i < configType.NumField() && configType.Field(i).Name != f.Name {
+			t.Errorf("expected field %d to be %s, got %s", i, configType.Field(i).Name, f.Name)
+		}
+		if envs[f.Env] || flags[f.Flag] || len(f.Env) == 0 || len(f.Flag) == 0 || len(f.Usage) == 0 {
+			t.Errorf("expected unique env var, flag and usage for %s", f.Name)
+		}
+		envs[f.Env] = true
+		flags[f.Flag] = true
+	}
+}
+
+func TestReadEnvAndFlags(t *testing.T) {
+	writeConfig(t, `
+Port = "7000"
+MetricsRole = "anyone"
+`)
+	t.Setenv("EARTHWALKER_PORT", "9000")
+	t.Setenv("EARTHWALKER_ALLOWED_IPS", "10.0.0.0/8, 192.168.1.1")
+	t.Setenv("EARTHWALKER_IS_BEHIND_PROXY", "false")
+	t.Setenv("EARTHWALKER_DB_GC_INTERVAL", "0s")
+	t.Setenv("EARTHWALKER_TILE_SERVER_URL", "")
+
+	conf, sources, err := Read([]string{"-port", "9100", "-allow-remote-map-creation", "-proxy-cache-memory-mb=8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Port != "9100" || sources["Port"] != SourceFlag {
+		t.Errorf("expected the flag to override env and file, got %s from %s", conf.Port, sources["Port"])
+	}
+	if !reflect.DeepEqual(conf.AllowedIPs, []string{"10.0.0.0/8", "192.168.1.1"}) || sources["AllowedIPs"] != SourceEnv {
+		t.Errorf("expected AllowedIPs from env, got %v from %s", conf.AllowedIPs, sources["AllowedIPs"])
+	}
+	if conf.IsBehindProxy || conf.DBGCInterval != 0 || !conf.AllowRemoteMapCreation || conf.ProxyCacheMemoryMB != 8 {
+		t.Errorf("unexpected config %+v", conf)
+	}
+	if conf.MetricsRole != "anyone" || sources["MetricsRole"] != SourceFile {
+		t.Errorf("expected MetricsRole from the file, got %s from %s", conf.MetricsRole, sources["MetricsRole"])
+	}
+	if conf.TileServerURL != Default("").TileServerURL || sources["TileServerURL"] != SourceDefault {
+		t.Error("expected empty env vars to be ignored, got", conf.TileServerURL)
+	}
+
+	t.Setenv("EARTHWALKER_UPSTREAM_TIMEOUT", "soon")
+	_, _, err = Read([]string{"-proxy-cache-disk-mb", "lots"})
+	if err == nil || !strings.Contains(err.Error(), "EARTHWALKER_UPSTREAM_TIMEOUT") || !strings.Contains(err.Error(), "-proxy-cache-disk-mb") {
+		t.Error("expected the env var and the flag to be rejected, got", err)
+	}
+	if _, _, err := Read([]string{"-no-such-flag"}); err == nil {
+		t.Error("expected an unknown flag to be rejected")
+	}
+	if _, _, err := Read([]string{"serve"}); err == nil {
+		t.Error("expected an unexpected argument to be rejected")
+	}
+}
@@ -0,0 +1,173 @@
+package config
+
+import (
+	"encoding"
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+// field of domain.Config, which can be set by the TOML key Name, the
+// environment variable Env and the command line flag Flag
+type field struct {
+	Name  string
+	Env   string
+	Flag  string
+	Usage string
+	// whether changes are applied when the config is reloaded, see Reload
+	Live bool
+}
+
+// fields has every field of domain.Config, so that they can all be set in
+// every way
+var fields = []field{
+	{"ConfigPath", "EARTHWALKER_CONFIG_PATH", "config", "location of the TOML config file", false},
+	{"StaticPath", "EARTHWALKER_STATIC_PATH", "static-path", "directory containing public, empty to use the embedded frontend", false},
+	{"DBPath", "EARTHWALKER_DB_PATH", "db-path", "location of the database directory", false},
+	{"Port", "EARTHWALKER_PORT", "port", "port to listen on", false},
+	{"TileServerURL", "EARTHWALKER_TILE_SERVER_URL", "tile-server-url", "URL of a raster tile server for the map", true},
+	{"NoLabelTileServerURL", "EARTHWALKER_NO_LABEL_TILE_SERVER_URL", "no-label-tile-server-url", "as tile-server-url, for maps without labels", true},
+	{"AllowRemoteMapDeletion", "EARTHWALKER_ALLOW_REMOTE_MAP_DELETION", "allow-remote-map-deletion", "allow anyone to delete maps", true},
+	{"AllowRemoteMapCreation", "EARTHWALKER_ALLOW_REMOTE_MAP_CREATION", "allow-remote-map-creation", "allow anyone to create maps", true},
+	{"IsBehindProxy", "EARTHWALKER_IS_BEHIND_PROXY", "is-behind-proxy", "find client IPs in forwarding headers set by trusted proxies", false},
+	{"AllowRemoteChallengeCreation", "EARTHWALKER_ALLOW_REMOTE_CHALLENGE_CREATION", "allow-remote-challenge-creation", "allow anyone to create challenges of existing maps", true},
+	{"TrustedProxies", "EARTHWALKER_TRUSTED_PROXIES", "trusted-proxies", "comma separated IPs or CIDRs of reverse proxies", false},
+	{"AllowedIPs", "EARTHWALKER_ALLOWED_IPS", "allowed-ips", "comma separated IPs or CIDRs which may create and delete maps", true},
+	{"GeoDataPath", "EARTHWALKER_GEODATA_PATH", "geodata-path", "directory containing the GeoNames files for reverse geocoding", false},
+	{"MapCreationRole", "EARTHWALKER_MAP_CREATION_ROLE", "map-creation-role", "minimum role to create maps, or anyone", true},
+	{"MapDeletionRole", "EARTHWALKER_MAP_DELETION_ROLE", "map-deletion-role", "minimum role to delete maps, or anyone", true},
+	{"ChallengeCreationRole", "EARTHWALKER_CHALLENGE_CREATION_ROLE", "challenge-creation-role", "minimum role to create challenges, or anyone", true},
+	{"MetricsRole", "EARTHWALKER_METRICS_ROLE", "metrics-role", "minimum role to view /metrics, or anyone", true},
+	{"ProxyCachePath", "EARTHWALKER_PROXY_CACHE_PATH", "proxy-cache-path", "directory of the Google Maps cache, empty to cache in memory only", false},
+	{"ProxyCacheMemoryMB", "EARTHWALKER_PROXY_CACHE_MEMORY_MB", "proxy-cache-memory-mb", "size limit of the in-memory cache", false},
+	{"ProxyCacheDiskMB", "EARTHWALKER_PROXY_CACHE_DISK_MB", "proxy-cache-disk-mb", "size limit of the on-disk cache", false},
+	{"ProxyCacheTTL", "EARTHWALKER_PROXY_CACHE_TTL", "proxy-cache-ttl", "how long to cache responses without cache headers", false},
+	{"UpstreamURL", "EARTHWALKER_UPSTREAM_URL", "upstream-url", "where Street View pages are fetched from", false},
+	{"UpstreamTimeout", "EARTHWALKER_UPSTREAM_TIMEOUT", "upstream-timeout", "timeout of requests to the upstream", false},
+	{"UpstreamMaxBodyMB", "EARTHWALKER_UPSTREAM_MAX_BODY_MB", "upstream-max-body-mb", "size limit of upstream responses, 0 for no limit", false},
+	{"ReadHeaderTimeout", "EARTHWALKER_READ_HEADER_TIMEOUT", "read-header-timeout", "how long clients may take to send request headers", false},
+	{"ReadTimeout", "EARTHWALKER_READ_TIMEOUT", "read-timeout", "how long clients may take to send a request", false},
+	{"WriteTimeout", "EARTHWALKER_WRITE_TIMEOUT", "write-timeout", "how long a response may take", false},
+	{"IdleTimeout", "EARTHWALKER_IDLE_TIMEOUT", "idle-timeout", "how long to keep idle connections open", false},
+	{"ShutdownTimeout", "EARTHWALKER_SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long to wait for requests in flight when shutting down", false},
+	{"DBGCInterval", "EARTHWALKER_DB_GC_INTERVAL", "db-gc-interval", "how often to reclaim space in the database, 0s never to", false},
+	{"TLSCertPath", "EARTHWALKER_TLS_CERT_PATH", "tls-cert-path", "PEM certificate to serve HTTPS with", false},
+	{"TLSKeyPath", "EARTHWALKER_TLS_KEY_PATH", "tls-key-path", "PEM private key of the certificate", false},
+	{"HTTPRedirectPort", "EARTHWALKER_HTTP_REDIRECT_PORT", "http-redirect-port", "port on which to redirect plain HTTP to HTTPS", false},
+	{"AdminClientCAPath", "EARTHWALKER_ADMIN_CLIENT_CA_PATH", "admin-client-ca-path", "PEM CA certificates which must have signed client certificates for /api/admin", false},
+	{"ReadinessCheckUpstream", "EARTHWALKER_READINESS_CHECK_UPSTREAM", "readiness-check-upstream", "whether /readyz fails while the upstream is unreachable", false},
+	{"LogLevel", "EARTHWALKER_LOG_LEVEL", "log-level", "debug, info, warn or error", false},
+	{"LogFormat", "EARTHWALKER_LOG_FORMAT", "log-format", "json or text", false},
+	{"MapCreationRateLimit", "EARTHWALKER_MAP_CREATION_RATE_LIMIT", "map-creation-rate-limit", "maps each client may create, e.g. 20/1h, empty for no limit", true},
+	{"ChallengeCreationRateLimit", "EARTHWALKER_CHALLENGE_CREATION_RATE_LIMIT", "challenge-creation-rate-limit", "challenges each client may create, e.g. 60/1h", true},
+	{"ResultCreationRateLimit", "EARTHWALKER_RESULT_CREATION_RATE_LIMIT", "result-creation-rate-limit", "challenge results each client may create, e.g. 120/1h", true},
+	{"GuessRateLimit", "EARTHWALKER_GUESS_RATE_LIMIT", "guess-rate-limit", "guesses each client may submit, e.g. 600/1h", true},
+	{"MaxRequestBodyKB", "EARTHWALKER_MAX_REQUEST_BODY_KB", "max-request-body-kb", "size limit of request bodies to /api, 0 for no limit", true},
+	{"MaxPolygonVertices", "EARTHWALKER_MAX_POLYGON_VERTICES", "max-polygon-vertices", "vertex limit of the polygons of a map, 0 for no limit", true},
+	{"MaxRounds", "EARTHWALKER_MAX_ROUNDS", "max-rounds", "round limit of maps and challenges, 0 for no limit", true},
+	{"IDLength", "EARTHWALKER_ID_LENGTH", "id-length", "length of the IDs of new objects", true},
+	{"IDAlphabet", "EARTHWALKER_ID_ALPHABET", "id-alphabet", "characters of the IDs of new objects", true},
+	{"ShareIDWords", "EARTHWALKER_SHARE_ID_WORDS", "share-id-words", "words in the IDs of new maps and challenges, 0 for random characters", true},
+}
+
+const usage = `Usage:
+  earthwalker [flags]
+  earthwalker config check|print [flags]
+
+Flags override environment variables, which override the config file.  Lists
+are comma separated.
+
+Flags:
+`
+
+// parseFlags in args, returning their values by field name
+func parseFlags(args []string, defaults domain.Config) (map[string]string, error) {
+	values := make(map[string]string)
+	flags := flag.NewFlagSet("earthwalker", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	defaultValues := reflect.ValueOf(defaults)
+	for _, f := range fields {
+		name := f.Name
+		flags.Var(&flagValue{
+			text:   format(defaultValues.FieldByName(name)),
+			isBool: defaultValues.FieldByName(name).Kind() == reflect.Bool,
+			set: func(text string) {
+				values[name] = text
+			},
+		}, f.Flag, f.Usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	return values, nil
+}
+
+// flagValue records the text of a flag, which is parsed by set later
+type flagValue struct {
+	text   string
+	isBool bool
+	set    func(text string)
+}
+
+func (value *flagValue) String() string {
+	return value.text
+}
+
+func (value *flagValue) Set(text string) error {
+	value.text = text
+	value.set(text)
+	return nil
+}
+
+// IsBoolFlag allows -flag instead of -flag=true
+func (value *flagValue) IsBoolFlag() bool {
+	return value.isBool
+}
+
+// set the field called name of conf from text, like "30s" for durations or
+// "a, b" for lists
+func set(conf *domain.Config, name string, text string) error {
+	value := reflect.ValueOf(conf).Elem().FieldByName(name)
+	if unmarshaler, ok := value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(text))
+	}
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(text)
+	case reflect.Int:
+		number, err := strconv.Atoi(text)
+		if err != nil {
+			return fmt.Errorf("invalid number '%s'", text)
+		}
+		value.SetInt(int64(number))
+	case reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(text, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		panic("config field " + name + " has unsupported type " + value.Type().String())
+	}
+	return nil
+}
+
+// format value like set parses it
+func format(value reflect.Value) string {
+	if list, ok := value.Interface().([]string); ok {
+		return strings.Join(list, ",")
+	}
+	return fmt.Sprint(value.Interface())
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/clientip"
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+// Provider holds the current Config, which is swapped atomically when the
+// config is reloaded.  Handlers Get it for every request, so that they see
+// changes without a restart.
+type Provider struct {
+	current atomic.Pointer[snapshot]
+}
+
+type snapshot struct {
+	conf       domain.Config
+	allowedIPs clientip.Nets
+}
+
+// NewProvider of conf, which should be valid (see Validate).  If its
+// AllowedIPs are invalid, no IPs are allowed.
+func NewProvider(conf domain.Config) *Provider {
+	provider := &Provider{}
+	allowedIPs, _ := clientip.ParseNets(conf.AllowedIPs)
+	provider.current.Store(&snapshot{conf: conf, allowedIPs: allowedIPs})
+	return provider
+}
+
+// Get the current Config
+func (provider *Provider) Get() domain.Config {
+	return provider.current.Load().conf
+}
+
+// AllowedIPs of the current Config
+func (provider *Provider) AllowedIPs() clientip.Nets {
+	return provider.current.Load().allowedIPs
+}
+
+// Set the current Config, unless its AllowedIPs are invalid
+func (provider *Provider) Set(conf domain.Config) error {
+	allowedIPs, err := clientip.ParseNets(conf.AllowedIPs)
+	if err != nil {
+		return fmt.Errorf("invalid AllowedIPs: %v", err)
+	}
+	provider.current.Store(&snapshot{conf: conf, allowedIPs: allowedIPs})
+	return nil
+}
+
+// Reload the config like Read(args), and Set the fields which can change
+// while running.  It returns the names of the fields which changed, and of
+// those which changed but need a restart to take effect.
+func Reload(provider *Provider, args []string) (changed []string, needRestart []string, err error) {
+	conf, _, err := Read(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := Validate(conf); err != nil {
+		return nil, nil, fmt.Errorf("invalid config:\n%v", err)
+	}
+	merged := provider.Get()
+	oldValue := reflect.ValueOf(&merged).Elem()
+	newValue := reflect.ValueOf(conf)
+	for _, f := range fields {
+		if format(oldValue.FieldByName(f.Name)) == format(newValue.FieldByName(f.Name)) {
+			continue
+		}
+		if !f.Live {
+			needRestart = append(needRestart, f.Name)
+			continue
+		}
+		oldValue.FieldByName(f.Name).Set(newValue.FieldByName(f.Name))
+		changed = append(changed, f.Name)
+	}
+	if len(changed) == 0 {
+		return nil, needRestart, nil
+	}
+	return changed, needRestart, provider.Set(merged)
+}
+
+// Watch the config file, and Reload provider when it changes or something is
+// received from reload (e.g. on SIGHUP), until ctx is done.  The file is
+// checked every interval.
+func Watch(ctx context.Context, provider *Provider, args []string, interval time.Duration, reload <-chan os.Signal) {
+	path := provider.Get().ConfigPath
+	lastModified := modified(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if current := modified(path); !current.Equal(lastModified) {
+				lastModified = current
+			} else {
+				continue
+			}
+		case <-reload:
+		}
+		changed, needRestart, err := Reload(provider, args)
+		if err != nil {
+			log.Printf("Failed to reload config, keeping the current one: %v\n", err)
+			continue
+		}
+		if len(needRestart) > 0 {
+			log.Printf("Config changes to %v only take effect after a restart\n", needRestart)
+		}
+		if len(changed) > 0 {
+			log.Printf("Reloaded config, changed %v\n", changed)
+		}
+	}
+}
+
+// modified time of the file at path, zero if it doesn't exist
+func modified(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"context"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	writeConfig(t, `
+Port = "8080"
+MetricsRole = "admin"
+AllowedIPs = ["localhost"]
+`)
+	conf, _, err := Read(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := NewProvider(conf)
+	if !provider.AllowedIPs().Contains(net.ParseIP("127.0.0.1")) {
+		t.Fatal("expected localhost to be allowed")
+	}
+
+	if err := os.WriteFile(conf.ConfigPath, []byte(`
+Port = "9090"
+MetricsRole = "anyone"
+AllowedIPs = ["10.0.0.0/8"]
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	changed, needRestart, err := Reload(provider, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changed, []string{"AllowedIPs", "MetricsRole"}) || !reflect.DeepEqual(needRestart, []string{"Port"}) {
+		t.Errorf("unexpected changes %v, restart needed for %v", changed, needRestart)
+	}
+	current := provider.Get()
+	if current.MetricsRole != "anyone" || current.Port != "8080" {
+		t.Errorf("expected only live fields to change, got %+v", current)
+	}
+	if provider.AllowedIPs().Contains(net.ParseIP("127.0.0.1")) || !provider.AllowedIPs().Contains(net.ParseIP("10.1.2.3")) {
+		t.Error("expected the new AllowedIPs, got", provider.AllowedIPs())
+	}
+
+	if err := os.WriteFile(conf.ConfigPath, []byte(`MetricsRole = "nobody"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Reload(provider, nil); err == nil {
+		t.Error("expected an invalid config to be rejected")
+	}
+	if provider.Get().MetricsRole != "anyone" {
+		t.Error("expected the config to be kept, got", provider.Get().MetricsRole)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	writeConfig(t, `TileServerURL = "https://a.example.com/{z}/{x}/{y}.png"`)
+	conf, _, err := Read(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := NewProvider(conf)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload := make(chan os.Signal)
+	go Watch(ctx, provider, nil, time.Hour, reload)
+
+	if err := os.WriteFile(conf.ConfigPath, []byte(`TileServerURL = "https://b.example.com/{z}/{x}/{y}.png"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reload <- os.Interrupt
+	deadline := time.Now().Add(5 * time.Second)
+	for provider.Get().TileServerURL != "https://b.example.com/{z}/{x}/{y}.png" {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the config to be reloaded, got", provider.Get().TileServerURL)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
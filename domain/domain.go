@@ -6,20 +6,197 @@
 //       the default executable filename.
 package domain
 
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is wrapped by errors of Stores when there is no object with
+// the requested ID.
+var ErrNotFound = errors.New("not found")
+
+// ErrIDExists is wrapped by errors of Stores' InsertNew when there already is
+// an object with the new object's ID.
+var ErrIDExists = errors.New("ID exists")
+
+// ErrUsernameTaken is wrapped by errors of UserStore.InsertNew when there
+// already is a User with the new User's username.
+var ErrUsernameTaken = errors.New("username taken")
+
 // == Shared Internal Structs ========
 
 // Config holds server-wide settings
 type Config struct {
 	ConfigPath             string
-	StaticPath             string
+	StaticPath             string // empty to use the embedded frontend
 	DBPath                 string
 	Port                   string
 	TileServerURL          string
 	NoLabelTileServerURL   string
-	AllowRemoteMapDeletion string
-	AllowRemoteMapCreation string
-	IsBehindProxy          string
-	AllowedIPs             []string
+	AllowRemoteMapDeletion Bool
+	AllowRemoteMapCreation Bool
+	IsBehindProxy          Bool
+	// like AllowRemoteMapCreation, for challenges of existing maps
+	AllowRemoteChallengeCreation Bool
+	// forwarding headers are only believed if set by these (CIDRs or IPs)
+	TrustedProxies []string
+	// CIDRs, IPs or "localhost" which may create and delete maps.  They're
+	// not logged, as they tell where to attack from.
+	AllowedIPs  []string `log:"redact"`
+	GeoDataPath string
+	// minimum Role for these actions, or "anyone" to allow anonymous players
+	MapCreationRole       string
+	MapDeletionRole       string
+	ChallengeCreationRole string
+	MetricsRole           string
+	// cache for the Google Maps proxy, an empty path caches in memory only
+	ProxyCachePath     string
+	ProxyCacheMemoryMB int
+	ProxyCacheDiskMB   int
+	// how long to cache responses without cache headers, e.g. "10m"
+	ProxyCacheTTL Duration
+	// where the play proxy fetches Google Maps from, and its request timeout
+	UpstreamURL     string
+	UpstreamTimeout Duration
+	// size limit of upstream responses, 0 for no limit
+	UpstreamMaxBodyMB int
+	// timeouts of the HTTP server, e.g. "30s".  WriteTimeout includes the
+	// time spent waiting for the upstream.
+	ReadHeaderTimeout Duration
+	ReadTimeout       Duration
+	WriteTimeout      Duration
+	IdleTimeout       Duration
+	// how long requests in flight may take to finish when shutting down
+	ShutdownTimeout Duration
+	// how often to garbage collect the db, "0s" never to
+	DBGCInterval Duration
+	// PEM files to serve HTTPS with, plain HTTP if empty.  They're reloaded
+	// on SIGHUP or when they change.
+	TLSCertPath string
+	TLSKeyPath  string
+	// if set, plain HTTP on this port redirects to HTTPS
+	HTTPRedirectPort string
+	// if set, admin routes need a client certificate signed by one of the
+	// CAs in this PEM file
+	AdminClientCAPath string
+	// whether /readyz fails while the upstream is unreachable
+	ReadinessCheckUpstream Bool
+	// "debug", "info", "warn" or "error", and "json" or "text"
+	LogLevel  string
+	LogFormat string
+	// requests per client IP to create maps, challenges and results and to
+	// submit guesses, e.g. "10/1h", empty for no limit
+	MapCreationRateLimit       RateLimit
+	ChallengeCreationRateLimit RateLimit
+	ResultCreationRateLimit    RateLimit
+	GuessRateLimit             RateLimit
+	// size limit of request bodies to /api
+	MaxRequestBodyKB int
+	// limits of new maps and challenges
+	MaxPolygonVertices int
+	MaxRounds          int
+	// IDs of new objects are IDLength characters of IDAlphabet.  Maps and
+	// challenges, whose IDs are in share links, get IDs of ShareIDWords words
+	// instead, unless it's 0.
+	IDLength     int
+	IDAlphabet   string
+	ShareIDWords int
+}
+
+// LogValue of the config for log/slog, without the fields tagged
+// `log:"redact"`
+func (c Config) LogValue() slog.Value {
+	value := reflect.ValueOf(c)
+	var attrs []slog.Attr
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.Tag.Get("log") == "redact" {
+			attrs = append(attrs, slog.String(field.Name, "[REDACTED]"))
+			continue
+		}
+		attrs = append(attrs, slog.Any(field.Name, value.Field(i).Interface()))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Bool config value.  Besides TOML booleans, it accepts the strings earlier
+// versions used, like "True" and "False".
+type Bool bool
+
+// UnmarshalText accepts anything strconv.ParseBool does
+func (b *Bool) UnmarshalText(text []byte) error {
+	value, err := strconv.ParseBool(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid boolean '%s', expected true or false", text)
+	}
+	*b = Bool(value)
+	return nil
+}
+
+// Duration config value, written like "1h30m" (see time.ParseDuration)
+type Duration time.Duration
+
+// UnmarshalText parses text with time.ParseDuration
+func (d *Duration) UnmarshalText(text []byte) error {
+	value, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration '%s', expected e.g. 30s or 1h30m", text)
+	}
+	*d = Duration(value)
+	return nil
+}
+
+// MarshalText formats d like "1h30m0s"
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// RateLimit config value, allowing Requests per Period in bursts of up to
+// Requests.  It's written like "10/1h", the zero RateLimit allows everything
+// and is written "".
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// UnmarshalText parses text like "10/1h", or "" for no limit
+func (limit *RateLimit) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*limit = RateLimit{}
+		return nil
+	}
+	requests, period, ok := strings.Cut(string(text), "/")
+	number, err := strconv.Atoi(requests)
+	if !ok || err != nil || number < 1 {
+		return fmt.Errorf("invalid rate limit '%s', expected e.g. 10/1h", text)
+	}
+	duration, err := time.ParseDuration(period)
+	if err != nil || duration <= 0 {
+		return fmt.Errorf("invalid rate limit '%s', expected e.g. 10/1h", text)
+	}
+	*limit = RateLimit{Requests: number, Period: duration}
+	return nil
+}
+
+// MarshalText formats limit like "10/1h0m0s"
+func (limit RateLimit) MarshalText() ([]byte, error) {
+	return []byte(limit.String()), nil
+}
+
+func (limit RateLimit) String() string {
+	if limit.Requests == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d/%s", limit.Requests, limit.Period)
 }
 
 // == Domain Enums ========
@@ -66,6 +243,39 @@ const (
 	SourceOutdoors
 )
 
+func (s PanoSource) String() string {
+	return [...]string{"any", "outdoors"}[s]
+}
+
+// Role is the enum representing what a User may do, in ascending order of
+// privilege.  Every Role may do everything the ones before it may do.
+type Role int
+
+const (
+	// RolePlayer may create challenges and play
+	RolePlayer Role = iota
+	// RoleMapCreator may also create maps
+	RoleMapCreator
+	// RoleAdmin may do anything, including deleting maps and managing users
+	RoleAdmin
+)
+
+var roleNames = [...]string{"player", "mapcreator", "admin"}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+// ParseRole is the inverse of Role.String
+func ParseRole(s string) (Role, error) {
+	for i, name := range roleNames {
+		if strings.EqualFold(s, name) {
+			return Role(i), nil
+		}
+	}
+	return RolePlayer, fmt.Errorf("unknown role '%s', expected one of %s", s, strings.Join(roleNames[:], ", "))
+}
+
 // == Domain Types and Stores ========
 // TODO: consider reducing stutter (Map.MapID, Challenge.ChallengeID, etc.)
 
@@ -95,6 +305,8 @@ type Map struct {
 // containing Maps.
 type MapStore interface {
 	Insert(Map) error
+	// InsertNew is Insert, unless the ID is taken (see ErrIDExists).
+	InsertNew(Map) error
 	Get(mapID string) (Map, error)
 	GetAll() ([]Map, error)
 	Delete(mapID string) error
@@ -111,6 +323,8 @@ type Challenge struct {
 // containing Challenges.
 type ChallengeStore interface {
 	Insert(Challenge) error
+	// InsertNew is Insert, unless the ID is taken (see ErrIDExists).
+	InsertNew(Challenge) error
 	Get(challengeID string) (Challenge, error)
 	GetList(mapID string) ([]string, error)
 	GetAll(mapID string) ([]Challenge, error)
@@ -124,6 +338,23 @@ type ChallengePlace struct {
 	ChallengeID string
 	RoundNum    int
 	Location    Coords
+	// Info is nil if the place hasn't been reverse geocoded, or if it has
+	// been redacted because the round hasn't been guessed yet.
+	Info *PlaceInfo
+}
+
+// PlaceInfo is what we know about the surroundings of a ChallengePlace.
+type PlaceInfo struct {
+	CountryCode  string // ISO 3166-1 alpha-2
+	Country      string
+	Region       string  // first-level administrative division
+	City         string  // nearest sizeable city
+	CityDistance float64 // distance to City, in meters
+}
+
+// Geocoder is implemented by structs which can reverse geocode Coords.
+type Geocoder interface {
+	Lookup(Coords) (PlaceInfo, error)
 }
 
 // ChallengeResult is a player's Guesses in a challenge.
@@ -133,22 +364,120 @@ type ChallengeResult struct {
 	ChallengeResultID string
 	ChallengeID       string
 
-	// these could potentially be replaced with UserID if we were to
-	// implement user auth/accounts
+	// UserID is empty for anonymous players.  Nickname and Icon are kept
+	// either way, so that leaderboards don't need to look up Users.
+	UserID   string
 	Nickname string
 	Icon     int
 
-	Guesses []Guess
+	Guesses   []Guess
+	CreatedAt time.Time
 }
 
 // ChallengeResultStore is implemented by structs which provide access to a
 // database containing ChallengeResults.
 type ChallengeResultStore interface {
 	Insert(ChallengeResult) error
+	// InsertNew is Insert, unless the ID is taken (see ErrIDExists).
+	InsertNew(ChallengeResult) error
 	Get(challengeResultID string) (ChallengeResult, error)
 	GetAll(challengeID string) ([]ChallengeResult, error)
 	Delete(challengeResultID string) error
 	DeleteAll(challengeID string) error
+	// GetAllByNickname returns every ChallengeResult of the player with the
+	// given nickname, in all challenges.  Nicknames are case insensitive.
+	GetAllByNickname(nickname string) ([]ChallengeResult, error)
+	// GetAllByUserID returns every ChallengeResult of the given User.
+	GetAllByUserID(userID string) ([]ChallengeResult, error)
+}
+
+// DeleteMap with the given ID, and all its Challenges and their
+// ChallengeResults.
+func DeleteMap(maps MapStore, challenges ChallengeStore, results ChallengeResultStore, mapID string) error {
+	challengeIDs, err := challenges.GetList(mapID)
+	if err != nil {
+		return fmt.Errorf("failed to get list of Challenge IDs: %v", err)
+	}
+	for _, challengeID := range challengeIDs {
+		if err := DeleteChallenge(challenges, results, challengeID); err != nil {
+			return err
+		}
+	}
+	if err := maps.Delete(mapID); err != nil {
+		return fmt.Errorf("failed to delete Map: %v", err)
+	}
+	return nil
+}
+
+// DeleteChallenge with the given ID, and all its ChallengeResults.
+func DeleteChallenge(challenges ChallengeStore, results ChallengeResultStore, challengeID string) error {
+	if err := results.DeleteAll(challengeID); err != nil {
+		return fmt.Errorf("failed to delete ChallengeResults: %v", err)
+	}
+	if err := challenges.Delete(challengeID); err != nil {
+		return fmt.Errorf("failed to delete Challenge: %v", err)
+	}
+	return nil
+}
+
+// User is a registered player.
+type User struct {
+	UserID       string
+	Username     string
+	PasswordHash []byte `json:"-"`
+	Role         Role
+	CreatedAt    time.Time
+}
+
+// UserStore is implemented by structs which provide access to a database
+// containing Users.
+type UserStore interface {
+	Insert(User) error
+	// InsertNew is Insert, unless the ID (see ErrIDExists) or the username
+	// (see ErrUsernameTaken) is taken.
+	InsertNew(User) error
+	Get(userID string) (User, error)
+	// GetByUsername is case insensitive, as are usernames in general.
+	GetByUsername(username string) (User, error)
+	GetAll() ([]User, error)
+}
+
+// APIToken lets scripts act as a User without logging in.
+// Only a hash of the secret token is stored, which doubles as the ID.
+type APIToken struct {
+	TokenID   string // hex encoded SHA-256 of the token
+	UserID    string
+	Name      string
+	CreatedAt time.Time
+}
+
+// APITokenStore is implemented by structs which provide access to a database
+// containing APITokens.
+type APITokenStore interface {
+	Insert(APIToken) error
+	Get(tokenID string) (APIToken, error)
+	GetAll(userID string) ([]APIToken, error)
+	Delete(tokenID string) error
+}
+
+// Session is a server-side browser session, identified by a cookie.
+// Anonymous players have sessions too, with an empty UserID.
+type Session struct {
+	SessionID string
+	UserID    string
+	// Results maps ChallengeIDs to the ChallengeResultID played in this
+	// session, LastChallengeID is the most recently joined of those.
+	Results         map[string]string
+	LastChallengeID string
+	ExpiresAt       time.Time
+}
+
+// SessionStore is implemented by structs which provide access to a database
+// containing Sessions.
+type SessionStore interface {
+	Insert(Session) error
+	Get(sessionID string) (Session, error)
+	Delete(sessionID string) error
 }
 
 // Guess is a guessed location for one pano in a Challenge.
@@ -158,9 +487,46 @@ type Guess struct {
 	Location          Coords
 }
 
+// PlayerStats aggregates all ChallengeResults of a player.
+type PlayerStats struct {
+	Nickname       string
+	GamesPlayed    int
+	RoundsPlayed   int
+	PerfectRounds  int
+	AverageScore   float64 // per round
+	MedianDistance float64 // in meters
+	BestRound      *RoundStats
+	WorstRound     *RoundStats
+	Trend          []GameStats // ordered by CreatedAt
+}
+
+// RoundStats is the outcome of a single Guess.
+type RoundStats struct {
+	ChallengeID       string
+	ChallengeResultID string
+	RoundNum          int
+	Score             int
+	Distance          float64 // in meters
+}
+
+// GameStats is the outcome of a single ChallengeResult.
+type GameStats struct {
+	ChallengeID       string
+	ChallengeResultID string
+	CreatedAt         time.Time
+	RoundsPlayed      int
+	Score             int
+}
+
 // Coords in degrees plus PanoID
 type Coords struct {
 	Lat    float64
 	Lng    float64
 	PanoID string
 }
+
+// LogValue of Coords for log/slog, which is always redacted, as they could be
+// the answer to a round
+func (coords Coords) LogValue() slog.Value {
+	return slog.StringValue("[REDACTED]")
+}
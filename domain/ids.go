@@ -0,0 +1,106 @@
+package domain
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// IDGenerator makes IDs for new objects with crypto/rand.  IDs of
+// ChallengeResults are bearer credentials, so they must not be guessable.
+type IDGenerator struct {
+	// Length characters of Alphabet
+	Length   int
+	Alphabet string
+	// Words, if not 0, makes IDs of this many words from IDWords instead,
+	// like "amber-otter-maple-tide", which are easier to share
+	Words int
+}
+
+// New random ID
+func (gen IDGenerator) New() (string, error) {
+	if gen.Words > 0 {
+		words := make([]string, gen.Words)
+		for i := range words {
+			n, err := randIntn(len(IDWords))
+			if err != nil {
+				return "", err
+			}
+			words[i] = IDWords[n]
+		}
+		return strings.Join(words, "-"), nil
+	}
+	alphabet := []rune(gen.Alphabet)
+	if gen.Length < 1 || len(alphabet) < 2 {
+		return "", fmt.Errorf("invalid ID generator, length %d of %d characters", gen.Length, len(alphabet))
+	}
+	id := make([]rune, gen.Length)
+	for i := range id {
+		n, err := randIntn(len(alphabet))
+		if err != nil {
+			return "", err
+		}
+		id[i] = alphabet[n]
+	}
+	return string(id), nil
+}
+
+// IDs generates IDs for new objects with c
+func (c Config) IDs() IDGenerator {
+	return IDGenerator{Length: c.IDLength, Alphabet: c.IDAlphabet}
+}
+
+// ShareIDs generates IDs for new objects whose IDs are in share links, i.e.
+// Maps and Challenges, with c
+func (c Config) ShareIDs() IDGenerator {
+	ids := c.IDs()
+	ids.Words = c.ShareIDWords
+	return ids
+}
+
+// randIntn returns a uniformly random int in [0, n)
+func randIntn(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read random number: %v", err)
+	}
+	return int(i.Int64()), nil
+}
+
+// IDWords are short, distinct, inoffensive words for IDGenerator.Words.
+// There are 256 of them, so each word is 8 bits of an ID.
+var IDWords = []string{
+	"acorn", "agate", "alder", "alpine", "amber", "anchor", "apple", "apricot",
+	"arch", "arctic", "aspen", "atlas", "autumn", "badger", "bamboo", "banjo",
+	"barley", "basil", "bay", "beacon", "beam", "bear", "beech", "berry",
+	"birch", "bison", "blossom", "bluff", "bramble", "breeze", "brook", "cactus",
+	"camel", "canal", "canyon", "cape", "cedar", "cello", "chalk", "cherry",
+	"chestnut", "cinder", "citrus", "clay", "cliff", "cloud", "clover", "cobalt",
+	"comet", "copper", "coral", "cove", "crane", "creek", "crest", "cricket",
+	"crystal", "cypress", "daisy", "delta", "desert", "dew", "dingo", "dolphin",
+	"dove", "dune", "dusk", "eagle", "echo", "elk", "elm", "ember",
+	"falcon", "fern", "field", "fig", "finch", "fjord", "flint", "forest",
+	"fox", "frost", "garnet", "gecko", "geyser", "ginger", "glacier", "glade",
+	"granite", "grove", "gull", "harbor", "hare", "hazel", "heath", "heron",
+	"hill", "holly", "honey", "horizon", "husky", "ibis", "iris", "island",
+	"ivory", "ivy", "jade", "jasmine", "jasper", "juniper", "kelp", "kestrel",
+	"kite", "koala", "lagoon", "lake", "larch", "lark", "laurel", "lava",
+	"lemon", "lichen", "lily", "lime", "linden", "llama", "lotus", "lynx",
+	"magnet", "mango", "maple", "marble", "marsh", "meadow", "mesa", "mint",
+	"mist", "moon", "moose", "moss", "mountain", "nectar", "nova", "oak",
+	"oasis", "ocean", "olive", "onyx", "opal", "orbit", "orchid", "osprey",
+	"otter", "owl", "oyster", "palm", "panda", "papaya", "pass", "peach",
+	"peak", "pearl", "pebble", "pelican", "pepper", "petal", "pine", "plain",
+	"plum", "polar", "pond", "poppy", "prairie", "puffin", "quail", "quartz",
+	"rain", "raven", "reed", "reef", "ridge", "river", "robin", "rock",
+	"rose", "ruby", "saffron", "sage", "salmon", "sand", "sapphire", "savanna",
+	"seal", "shell", "shore", "sierra", "silver", "sky", "slate", "snow",
+	"sparrow", "spruce", "star", "steppe", "stone", "storm", "stream", "summit",
+	"sun", "swan", "taiga", "thistle", "thunder", "tide", "tiger", "timber",
+	"topaz", "torch", "trail", "tulip", "tundra", "turtle", "valley", "velvet",
+	"violet", "volcano", "walnut", "walrus", "wave", "willow", "wind", "wolf",
+	"wren", "yak", "yarrow", "yew", "zebra", "zenith", "zephyr", "zinc",
+	"basalt", "bluebell", "brine", "butte", "caribou", "cirrus", "condor", "cosmos",
+	"dahlia", "ermine", "estuary", "ferret", "gazelle", "gorge", "hollow", "indigo",
+}
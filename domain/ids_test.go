@@ -0,0 +1,51 @@
+package domain
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIDGenerator(t *testing.T) {
+	ids := IDGenerator{Length: 16, Alphabet: "abc"}
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		id, err := ids.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(id) != 16 || strings.Trim(id, "abc") != "" {
+			t.Fatalf("expected 16 characters of abc, got %s", id)
+		}
+		seen[id] = true
+	}
+	// 3^16 IDs, 100 of them shouldn't repeat
+	if len(seen) != 100 {
+		t.Errorf("expected 100 distinct IDs, got %d", len(seen))
+	}
+
+	words := make(map[string]bool)
+	for _, word := range IDWords {
+		words[word] = true
+	}
+	if len(words) != 256 {
+		t.Errorf("expected 256 distinct words, got %d", len(words))
+	}
+	ids.Words = 4
+	id, err := ids.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(id, "-")
+	if len(parts) != 4 {
+		t.Fatalf("expected 4 words, got %s", id)
+	}
+	for _, part := range parts {
+		if !words[part] {
+			t.Errorf("%s of %s isn't one of IDWords", part, id)
+		}
+	}
+
+	if _, err := (IDGenerator{Length: 16, Alphabet: "a"}).New(); err == nil {
+		t.Error("expected an alphabet of 1 character to be rejected")
+	}
+}
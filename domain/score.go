@@ -0,0 +1,35 @@
+package domain
+
+import "math"
+
+// Scoring, ported from frontend/src/js/earthwalker.js.
+// Keep the two in sync, or scores shown in stats won't match the game.
+
+const (
+	earthArea    = 510066000000000
+	earthSqrt    = 22584640
+	halfDistance = 1000000
+	decayBase    = 2
+	// MaxScore is awarded for a guess within a Map's GraceDistance
+	MaxScore = 5000
+)
+
+// ScoreDistance returns the score and the distance in meters of guess,
+// given the actual location of the pano, the Map's graceDistance (in meters)
+// and the area of its Polygon (in square meters, 0 if there is none).
+func ScoreDistance(guess Coords, actual Coords, graceDistance int, area float64) (int, float64) {
+	if area == 0 {
+		area = earthArea
+	}
+	distance := Distance(guess, actual)
+	// guesses which aren't on the map (e.g. the round timed out) score zero
+	if !guess.Valid() {
+		return 0, distance
+	}
+	if distance < float64(graceDistance) {
+		return MaxScore, distance
+	}
+	relativeArea := math.Sqrt(area) / earthSqrt
+	factor := math.Pow(decayBase, -1*(distance-float64(graceDistance))/(halfDistance*relativeArea))
+	return int(math.Round(factor * MaxScore)), distance
+}
@@ -1,15 +1,24 @@
 package domain
 
-import "math/rand"
-
-// RandAlpha generates a length n pseudo-random string of ascii letters
-// We use these as IDs.  Keep in mind that collisions, while unlikely,
-// are possible.
-func RandAlpha(n int) string {
-	var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
-	}
-	return string(b)
+import (
+	"math"
+)
+
+// earthRadius in meters, same as in the frontend
+const earthRadius = 6371009
+
+// Distance in meters between a and b along a great circle
+func Distance(a, b Coords) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// Valid is false if c is not a location on earth
+func (c Coords) Valid() bool {
+	return math.Abs(c.Lat) <= 90 && math.Abs(c.Lng) <= 180
 }
@@ -0,0 +1,159 @@
+// Package geocode reverse geocodes Coords using offline GeoNames datasets.
+// Nothing is requested from the network: the dataset files are read once at
+// startup and kept in memory.
+//
+// The files can be downloaded from https://download.geonames.org/export/dump/
+// and must be placed together in one directory:
+//   - cities15000.txt (or another citiesN.txt, renamed)
+//   - admin1CodesASCII.txt
+//   - countryInfo.txt
+package geocode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+const (
+	citiesFile    = "cities15000.txt"
+	admin1File    = "admin1CodesASCII.txt"
+	countriesFile = "countryInfo.txt"
+)
+
+type city struct {
+	name        string
+	location    domain.Coords
+	countryCode string
+	admin1Code  string
+}
+
+// Offline is a domain.Geocoder backed by GeoNames dumps.
+// Country and Region are those of the nearest city, so places near borders
+// may occasionally be attributed to the neighbouring country or region.
+type Offline struct {
+	cities    []city
+	admin1    map[string]string // "CC.code" -> name
+	countries map[string]string // "CC" -> name
+}
+
+// Load the GeoNames files from dir into a new Offline geocoder
+func Load(dir string) (*Offline, error) {
+	geocoder := &Offline{}
+	var err error
+	geocoder.cities, err = readCities(filepath.Join(dir, citiesFile))
+	if err != nil {
+		return nil, err
+	}
+	if len(geocoder.cities) == 0 {
+		return nil, fmt.Errorf("no cities in '%s'", filepath.Join(dir, citiesFile))
+	}
+	// admin1 codes: CC.code, name, ascii name, geonameid
+	geocoder.admin1, err = readNames(filepath.Join(dir, admin1File), 0, 1)
+	if err != nil {
+		return nil, err
+	}
+	// country info: ISO, ISO3, ISO-Numeric, fips, Country, ...
+	geocoder.countries, err = readNames(filepath.Join(dir, countriesFile), 0, 4)
+	if err != nil {
+		return nil, err
+	}
+	return geocoder, nil
+}
+
+// Lookup the country, region and nearest city of location
+func (geocoder *Offline) Lookup(location domain.Coords) (domain.PlaceInfo, error) {
+	if !location.Valid() {
+		return domain.PlaceInfo{}, fmt.Errorf("coordinates out of range: %f, %f", location.Lat, location.Lng)
+	}
+	nearest := -1
+	nearestDistance := 0.0
+	for i := range geocoder.cities {
+		distance := domain.Distance(location, geocoder.cities[i].location)
+		if nearest < 0 || distance < nearestDistance {
+			nearest = i
+			nearestDistance = distance
+		}
+	}
+	c := geocoder.cities[nearest]
+	return domain.PlaceInfo{
+		CountryCode:  c.countryCode,
+		Country:      geocoder.countries[c.countryCode],
+		Region:       geocoder.admin1[c.countryCode+"."+c.admin1Code],
+		City:         c.name,
+		CityDistance: nearestDistance,
+	}, nil
+}
+
+func readCities(path string) ([]city, error) {
+	var cities []city
+	err := readTSV(path, func(fields []string) error {
+		// geonameid, name, asciiname, alternatenames, latitude, longitude,
+		// feature class, feature code, country code, cc2, admin1 code, ...
+		if len(fields) < 11 {
+			return fmt.Errorf("expected at least 11 fields, got %d", len(fields))
+		}
+		lat, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			return fmt.Errorf("invalid latitude: %v", err)
+		}
+		lng, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			return fmt.Errorf("invalid longitude: %v", err)
+		}
+		cities = append(cities, city{
+			name:        fields[1],
+			location:    domain.Coords{Lat: lat, Lng: lng},
+			countryCode: fields[8],
+			admin1Code:  fields[10],
+		})
+		return nil
+	})
+	return cities, err
+}
+
+func readNames(path string, keyField int, nameField int) (map[string]string, error) {
+	names := make(map[string]string)
+	err := readTSV(path, func(fields []string) error {
+		if len(fields) <= keyField || len(fields) <= nameField {
+			return fmt.Errorf("expected at least %d fields, got %d", nameField+1, len(fields))
+		}
+		names[fields[keyField]] = fields[nameField]
+		return nil
+	})
+	return names, err
+}
+
+// readTSV calls handleLine with the fields of every line in the file at path,
+// skipping empty lines and comments
+func readTSV(path string, handleLine func(fields []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open geonames file: %v", err)
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	lineNum := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read '%s': %v", path, err)
+		}
+		lineNum++
+		trimmed := strings.TrimRight(line, "\r\n")
+		if len(trimmed) > 0 && !strings.HasPrefix(trimmed, "#") {
+			if lineErr := handleLine(strings.Split(trimmed, "\t")); lineErr != nil {
+				return fmt.Errorf("'%s' line %d: %v", path, lineNum, lineErr)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
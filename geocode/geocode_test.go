@@ -0,0 +1,47 @@
+package geocode
+
+import (
+	"testing"
+
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+func TestLookup(t *testing.T) {
+	geocoder, err := Load("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		location domain.Coords
+		country  string
+		region   string
+		city     string
+	}{
+		// Garmisch-Partenkirchen
+		{domain.Coords{Lat: 47.492, Lng: 11.095}, "Germany", "Bavaria", "Munich"},
+		// Potsdam
+		{domain.Coords{Lat: 52.391, Lng: 13.064}, "Germany", "Berlin", "Berlin"},
+		// Versailles
+		{domain.Coords{Lat: 48.804, Lng: 2.120}, "France", "Île-de-France", "Paris"},
+	}
+	for _, test := range tests {
+		info, err := geocoder.Lookup(test.location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Country != test.country || info.Region != test.region || info.City != test.city {
+			t.Errorf("got %+v for %v, expected %s, %s, %s",
+				info, test.location, test.city, test.region, test.country)
+		}
+	}
+}
+
+func TestLookupOutOfRange(t *testing.T) {
+	geocoder, err := Load("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := geocoder.Lookup(domain.Coords{Lat: 91}); err == nil {
+		t.Error("expected an error for latitude 91")
+	}
+}
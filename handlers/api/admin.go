@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gitlab.com/glatteis/earthwalker/apierror"
+	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/logging"
+)
+
+// Admin endpoints.  Authorization is left to an auth.Policy wrapping this.
+type Admin struct {
+	UserStore domain.UserStore
+}
+
+func (handler Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	head, tail := shiftPath(r.URL.Path)
+	switch head {
+	case "users":
+		userID, tail := shiftPath(tail)
+		field, _ := shiftPath(tail)
+		switch {
+		case len(userID) == 0 && r.Method == http.MethodGet:
+			users, err := handler.UserStore.GetAll()
+			if err != nil {
+				apierror.Send(w, "failed to get users from store", http.StatusInternalServerError)
+				logging.FromContext(r.Context()).Error("Failed to get users from store", "err", err)
+				return
+			}
+			json.NewEncoder(w).Encode(users)
+		case len(userID) > 0 && field == "role" && r.Method == http.MethodPut:
+			handler.setRole(w, r, userID)
+		default:
+			apierror.Send(w, "api/admin/users endpoint does not exist.", http.StatusNotFound)
+		}
+	default:
+		apierror.Send(w, "api/admin endpoint does not exist.", http.StatusNotFound)
+	}
+}
+
+func (handler Admin) setRole(w http.ResponseWriter, r *http.Request, userID string) {
+	var request struct{ Role string }
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		apierror.Send(w, "failed to decode role from request", http.StatusBadRequest)
+		return
+	}
+	role, err := domain.ParseRole(request.Role)
+	if err != nil {
+		apierror.Send(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, err := handler.UserStore.Get(userID)
+	if err != nil {
+		apierror.Send(w, "user not found", http.StatusNotFound)
+		return
+	}
+	user.Role = role
+	err = handler.UserStore.Insert(user)
+	if err != nil {
+		apierror.Send(w, "failed to insert user into store", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to insert user into store", "err", err)
+		return
+	}
+	json.NewEncoder(w).Encode(user)
+}
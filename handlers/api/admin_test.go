@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.com/glatteis/earthwalker/auth"
+	"gitlab.com/glatteis/earthwalker/config"
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+func TestRoleAuthorization(t *testing.T) {
+	users := memUserStore{}
+	tokens := memAPITokenStore{}
+	sessions := auth.Sessions{Store: memSessionStore{}}
+	policy := auth.Policy{
+		Config: config.NewProvider(withIDs(domain.Config{
+			MapCreationRole: "mapcreator",
+			MapDeletionRole: "admin",
+		})),
+		Sessions:   sessions,
+		UserStore:  users,
+		TokenStore: tokens,
+	}
+	maps := memMapStore{}
+	handler := Root{
+		MapsHandler: policy.Protect(auth.Rules{
+			http.MethodPost:   auth.ActionCreateMap,
+			http.MethodDelete: auth.ActionDeleteMap,
+		}, Maps{
+			MapStore:         maps,
+			Config:           policy.Config,
+			MapDeleteHandler: MapDelete{MapStore: maps, ChallengeStore: memChallengeStore{}, ChallengeResultStore: memChallengeResultStore{}},
+		}),
+		UsersHandler:    Users{UserStore: users, Sessions: sessions, Config: policy.Config},
+		SessionsHandler: Sessions{UserStore: users, Sessions: sessions},
+		TokensHandler:   Tokens{TokenStore: tokens, Policy: policy},
+		AdminHandler:    policy.Require(auth.ActionAdmin, Admin{UserStore: users}),
+	}
+
+	register := func(name string) (*http.Cookie, domain.User) {
+		rec := do(t, handler, "POST", "/users", `{"Username": "`+name+`", "Password": "password123"}`)
+		var user domain.User
+		if err := json.NewDecoder(rec.Body).Decode(&user); err != nil {
+			t.Fatal(err)
+		}
+		return sessionCookie(rec), user
+	}
+	playerCookie, player := register("player")
+	rootCookie, _ := register("root")
+
+	// admins are only made with the CLI, not by their name
+	if rec := do(t, handler, "PUT", "/admin/users/"+player.UserID+"/role", `{"Role": "mapcreator"}`, rootCookie); rec.Code != http.StatusForbidden {
+		t.Errorf("promotion by a user named root: got status %d", rec.Code)
+	}
+	root, _ := users.GetByUsername("root")
+	root.Role = domain.RoleAdmin
+	users.Insert(root)
+
+	if rec := do(t, handler, "POST", "/maps", `{}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous map creation: got status %d", rec.Code)
+	}
+	if rec := do(t, handler, "POST", "/maps", `{}`, playerCookie); rec.Code != http.StatusForbidden {
+		t.Errorf("map creation by a player: got status %d", rec.Code)
+	}
+	if rec := do(t, handler, "GET", "/maps/all", ""); rec.Code != http.StatusOK {
+		t.Errorf("anonymous map listing: got status %d", rec.Code)
+	}
+	if rec := do(t, handler, "PUT", "/admin/users/"+player.UserID+"/role", `{"Role": "admin"}`, playerCookie); rec.Code != http.StatusForbidden {
+		t.Errorf("self promotion: got status %d", rec.Code)
+	}
+
+	// promote the player, then act as them with an API token
+	if rec := do(t, handler, "PUT", "/admin/users/"+player.UserID+"/role", `{"Role": "mapcreator"}`, rootCookie); rec.Code != http.StatusOK {
+		t.Fatalf("promotion by an admin: got status %d: %s", rec.Code, rec.Body)
+	}
+	rec := do(t, handler, "POST", "/tokens", `{"Name": "script"}`, playerCookie)
+	var token newToken
+	if err := json.NewDecoder(rec.Body).Decode(&token); err != nil || len(token.Token) == 0 {
+		t.Fatalf("got token %+v (%v)", token, err)
+	}
+	if _, ok := tokens[token.Token]; ok {
+		t.Error("API token secret is stored in plain text")
+	}
+	createMap := func(authorization string) int {
+		req, err := http.NewRequest("POST", "/maps", strings.NewReader(`{"Name": "m", "NumRounds": 5}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", authorization)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	if code := createMap("Bearer " + token.Token); code != http.StatusOK {
+		t.Errorf("map creation with a mapcreator's token: got status %d", code)
+	}
+	if code := createMap("Bearer ew_wrong"); code != http.StatusUnauthorized {
+		t.Errorf("map creation with a wrong token: got status %d", code)
+	}
+	if rec := do(t, handler, "DELETE", "/maps/x", "", playerCookie); rec.Code != http.StatusForbidden {
+		t.Errorf("map deletion by a mapcreator: got status %d", rec.Code)
+	}
+	if rec := do(t, handler, "DELETE", "/maps/x", "", rootCookie); rec.Code != http.StatusOK {
+		t.Errorf("map deletion by an admin: got status %d", rec.Code)
+	}
+}
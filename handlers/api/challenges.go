@@ -1,16 +1,29 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 
+	"gitlab.com/glatteis/earthwalker/apierror"
+	"gitlab.com/glatteis/earthwalker/auth"
+	"gitlab.com/glatteis/earthwalker/config"
 	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/logging"
 )
 
 type Challenges struct {
-	ChallengeStore domain.ChallengeStore
+	MapStore             domain.MapStore
+	ChallengeStore       domain.ChallengeStore
+	ChallengeResultStore domain.ChallengeResultStore
+	// to check that the result whose rounds' Info is requested is the
+	// requester's
+	Sessions auth.Sessions
+	// Geocoder may be nil, in which case Places aren't annotated
+	Geocoder domain.Geocoder
+	// the current config, for the limits of new challenges
+	Config *config.Provider
 }
 
 func (handler Challenges) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -18,46 +31,100 @@ func (handler Challenges) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		challengeID, _ := shiftPath(r.URL.Path)
 		if len(challengeID) == 0 || challengeID == "/" {
-			sendError(w, "missing challenge id", http.StatusBadRequest)
+			apierror.Send(w, "missing challenge id", http.StatusBadRequest)
 			return
 		}
 		foundChallenge, err := handler.ChallengeStore.Get(challengeID)
 		if err != nil {
-			sendError(w, "failed to get challenge from store", http.StatusInternalServerError)
-			log.Printf("Failed to get challenge from store: %v\n", err)
+			apierror.Send(w, "failed to get challenge from store", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to get challenge from store", "err", err)
 			return
 		}
-		json.NewEncoder(w).Encode(foundChallenge)
+		json.NewEncoder(w).Encode(handler.redactInfo(r, foundChallenge, r.URL.Query().Get("result")))
 	case http.MethodPost:
 		newChallenge, err := challengeFromRequest(r)
 		if err != nil {
-			sendError(w, "failed to create challenge from request", http.StatusInternalServerError)
-			log.Printf("Failed to create challenge from request: %v\n", err)
+			sendRequestError(w, r, "failed to create challenge from request", err)
 			return
 		}
-		err = handler.ChallengeStore.Insert(newChallenge)
+		if err := validateChallenge(newChallenge, handler.MapStore, handler.Config.Get()); err != nil {
+			sendRequestError(w, r, "invalid challenge", err)
+			return
+		}
+		handler.annotatePlaces(r.Context(), &newChallenge)
+		newChallenge.ChallengeID, err = insertNew(handler.Config.Get().ShareIDs(), func(id string) error {
+			newChallenge.ChallengeID = id
+			for i := range newChallenge.Places {
+				newChallenge.Places[i].ChallengeID = id
+			}
+			return handler.ChallengeStore.InsertNew(newChallenge)
+		})
 		if err != nil {
-			sendError(w, "failed to insert challenge into store", http.StatusInternalServerError)
-			log.Printf("Failed to insert challenge into store: %v\n", err)
+			apierror.Send(w, "failed to insert challenge into store", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to insert challenge into store", "err", err)
 			return
 		}
-		json.NewEncoder(w).Encode(newChallenge)
+		json.NewEncoder(w).Encode(handler.redactInfo(r, newChallenge, ""))
 	default:
-		sendError(w, "api/challenges endpoint does not exist.", http.StatusNotFound)
+		apierror.Send(w, "api/challenges endpoint does not exist.", http.StatusNotFound)
+	}
+}
+
+// annotatePlaces of challenge with reverse geocoded PlaceInfo.
+// Failures are logged, the place just won't have Info.
+func (handler Challenges) annotatePlaces(ctx context.Context, challenge *domain.Challenge) {
+	if handler.Geocoder == nil {
+		return
+	}
+	for i := range challenge.Places {
+		info, err := handler.Geocoder.Lookup(challenge.Places[i].Location)
+		if err != nil {
+			logging.FromContext(ctx).Error("Failed to geocode round",
+				"round", challenge.Places[i].RoundNum, "challenge_id", challenge.ChallengeID, "err", err)
+			continue
+		}
+		challenge.Places[i].Info = &info
+	}
+}
+
+// redactInfo returns a copy of challenge with Info removed from every Place
+// which hasn't been guessed yet in the ChallengeResult with ID resultID.
+// If there is no such result, or it isn't the requester's, all Info is removed.
+// Info is derived from the location but, unlike the pano itself, is
+// readable text, so it must never reach the client before the guess.
+func (handler Challenges) redactInfo(r *http.Request, challenge domain.Challenge, resultID string) domain.Challenge {
+	numGuessed := 0
+	if len(resultID) > 0 && handler.ChallengeResultStore != nil {
+		result, err := handler.ChallengeResultStore.Get(resultID)
+		if err == nil && result.ChallengeID == challenge.ChallengeID && ownsResult(handler.Sessions, r, result) {
+			numGuessed = len(result.Guesses)
+		}
+	}
+	places := make([]domain.ChallengePlace, len(challenge.Places))
+	for i, place := range challenge.Places {
+		if place.RoundNum >= numGuessed {
+			place.Info = nil
+		}
+		places[i] = place
 	}
+	challenge.Places = places
+	return challenge
 }
 
 func challengeFromRequest(r *http.Request) (domain.Challenge, error) {
 	newChallenge := domain.Challenge{
 		Places: make([]domain.ChallengePlace, 0),
 	}
-	err := json.NewDecoder(r.Body).Decode(&newChallenge)
+	err := decodeRequest(r, &newChallenge)
 	if err != nil {
-		return newChallenge, fmt.Errorf("failed to decode newChallenge from request: %v", err)
+		return newChallenge, fmt.Errorf("failed to decode newChallenge from request: %w", err)
 	}
-	newChallenge.ChallengeID = domain.RandAlpha(10)
+	// the ID is set when inserting
+	newChallenge.ChallengeID = ""
 	for i := range newChallenge.Places {
-		newChallenge.Places[i].ChallengeID = newChallenge.ChallengeID
+		newChallenge.Places[i].ChallengeID = ""
+		// Info is only ever set by the server
+		newChallenge.Places[i].Info = nil
 	}
 	return newChallenge, nil
 }
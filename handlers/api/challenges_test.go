@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gitlab.com/glatteis/earthwalker/auth"
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+func TestChallengeInfoRedacted(t *testing.T) {
+	info := &domain.PlaceInfo{CountryCode: "DE", Country: "Germany", Region: "Bavaria", City: "Munich"}
+	challengeStore := memChallengeStore{"c": domain.Challenge{
+		ChallengeID: "c",
+		Places: []domain.ChallengePlace{
+			{ChallengeID: "c", RoundNum: 0, Info: info},
+			{ChallengeID: "c", RoundNum: 1, Info: info},
+		},
+	}}
+	resultStore := memChallengeResultStore{
+		"r":     {ChallengeResultID: "r", ChallengeID: "c", Guesses: []domain.Guess{{RoundNum: 0}}},
+		"other": {ChallengeResultID: "other", ChallengeID: "d", Guesses: []domain.Guess{{RoundNum: 0}, {RoundNum: 1}}},
+	}
+	// the session in which r and other were started
+	sessionStore := memSessionStore{"s": {SessionID: "s", Results: map[string]string{"c": "r", "d": "other"}}}
+	handler := Root{ChallengesHandler: Challenges{
+		ChallengeStore:       challengeStore,
+		ChallengeResultStore: resultStore,
+		Sessions:             auth.Sessions{Store: sessionStore},
+	}}
+
+	tests := []struct {
+		url      string
+		session  bool
+		expected []bool // whether each round should have Info
+	}{
+		{"/challenges/c", true, []bool{false, false}},
+		{"/challenges/c?result=r", true, []bool{true, false}},
+		{"/challenges/c?result=r", false, []bool{false, false}},
+		{"/challenges/c?result=other", true, []bool{false, false}},
+		{"/challenges/c?result=missing", true, []bool{false, false}},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.session {
+			req.AddCookie(&http.Cookie{Name: auth.SessionCookieName, Value: "s"})
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if status := recorder.Code; status != http.StatusOK {
+			t.Fatalf("%s: got status code %v, expected %v", test.url, status, http.StatusOK)
+		}
+		var challenge domain.Challenge
+		if err := json.NewDecoder(recorder.Body).Decode(&challenge); err != nil {
+			t.Fatal(err)
+		}
+		for i, place := range challenge.Places {
+			if (place.Info != nil) != test.expected[i] {
+				t.Errorf("%s, in session %v: round %d has Info %v, expected Info: %v", test.url, test.session, i, place.Info, test.expected[i])
+			}
+		}
+	}
+	if challengeStore["c"].Places[1].Info == nil {
+		t.Error("redaction modified the stored challenge")
+	}
+}
@@ -2,42 +2,46 @@ package api
 
 import (
 	"fmt"
-	"log"
 	"net/http"
-	"strings"
+	"strconv"
 
-	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/apierror"
+	"gitlab.com/glatteis/earthwalker/config"
+	"gitlab.com/glatteis/earthwalker/logging"
 )
 
 type Config struct {
-	Config domain.Config
+	// the current config, which may be reloaded
+	Config *config.Provider
 }
 
 func (handler Config) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, fmt.Sprintf("api/config accepts only GET requests, not '%s'.", r.Method), http.StatusNotFound)
+		apierror.Send(w, fmt.Sprintf("api/config accepts only GET requests, not '%s'.", r.Method), http.StatusNotFound)
+		return
 	}
+	conf := handler.Config.Get()
 	var respJSON string
 	switch head, _ := shiftPath(r.URL.Path); head {
 	case "tileserver":
-		respJSON = "{\"tileserver\": \"" + handler.Config.TileServerURL + "\"}"
+		respJSON = "{\"tileserver\": \"" + conf.TileServerURL + "\"}"
 	case "nolabeltileserver":
-		respJSON = "{\"tileserver\": \"" + handler.Config.NoLabelTileServerURL + "\"}"
+		respJSON = "{\"tileserver\": \"" + conf.NoLabelTileServerURL + "\"}"
 	case "allowremotemapdeletion":
-		respJSON = "{\"allowremotemapdeletion\": \"" + handler.Config.AllowRemoteMapDeletion + "\"}"
+		respJSON = "{\"allowremotemapdeletion\": \"" + strconv.FormatBool(bool(conf.AllowRemoteMapDeletion)) + "\"}"
 	case "allowremotemapcreation":
-		respJSON = "{\"allowremotemapcreation\": \"" + handler.Config.AllowRemoteMapCreation + "\"}"	
+		respJSON = "{\"allowremotemapcreation\": \"" + strconv.FormatBool(bool(conf.AllowRemoteMapCreation)) + "\"}"
+	case "allowremotechallengecreation":
+		respJSON = "{\"allowremotechallengecreation\": \"" + strconv.FormatBool(bool(conf.AllowRemoteChallengeCreation)) + "\"}"
 	case "isbehindproxy":
-		respJSON = "{\"isbehindproxy\": \"" + handler.Config.IsBehindProxy + "\"}"	
-	case "allowedips":
-		respJSON = "{\"allowedips\": \"" + strings.Join(handler.Config.AllowedIPs, ",") + "\"}"
+		respJSON = "{\"isbehindproxy\": \"" + strconv.FormatBool(bool(conf.IsBehindProxy)) + "\"}"
 	default:
-		sendError(w, fmt.Sprintf("api/config endpoint '%s' does not exist.", r.URL.Path), http.StatusNotFound)
+		apierror.Send(w, fmt.Sprintf("api/config endpoint '%s' does not exist.", r.URL.Path), http.StatusNotFound)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_, err := w.Write([]byte(respJSON))
 	if err != nil {
-		log.Printf("Error writing response: %v\n", err)
+		logging.FromContext(r.Context()).Error("Error writing response", "err", err)
 	}
 }
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"gitlab.com/glatteis/earthwalker/config"
 	"gitlab.com/glatteis/earthwalker/domain"
 )
 
@@ -16,7 +18,7 @@ func TestGetTileServer(t *testing.T) {
 	}
 	recorder := httptest.NewRecorder()
 	conf := domain.Config{TileServerURL: "https://mt.google.com/vt/lyrs=m&hl=en&x={x}&y={y}&z={z}"}
-	handler := Root{ConfigHandler: Config{Config: conf}}
+	handler := Root{ConfigHandler: Config{Config: config.NewProvider(conf)}}
 
 	handler.ServeHTTP(recorder, req)
 	if status := recorder.Code; status != http.StatusOK {
@@ -35,7 +37,7 @@ func TestGetNoLabelTileServer(t *testing.T) {
 	}
 	recorder := httptest.NewRecorder()
 	conf := domain.Config{NoLabelTileServerURL: "https://mt.google.com/vt/lyrs=s&hl=en&x={x}&y={y}&z={z}"}
-	handler := Root{ConfigHandler: Config{Config: conf}}
+	handler := Root{ConfigHandler: Config{Config: config.NewProvider(conf)}}
 
 	handler.ServeHTTP(recorder, req)
 	if status := recorder.Code; status != http.StatusOK {
@@ -46,3 +48,16 @@ func TestGetNoLabelTileServer(t *testing.T) {
 		t.Errorf("got response body %v, expected %v", recorder.Body.String(), expected)
 	}
 }
+
+func TestConfigOnlyGet(t *testing.T) {
+	conf := domain.Config{TileServerURL: "https://mt.google.com/vt/lyrs=m&hl=en&x={x}&y={y}&z={z}"}
+	handler := Root{ConfigHandler: Config{Config: config.NewProvider(conf)}}
+
+	recorder := do(t, handler, "POST", "/config/tileserver", "")
+	if status := recorder.Code; status != http.StatusNotFound {
+		t.Errorf("got status code %v, expected %v", status, http.StatusNotFound)
+	}
+	if strings.Contains(recorder.Body.String(), "tileserver\"") || recorder.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected only a JSON error, got %s", recorder.Body.String())
+	}
+}
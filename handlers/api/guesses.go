@@ -3,55 +3,63 @@ package api
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 
+	"gitlab.com/glatteis/earthwalker/apierror"
+	"gitlab.com/glatteis/earthwalker/auth"
 	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/logging"
+	"gitlab.com/glatteis/earthwalker/metrics"
 )
 
 type Guesses struct {
+	ChallengeStore       domain.ChallengeStore
 	ChallengeResultStore domain.ChallengeResultStore
+	Sessions             auth.Sessions
+	// Submitted counts guesses, may be nil
+	Submitted *metrics.Counter
 }
 
 func (handler Guesses) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
-		log.Println("handling guess POST!")
 		newGuess, err := guessFromRequest(r)
 		if err != nil {
-			sendError(w, "failed to create guess from request", http.StatusInternalServerError)
-			log.Printf("Failed to create guess from request: %v\n", err)
+			sendRequestError(w, r, "failed to create guess from request", err)
 			return
 		}
-		result, err := handler.ChallengeResultStore.Get(newGuess.ChallengeResultID)
+		result, err := validateGuess(newGuess, handler.ChallengeResultStore, handler.ChallengeStore)
 		if err != nil {
-			sendError(w, "failed to get result specified in guess", http.StatusInternalServerError)
-			log.Printf("Failed to get result specified in guess: %v\n", err)
+			sendRequestError(w, r, "invalid guess", err)
 			return
 		}
-		if len(result.Guesses) != newGuess.RoundNum {
-			sendError(w, "guess round num does not match existing result", http.StatusInternalServerError)
-			log.Printf("Guess round num does not match existing result: %v\n", err)
-			return
+		// results of registered users may only be played by them
+		if len(result.UserID) > 0 {
+			session, ok := handler.Sessions.Get(r)
+			if !ok || session.UserID != result.UserID {
+				apierror.Send(w, "this result belongs to another user", http.StatusForbidden)
+				return
+			}
 		}
 		result.Guesses = append(result.Guesses, newGuess)
 		err = handler.ChallengeResultStore.Insert(result)
 		if err != nil {
-			sendError(w, "failed to insert guess into store", http.StatusInternalServerError)
-			log.Printf("Failed to insert result with new guess into store: %v\n", err)
+			apierror.Send(w, "failed to insert guess into store", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to insert result with new guess into store", "err", err)
 			return
 		}
+		handler.Submitted.Inc()
 		json.NewEncoder(w).Encode(result)
 	default:
-		sendError(w, "api/guesses endpoint does not exist.", http.StatusNotFound)
+		apierror.Send(w, "api/guesses endpoint does not exist.", http.StatusNotFound)
 	}
 }
 
 func guessFromRequest(r *http.Request) (domain.Guess, error) {
 	newGuess := domain.Guess{}
-	err := json.NewDecoder(r.Body).Decode(&newGuess)
+	err := decodeRequest(r, &newGuess)
 	if err != nil {
-		return newGuess, fmt.Errorf("failed to decode newGuess from request: %v", err)
+		return newGuess, fmt.Errorf("failed to decode newGuess from request: %w", err)
 	}
 	return newGuess, nil
 }
@@ -4,14 +4,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"hash/fnv"
-	"log"
 	"net/http"
+	"time"
 
+	"gitlab.com/glatteis/earthwalker/apierror"
+	"gitlab.com/glatteis/earthwalker/auth"
+	"gitlab.com/glatteis/earthwalker/config"
 	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/logging"
 )
 
 type Results struct {
+	ChallengeStore       domain.ChallengeStore
 	ChallengeResultStore domain.ChallengeResultStore
+	Sessions             auth.Sessions
+	// the current config, for the IDs of new results
+	Config *config.Provider
 }
 
 func (handler Results) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -22,52 +30,105 @@ func (handler Results) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case http.MethodGet:
 			challengeID, _ := shiftPath(tail)
 			if len(challengeID) == 0 || challengeID == "/" {
-				sendError(w, "missing challenge id", http.StatusBadRequest)
+				apierror.Send(w, "missing challenge id", http.StatusBadRequest)
 				return
 			}
 			foundChallengeResults, err := handler.ChallengeResultStore.GetAll(challengeID)
 			if err != nil {
-				sendError(w, "failed to get results from store", http.StatusInternalServerError)
-				log.Printf("Failed to get results from store: %v\n", err)
+				apierror.Send(w, "failed to get results from store", http.StatusInternalServerError)
+				logging.FromContext(r.Context()).Error("Failed to get results from store", "err", err)
 				return
 			}
+			hideIDsOfOthers(handler.Sessions, r, foundChallengeResults)
 			json.NewEncoder(w).Encode(foundChallengeResults)
 		default:
-			sendError(w, "api/results/all endpoint does not exist.", http.StatusNotFound)
+			apierror.Send(w, "api/results/all endpoint does not exist.", http.StatusNotFound)
 		}
 	default:
 		switch r.Method {
 		case http.MethodGet:
 			challengeResultID := head
 			if len(challengeResultID) == 0 || challengeResultID == "/" {
-				sendError(w, "missing result id", http.StatusBadRequest)
+				apierror.Send(w, "missing result id", http.StatusBadRequest)
 				return
 			}
 			foundChallengeResult, err := handler.ChallengeResultStore.Get(challengeResultID)
 			if err != nil {
-				sendError(w, "failed to get result from store", http.StatusInternalServerError)
-				log.Printf("Failed to get result from store: %v\n", err)
+				apierror.Send(w, "failed to get result from store", http.StatusInternalServerError)
+				logging.FromContext(r.Context()).Error("Failed to get result from store", "err", err)
 				return
 			}
 			json.NewEncoder(w).Encode(foundChallengeResult)
 		case http.MethodPost:
 			newChallengeResult, err := challengeResultFromRequest(r)
 			if err != nil {
-				sendError(w, "failed to create result from request", http.StatusInternalServerError)
-				log.Printf("Failed to create result from request: %v\n", err)
+				sendRequestError(w, r, "failed to create result from request", err)
 				return
 			}
-			err = handler.ChallengeResultStore.Insert(newChallengeResult)
+			if err := validateResult(newChallengeResult, handler.ChallengeStore); err != nil {
+				sendRequestError(w, r, "invalid result", err)
+				return
+			}
+			session, err := handler.Sessions.Start(r)
+			if err != nil {
+				apierror.Send(w, "failed to start session", http.StatusInternalServerError)
+				logging.FromContext(r.Context()).Error("Failed to start session", "err", err)
+				return
+			}
+			newChallengeResult.UserID = session.UserID
+			newChallengeResult.ChallengeResultID, err = insertNew(handler.Config.Get().IDs(), func(id string) error {
+				newChallengeResult.ChallengeResultID = id
+				return handler.ChallengeResultStore.InsertNew(newChallengeResult)
+			})
 			if err != nil {
-				sendError(w, "failed to insert result into store", http.StatusInternalServerError)
-				log.Printf("Failed to insert result into store: %v\n", err)
+				apierror.Send(w, "failed to insert result into store", http.StatusInternalServerError)
+				logging.FromContext(r.Context()).Error("Failed to insert result into store", "err", err)
+				return
+			}
+			// remember the result, so /play knows which one to continue
+			session.Results[newChallengeResult.ChallengeID] = newChallengeResult.ChallengeResultID
+			session.LastChallengeID = newChallengeResult.ChallengeID
+			err = handler.Sessions.Save(w, r, session)
+			if err != nil {
+				apierror.Send(w, "failed to save session", http.StatusInternalServerError)
+				logging.FromContext(r.Context()).Error("Failed to save session", "err", err)
 				return
 			}
 			// TODO: results don't seem to be echoing as expected?
 			json.NewEncoder(w).Encode(newChallengeResult)
 		default:
-			sendError(w, "api/results endpoint does not exist.", http.StatusNotFound)
+			apierror.Send(w, "api/results endpoint does not exist.", http.StatusNotFound)
+		}
+	}
+}
+
+// ownsResult is whether result was started in the Session of r, or belongs to
+// its User
+func ownsResult(sessions auth.Sessions, r *http.Request, result domain.ChallengeResult) bool {
+	session, ok := sessions.Get(r)
+	if !ok {
+		return false
+	}
+	if len(result.UserID) > 0 && session.UserID == result.UserID {
+		return true
+	}
+	return session.Results[result.ChallengeID] == result.ChallengeResultID
+}
+
+// hideIDsOfOthers removes the IDs of those results which don't belong to the
+// requester.  The ID of an anonymous result is all it takes to play it.
+func hideIDsOfOthers(sessions auth.Sessions, r *http.Request, results []domain.ChallengeResult) {
+	for i := range results {
+		if ownsResult(sessions, r, results[i]) {
+			continue
+		}
+		results[i].ChallengeResultID = ""
+		guesses := make([]domain.Guess, len(results[i].Guesses))
+		for j, guess := range results[i].Guesses {
+			guess.ChallengeResultID = ""
+			guesses[j] = guess
 		}
+		results[i].Guesses = guesses
 	}
 }
 
@@ -75,11 +136,15 @@ func challengeResultFromRequest(r *http.Request) (domain.ChallengeResult, error)
 	newChallengeResult := domain.ChallengeResult{
 		Guesses: make([]domain.Guess, 0),
 	}
-	err := json.NewDecoder(r.Body).Decode(&newChallengeResult)
+	err := decodeRequest(r, &newChallengeResult)
 	if err != nil {
-		return newChallengeResult, fmt.Errorf("failed to decode newChallengeResult from request: %v", err)
+		return newChallengeResult, fmt.Errorf("failed to decode newChallengeResult from request: %w", err)
 	}
-	newChallengeResult.ChallengeResultID = domain.RandAlpha(10)
+	// set when inserting, the ID is what lets players continue their game
+	newChallengeResult.ChallengeResultID = ""
+	// set from the session, never from the request
+	newChallengeResult.UserID = ""
+	newChallengeResult.CreatedAt = time.Now()
 	// Hash nickname into a hue value
 	algorithm := fnv.New32a()
 	algorithm.Write([]byte(newChallengeResult.Nickname))
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gitlab.com/glatteis/earthwalker/auth"
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+func TestAllResultsHideOtherIDs(t *testing.T) {
+	handler := Root{ResultsHandler: Results{
+		ChallengeResultStore: memChallengeResultStore{
+			"mine":   {ChallengeResultID: "mine", ChallengeID: "c", Guesses: []domain.Guess{{ChallengeResultID: "mine"}}},
+			"theirs": {ChallengeResultID: "theirs", ChallengeID: "c", Guesses: []domain.Guess{{ChallengeResultID: "theirs"}}},
+			"user":   {ChallengeResultID: "user", ChallengeID: "c", UserID: "u"},
+		},
+		Sessions: auth.Sessions{Store: memSessionStore{"s": {SessionID: "s", UserID: "u", Results: map[string]string{"c": "mine"}}}},
+	}}
+	req := httptest.NewRequest(http.MethodGet, "/results/all/c", nil)
+	req.AddCookie(&http.Cookie{Name: auth.SessionCookieName, Value: "s"})
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	var results []domain.ChallengeResult
+	if err := json.NewDecoder(recorder.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]bool)
+	for _, result := range results {
+		ids[result.ChallengeResultID] = true
+		for _, guess := range result.Guesses {
+			if guess.ChallengeResultID != result.ChallengeResultID {
+				t.Errorf("guess of result '%s' has ID '%s'", result.ChallengeResultID, guess.ChallengeResultID)
+			}
+		}
+	}
+	if len(results) != 3 || !ids["mine"] || !ids["user"] || ids["theirs"] {
+		t.Errorf("expected only the IDs of the requester's results, got %v", ids)
+	}
+}
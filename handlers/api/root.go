@@ -1,35 +1,59 @@
 package api
 
-// TODO: improve logging (we probably want to output actual structs/IDs
-// 	     when something goes wrong)
-
 import (
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
+	"gitlab.com/glatteis/earthwalker/apierror"
 	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/metrics"
 )
 
 type Root struct {
-	Config               domain.Config
 	MapStore             domain.MapStore
 	ChallengeStore       domain.ChallengeStore
 	ChallengeResultStore domain.ChallengeResultStore
 
-	ConfigHandler     Config
-	MapsHandler       Maps
-	ChallengesHandler Challenges
-	ResultsHandler    Results
-	GuessesHandler    Guesses
+	ConfigHandler Config
+	// MapsHandler and ChallengesHandler are usually wrapped in an auth.Policy
+	MapsHandler       http.Handler
+	ChallengesHandler http.Handler
+	// ResultsHandler and GuessesHandler are usually rate limited
+	ResultsHandler  http.Handler
+	GuessesHandler  http.Handler
+	StatsHandler    Stats
+	UsersHandler    Users
+	SessionsHandler Sessions
+	TokensHandler   Tokens
+	// AdminHandler must be wrapped in an auth.Policy requiring auth.ActionAdmin
+	AdminHandler http.Handler
+
+	// Requests by route (the first path segment), method and status code,
+	// and their Duration by route and method.  Both may be nil.
+	Requests *metrics.Counter
+	Duration *metrics.Histogram
 }
 
 func (handler Root) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s requested %s %s", r.RemoteAddr, r.Method, r.URL.Path)
 	head, tail := shiftPath(r.URL.Path)
 	r.URL.Path = tail
+
+	route, method := head, metricsMethod(r.Method)
+	recorder := &metrics.StatusRecorder{ResponseWriter: w}
+	w = recorder
+	defer func(start time.Time) {
+		if recorder.Status == 0 {
+			recorder.Status = http.StatusOK
+		}
+		handler.Requests.Inc(route, method, strconv.Itoa(recorder.Status))
+		handler.Duration.Observe(time.Since(start).Seconds(), route, method)
+	}(time.Now())
+
 	switch head {
 	case "config":
 		handler.ConfigHandler.ServeHTTP(w, r)
@@ -41,21 +65,32 @@ func (handler Root) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		handler.ResultsHandler.ServeHTTP(w, r)
 	case "guesses":
 		handler.GuessesHandler.ServeHTTP(w, r)
+	case "stats":
+		handler.StatsHandler.ServeHTTP(w, r)
+	case "users":
+		handler.UsersHandler.ServeHTTP(w, r)
+	case "sessions":
+		handler.SessionsHandler.ServeHTTP(w, r)
+	case "tokens":
+		handler.TokensHandler.ServeHTTP(w, r)
+	case "admin":
+		handler.AdminHandler.ServeHTTP(w, r)
 	default:
-		sendError(w, fmt.Sprintf("API endpoint '%s' does not exist.", head), http.StatusNotFound)
+		// anything could be requested here, which mustn't grow the metrics
+		route = "unknown"
+		apierror.Send(w, fmt.Sprintf("API endpoint '%s' does not exist.", head), http.StatusNotFound)
 		return
 	}
 }
 
-// sendError text as JSON
-func sendError(w http.ResponseWriter, text string, status int) {
-	respJSON := "{\"error\": \"" + text + "\"}"
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	_, err := w.Write([]byte(respJSON))
-	if err != nil {
-		log.Printf("Error writing response: %v\n", err)
+// metricsMethod is method if it's a standard one, "other" otherwise
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
 	}
+	return "other"
 }
 
 func shiftPath(p string) (head, tail string) {
@@ -66,3 +101,23 @@ func shiftPath(p string) (head, tail string) {
 	}
 	return p[1:i], p[i:]
 }
+
+// maxIDAttempts at finding an unused ID for a new object.  Collisions of
+// random IDs are practically impossible, but word IDs are much shorter.
+const maxIDAttempts = 10
+
+// insertNew calls insert with new IDs from ids until it doesn't fail with
+// domain.ErrIDExists, and returns the ID it succeeded with
+func insertNew(ids domain.IDGenerator, insert func(id string) error) (string, error) {
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		id, err := ids.New()
+		if err != nil {
+			return "", fmt.Errorf("failed to generate ID: %v", err)
+		}
+		err = insert(id)
+		if !errors.Is(err, domain.ErrIDExists) {
+			return id, err
+		}
+	}
+	return "", fmt.Errorf("every one of %d new IDs was taken: %w", maxIDAttempts, domain.ErrIDExists)
+}
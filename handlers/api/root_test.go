@@ -0,0 +1,68 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/metrics"
+)
+
+func TestRootMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	handler := Root{
+		StatsHandler: Stats{ChallengeResultStore: memChallengeResultStore{}},
+		Requests:     registry.Counter("requests_total", "", "route", "method", "code"),
+		Duration:     registry.Histogram("duration_seconds", "", metrics.DefaultBuckets, "route", "method"),
+	}
+	for _, url := range []string{"/stats/alice", "/stats/bob", "/no/such/route", "/no-such-route-either"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, url, nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/stats/alice", nil))
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		`requests_total{route="stats",method="GET",code="200"} 2`,
+		`requests_total{route="unknown",method="GET",code="404"} 2`,
+		`requests_total{route="stats",method="other",code="404"} 1`,
+		`duration_seconds_count{route="stats",method="GET"} 2`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("expected '%s' in\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestInsertNew(t *testing.T) {
+	ids := withIDs(domain.Config{}).IDs()
+	var tried []string
+	id, err := insertNew(ids, func(id string) error {
+		tried = append(tried, id)
+		if len(tried) < 3 {
+			return fmt.Errorf("id '%s': %w", id, domain.ErrIDExists)
+		}
+		return nil
+	})
+	if err != nil || len(tried) != 3 || id != tried[2] {
+		t.Errorf("expected the third ID to be inserted, got %s, %v after trying %v", id, err, tried)
+	}
+
+	attempts := 0
+	_, err = insertNew(ids, func(id string) error {
+		attempts++
+		return domain.ErrIDExists
+	})
+	if !errors.Is(err, domain.ErrIDExists) || attempts != maxIDAttempts {
+		t.Errorf("expected ErrIDExists after %d attempts, got %v after %d", maxIDAttempts, err, attempts)
+	}
+
+	failure := errors.New("disk full")
+	if _, err = insertNew(ids, func(id string) error { return failure }); !errors.Is(err, failure) {
+		t.Errorf("expected other errors to be returned right away, got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gitlab.com/glatteis/earthwalker/apierror"
+	"gitlab.com/glatteis/earthwalker/auth"
+	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/logging"
+)
+
+// dummyHash is compared against when logging in as a nonexistent user, so
+// that response times don't reveal which usernames exist
+var dummyHash, _ = auth.HashPassword("earthwalker")
+
+type Sessions struct {
+	UserStore domain.UserStore
+	Sessions  auth.Sessions
+}
+
+func (handler Sessions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		creds, err := credentialsFromRequest(r)
+		if err != nil {
+			apierror.Send(w, "failed to read credentials from request", http.StatusBadRequest)
+			return
+		}
+		user, err := handler.UserStore.GetByUsername(creds.Username)
+		if err != nil {
+			auth.CheckPassword(dummyHash, creds.Password)
+			apierror.Send(w, "wrong username or password", http.StatusUnauthorized)
+			return
+		}
+		if !auth.CheckPassword(user.PasswordHash, creds.Password) {
+			apierror.Send(w, "wrong username or password", http.StatusUnauthorized)
+			return
+		}
+		_, err = handler.Sessions.Login(w, r, user.UserID)
+		if err != nil {
+			apierror.Send(w, "failed to log in", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to log in", "err", err)
+			return
+		}
+		json.NewEncoder(w).Encode(user)
+	case http.MethodDelete:
+		err := handler.Sessions.Logout(w, r)
+		if err != nil {
+			apierror.Send(w, "failed to log out", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to log out", "err", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apierror.Send(w, "api/sessions endpoint does not exist.", http.StatusNotFound)
+	}
+}
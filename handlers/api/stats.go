@@ -0,0 +1,183 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"gitlab.com/glatteis/earthwalker/apierror"
+	"gitlab.com/glatteis/earthwalker/auth"
+	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/logging"
+)
+
+type Stats struct {
+	MapStore             domain.MapStore
+	ChallengeStore       domain.ChallengeStore
+	ChallengeResultStore domain.ChallengeResultStore
+	// to hide the IDs of other players' results
+	Sessions auth.Sessions
+}
+
+func (handler Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apierror.Send(w, "api/stats endpoint does not exist.", http.StatusNotFound)
+		return
+	}
+	nickname, _ := shiftPath(r.URL.Path)
+	if len(nickname) == 0 || nickname == "/" {
+		apierror.Send(w, "missing nickname", http.StatusBadRequest)
+		return
+	}
+	results, err := handler.ChallengeResultStore.GetAllByNickname(nickname)
+	if err != nil {
+		apierror.Send(w, "failed to get results from store", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to get results from store", "nickname", nickname, "err", err)
+		return
+	}
+	hideIDsOfOthers(handler.Sessions, r, results)
+	stats, err := handler.playerStats(nickname, results)
+	if err != nil {
+		apierror.Send(w, "failed to calculate stats", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to calculate stats", "nickname", nickname, "err", err)
+		return
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+// serveUserStats aggregated over every ChallengeResult of user
+func (handler Stats) serveUserStats(w http.ResponseWriter, r *http.Request, user domain.User) {
+	results, err := handler.ChallengeResultStore.GetAllByUserID(user.UserID)
+	if err != nil {
+		apierror.Send(w, "failed to get results from store", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to get results from store", "user_id", user.UserID, "err", err)
+		return
+	}
+	hideIDsOfOthers(handler.Sessions, r, results)
+	stats, err := handler.playerStats(user.Username, results)
+	if err != nil {
+		apierror.Send(w, "failed to calculate stats", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to calculate stats", "user_id", user.UserID, "err", err)
+		return
+	}
+	json.NewEncoder(w).Encode(stats)
+}
+
+// playerStats aggregates results, which must all belong to one player
+func (handler Stats) playerStats(nickname string, results []domain.ChallengeResult) (domain.PlayerStats, error) {
+	stats := domain.PlayerStats{
+		Nickname: nickname,
+		Trend:    make([]domain.GameStats, 0),
+	}
+	challenges := make(map[string]domain.Challenge)
+	maps := make(map[string]domain.Map)
+	var distances []float64
+	totalScore := 0
+	for _, result := range results {
+		if len(result.Guesses) == 0 {
+			continue
+		}
+		challenge, ok := challenges[result.ChallengeID]
+		if !ok {
+			var err error
+			challenge, err = handler.ChallengeStore.Get(result.ChallengeID)
+			// results outlive deleted challenges in old databases, and
+			// deleting is not atomic
+			if errors.Is(err, domain.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return stats, fmt.Errorf("failed to get challenge of result '%s': %v", result.ChallengeResultID, err)
+			}
+			challenges[result.ChallengeID] = challenge
+		}
+		m, ok := maps[challenge.MapID]
+		if !ok {
+			var err error
+			m, err = handler.MapStore.Get(challenge.MapID)
+			if errors.Is(err, domain.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return stats, fmt.Errorf("failed to get map of challenge '%s': %v", challenge.ChallengeID, err)
+			}
+			maps[challenge.MapID] = m
+		}
+
+		game := domain.GameStats{
+			ChallengeID:       result.ChallengeID,
+			ChallengeResultID: result.ChallengeResultID,
+			CreatedAt:         result.CreatedAt,
+		}
+		for _, guess := range result.Guesses {
+			place, ok := placeForRound(challenge, guess.RoundNum)
+			if !ok {
+				continue
+			}
+			score, distance := domain.ScoreDistance(guess.Location, place.Location, m.GraceDistance, float64(m.Area))
+			round := domain.RoundStats{
+				ChallengeID:       result.ChallengeID,
+				ChallengeResultID: result.ChallengeResultID,
+				RoundNum:          guess.RoundNum,
+				Score:             score,
+				Distance:          distance,
+			}
+			if stats.BestRound == nil || round.Score > stats.BestRound.Score {
+				best := round
+				stats.BestRound = &best
+			}
+			if stats.WorstRound == nil || round.Score < stats.WorstRound.Score {
+				worst := round
+				stats.WorstRound = &worst
+			}
+			if score == domain.MaxScore {
+				stats.PerfectRounds++
+			}
+			if guess.Location.Valid() {
+				distances = append(distances, distance)
+			}
+			game.RoundsPlayed++
+			game.Score += score
+		}
+		stats.GamesPlayed++
+		stats.RoundsPlayed += game.RoundsPlayed
+		totalScore += game.Score
+		stats.Trend = append(stats.Trend, game)
+	}
+
+	if stats.RoundsPlayed > 0 {
+		stats.AverageScore = float64(totalScore) / float64(stats.RoundsPlayed)
+	}
+	stats.MedianDistance = median(distances)
+	sort.Slice(stats.Trend, func(i, j int) bool {
+		if stats.Trend[i].CreatedAt.Equal(stats.Trend[j].CreatedAt) {
+			return stats.Trend[i].ChallengeResultID < stats.Trend[j].ChallengeResultID
+		}
+		return stats.Trend[i].CreatedAt.Before(stats.Trend[j].CreatedAt)
+	})
+	return stats, nil
+}
+
+func placeForRound(challenge domain.Challenge, roundNum int) (domain.ChallengePlace, bool) {
+	for _, place := range challenge.Places {
+		if place.RoundNum == roundNum {
+			return place, true
+		}
+	}
+	return domain.ChallengePlace{}, false
+}
+
+// median of values, or 0 if there are none.  Sorts values.
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
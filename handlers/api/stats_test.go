@@ -0,0 +1,109 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/auth"
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+func TestPlayerStats(t *testing.T) {
+	munich := domain.Coords{Lat: 48.137, Lng: 11.575}
+	paris := domain.Coords{Lat: 48.857, Lng: 2.352}
+	handler := Root{StatsHandler: Stats{
+		MapStore: memMapStore{"m": {MapID: "m", GraceDistance: 100}},
+		ChallengeStore: memChallengeStore{"c": {ChallengeID: "c", MapID: "m", Places: []domain.ChallengePlace{
+			{RoundNum: 1, Location: paris},
+			{RoundNum: 0, Location: munich},
+		}}, "o": {ChallengeID: "o", MapID: "x", Places: []domain.ChallengePlace{{RoundNum: 0}}}},
+		ChallengeResultStore: memChallengeResultStore{
+			"new": {ChallengeResultID: "new", ChallengeID: "c", Nickname: "Alice",
+				CreatedAt: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+				Guesses: []domain.Guess{
+					{RoundNum: 0, Location: munich},
+					{RoundNum: 1, Location: munich},
+				}},
+			"old": {ChallengeResultID: "old", ChallengeID: "c", Nickname: "alice",
+				CreatedAt: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+				Guesses: []domain.Guess{
+					{RoundNum: 0, Location: domain.Coords{Lat: 100}}, // timed out
+				}},
+			"unstarted": {ChallengeResultID: "unstarted", ChallengeID: "c", Nickname: "alice"},
+			"bob":       {ChallengeResultID: "bob", ChallengeID: "c", Nickname: "bob"},
+			// of deleted challenges and maps, which are left out
+			"deleted": {ChallengeResultID: "deleted", ChallengeID: "x", Nickname: "alice", Guesses: []domain.Guess{{RoundNum: 0}}},
+			"orphan":  {ChallengeResultID: "orphan", ChallengeID: "o", Nickname: "alice", Guesses: []domain.Guess{{RoundNum: 0}}},
+		},
+		// only old was played in the requester's session
+		Sessions: auth.Sessions{Store: memSessionStore{"s": {SessionID: "s", Results: map[string]string{"c": "old"}}}},
+	}}
+
+	req, err := http.NewRequest("GET", "/stats/ALICE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: auth.SessionCookieName, Value: "s"})
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if status := recorder.Code; status != http.StatusOK {
+		t.Fatalf("got status code %v, expected %v", status, http.StatusOK)
+	}
+	var stats domain.PlayerStats
+	if err := json.NewDecoder(recorder.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+
+	parisScore, parisDistance := domain.ScoreDistance(munich, paris, 100, 0)
+	if stats.GamesPlayed != 2 || stats.RoundsPlayed != 3 || stats.PerfectRounds != 1 {
+		t.Errorf("got %d games, %d rounds, %d perfect rounds, expected 2, 3, 1",
+			stats.GamesPlayed, stats.RoundsPlayed, stats.PerfectRounds)
+	}
+	if expected := float64(domain.MaxScore+parisScore) / 3; stats.AverageScore != expected {
+		t.Errorf("got average score %f, expected %f", stats.AverageScore, expected)
+	}
+	// the timed out guess has no meaningful distance
+	if expected := parisDistance / 2; stats.MedianDistance != expected {
+		t.Errorf("got median distance %f, expected %f", stats.MedianDistance, expected)
+	}
+	if stats.BestRound.Score != domain.MaxScore || stats.WorstRound.Score != 0 {
+		t.Errorf("got best round %+v and worst round %+v", stats.BestRound, stats.WorstRound)
+	}
+	// the IDs of other results are hidden
+	if len(stats.Trend) != 2 || stats.Trend[0].ChallengeResultID != "old" || stats.Trend[1].ChallengeResultID != "" ||
+		stats.Trend[1].Score != domain.MaxScore+parisScore {
+		t.Errorf("got trend %+v", stats.Trend)
+	}
+}
+
+func TestUserStatsHideOtherIDs(t *testing.T) {
+	sessions := auth.Sessions{Store: memSessionStore{
+		"alice": {SessionID: "alice", UserID: "a"},
+		"bob":   {SessionID: "bob", UserID: "b"},
+	}}
+	handler := Root{UsersHandler: Users{
+		UserStore: memUserStore{"a": {UserID: "a", Username: "alice"}},
+		StatsHandler: Stats{
+			MapStore:       memMapStore{"m": {MapID: "m"}},
+			ChallengeStore: memChallengeStore{"c": {ChallengeID: "c", MapID: "m", Places: []domain.ChallengePlace{{RoundNum: 0}}}},
+			ChallengeResultStore: memChallengeResultStore{
+				"r": {ChallengeResultID: "r", ChallengeID: "c", UserID: "a", Guesses: []domain.Guess{{RoundNum: 0}}},
+			},
+			Sessions: sessions,
+		},
+	}}
+
+	for session, expected := range map[string]string{"alice": "r", "bob": ""} {
+		recorder := do(t, handler, "GET", "/users/a/stats", "", &http.Cookie{Name: auth.SessionCookieName, Value: session})
+		var stats domain.PlayerStats
+		if err := json.NewDecoder(recorder.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		if len(stats.Trend) != 1 || stats.Trend[0].ChallengeResultID != expected {
+			t.Errorf("%s got trend %+v, expected result ID '%s'", session, stats.Trend, expected)
+		}
+	}
+}
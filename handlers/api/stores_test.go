@@ -0,0 +1,267 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"gitlab.com/glatteis/earthwalker/config"
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+// withIDs sets the settings of conf for IDs of new objects to the defaults
+func withIDs(conf domain.Config) domain.Config {
+	defaults := config.Default("/app")
+	conf.IDLength, conf.IDAlphabet = defaults.IDLength, defaults.IDAlphabet
+	return conf
+}
+
+// in-memory stores for handler tests
+
+type memMapStore map[string]domain.Map
+
+func (store memMapStore) Insert(m domain.Map) error {
+	store[m.MapID] = m
+	return nil
+}
+
+func (store memMapStore) InsertNew(m domain.Map) error {
+	if _, ok := store[m.MapID]; ok {
+		return fmt.Errorf("map '%s': %w", m.MapID, domain.ErrIDExists)
+	}
+	return store.Insert(m)
+}
+
+func (store memMapStore) Get(mapID string) (domain.Map, error) {
+	m, ok := store[mapID]
+	if !ok {
+		return m, fmt.Errorf("map '%s': %w", mapID, domain.ErrNotFound)
+	}
+	return m, nil
+}
+
+func (store memMapStore) GetAll() ([]domain.Map, error) {
+	var maps []domain.Map
+	for _, m := range store {
+		maps = append(maps, m)
+	}
+	return maps, nil
+}
+
+func (store memMapStore) Delete(mapID string) error {
+	delete(store, mapID)
+	return nil
+}
+
+type memChallengeStore map[string]domain.Challenge
+
+func (store memChallengeStore) Insert(c domain.Challenge) error {
+	store[c.ChallengeID] = c
+	return nil
+}
+
+func (store memChallengeStore) InsertNew(c domain.Challenge) error {
+	if _, ok := store[c.ChallengeID]; ok {
+		return fmt.Errorf("challenge '%s': %w", c.ChallengeID, domain.ErrIDExists)
+	}
+	return store.Insert(c)
+}
+
+func (store memChallengeStore) Get(challengeID string) (domain.Challenge, error) {
+	c, ok := store[challengeID]
+	if !ok {
+		return c, fmt.Errorf("challenge '%s': %w", challengeID, domain.ErrNotFound)
+	}
+	return c, nil
+}
+
+func (store memChallengeStore) GetList(mapID string) ([]string, error) {
+	var ids []string
+	for id, c := range store {
+		if c.MapID == mapID {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (store memChallengeStore) GetAll(mapID string) ([]domain.Challenge, error) {
+	var challenges []domain.Challenge
+	for _, c := range store {
+		if c.MapID == mapID {
+			challenges = append(challenges, c)
+		}
+	}
+	return challenges, nil
+}
+
+func (store memChallengeStore) Delete(challengeID string) error {
+	delete(store, challengeID)
+	return nil
+}
+
+func (store memChallengeStore) DeleteAll(mapID string) error {
+	for id, c := range store {
+		if c.MapID == mapID {
+			delete(store, id)
+		}
+	}
+	return nil
+}
+
+type memChallengeResultStore map[string]domain.ChallengeResult
+
+func (store memChallengeResultStore) Insert(r domain.ChallengeResult) error {
+	store[r.ChallengeResultID] = r
+	return nil
+}
+
+func (store memChallengeResultStore) InsertNew(r domain.ChallengeResult) error {
+	if _, ok := store[r.ChallengeResultID]; ok {
+		return fmt.Errorf("result '%s': %w", r.ChallengeResultID, domain.ErrIDExists)
+	}
+	return store.Insert(r)
+}
+
+func (store memChallengeResultStore) Get(challengeResultID string) (domain.ChallengeResult, error) {
+	r, ok := store[challengeResultID]
+	if !ok {
+		return r, fmt.Errorf("result '%s': %w", challengeResultID, domain.ErrNotFound)
+	}
+	return r, nil
+}
+
+func (store memChallengeResultStore) GetAll(challengeID string) ([]domain.ChallengeResult, error) {
+	var results []domain.ChallengeResult
+	for _, r := range store {
+		if r.ChallengeID == challengeID {
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+func (store memChallengeResultStore) Delete(challengeResultID string) error {
+	delete(store, challengeResultID)
+	return nil
+}
+
+func (store memChallengeResultStore) DeleteAll(challengeID string) error {
+	for id, r := range store {
+		if r.ChallengeID == challengeID {
+			delete(store, id)
+		}
+	}
+	return nil
+}
+
+func (store memChallengeResultStore) GetAllByNickname(nickname string) ([]domain.ChallengeResult, error) {
+	var results []domain.ChallengeResult
+	for _, r := range store {
+		if strings.EqualFold(r.Nickname, nickname) {
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+func (store memChallengeResultStore) GetAllByUserID(userID string) ([]domain.ChallengeResult, error) {
+	var results []domain.ChallengeResult
+	for _, r := range store {
+		if r.UserID == userID {
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+type memUserStore map[string]domain.User
+
+func (store memUserStore) Insert(u domain.User) error {
+	store[u.UserID] = u
+	return nil
+}
+
+func (store memUserStore) InsertNew(u domain.User) error {
+	if _, ok := store[u.UserID]; ok {
+		return fmt.Errorf("user '%s': %w", u.UserID, domain.ErrIDExists)
+	}
+	if _, err := store.GetByUsername(u.Username); err == nil {
+		return fmt.Errorf("username '%s': %w", u.Username, domain.ErrUsernameTaken)
+	}
+	return store.Insert(u)
+}
+
+func (store memUserStore) Get(userID string) (domain.User, error) {
+	u, ok := store[userID]
+	if !ok {
+		return u, fmt.Errorf("user '%s': %w", userID, domain.ErrNotFound)
+	}
+	return u, nil
+}
+
+func (store memUserStore) GetByUsername(username string) (domain.User, error) {
+	for _, u := range store {
+		if strings.EqualFold(u.Username, username) {
+			return u, nil
+		}
+	}
+	return domain.User{}, fmt.Errorf("username '%s': %w", username, domain.ErrNotFound)
+}
+
+type memSessionStore map[string]domain.Session
+
+func (store memSessionStore) Insert(s domain.Session) error {
+	store[s.SessionID] = s
+	return nil
+}
+
+func (store memSessionStore) Get(sessionID string) (domain.Session, error) {
+	s, ok := store[sessionID]
+	if !ok {
+		return s, fmt.Errorf("session: %w", domain.ErrNotFound)
+	}
+	return s, nil
+}
+
+func (store memSessionStore) Delete(sessionID string) error {
+	delete(store, sessionID)
+	return nil
+}
+
+func (store memUserStore) GetAll() ([]domain.User, error) {
+	var users []domain.User
+	for _, u := range store {
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+type memAPITokenStore map[string]domain.APIToken
+
+func (store memAPITokenStore) Insert(t domain.APIToken) error {
+	store[t.TokenID] = t
+	return nil
+}
+
+func (store memAPITokenStore) Get(tokenID string) (domain.APIToken, error) {
+	t, ok := store[tokenID]
+	if !ok {
+		return t, fmt.Errorf("API token: %w", domain.ErrNotFound)
+	}
+	return t, nil
+}
+
+func (store memAPITokenStore) GetAll(userID string) ([]domain.APIToken, error) {
+	var tokens []domain.APIToken
+	for _, t := range store {
+		if t.UserID == userID {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+
+func (store memAPITokenStore) Delete(tokenID string) error {
+	delete(store, tokenID)
+	return nil
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"gitlab.com/glatteis/earthwalker/apierror"
+	"gitlab.com/glatteis/earthwalker/auth"
+	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/logging"
+)
+
+// newToken is the response to creating an APIToken, the only time the
+// secret is ever sent
+type newToken struct {
+	Token string
+	domain.APIToken
+}
+
+// Tokens manages the APITokens of the User making the request
+type Tokens struct {
+	TokenStore domain.APITokenStore
+	Policy     auth.Policy
+}
+
+func (handler Tokens) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, err := handler.Policy.Principal(r)
+	if err != nil {
+		apierror.Send(w, "you need to log in to manage API tokens.", http.StatusUnauthorized)
+		return
+	}
+	tokenID, _ := shiftPath(r.URL.Path)
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := handler.TokenStore.GetAll(user.UserID)
+		if err != nil {
+			apierror.Send(w, "failed to get API tokens from store", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to get API tokens from store", "err", err)
+			return
+		}
+		json.NewEncoder(w).Encode(tokens)
+	case http.MethodPost:
+		var request struct{ Name string }
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			apierror.Send(w, "failed to decode token name from request", http.StatusBadRequest)
+			return
+		}
+		secret, token, err := auth.NewAPIToken(user.UserID, request.Name)
+		if err != nil {
+			apierror.Send(w, "failed to create API token", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to create API token", "err", err)
+			return
+		}
+		err = handler.TokenStore.Insert(token)
+		if err != nil {
+			apierror.Send(w, "failed to insert API token into store", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to insert API token into store", "err", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newToken{Token: secret, APIToken: token})
+	case http.MethodDelete:
+		if len(tokenID) == 0 {
+			apierror.Send(w, "missing token id", http.StatusBadRequest)
+			return
+		}
+		token, err := handler.TokenStore.Get(tokenID)
+		if err != nil || token.UserID != user.UserID {
+			apierror.Send(w, fmt.Sprintf("you have no API token with id '%s'.", tokenID), http.StatusNotFound)
+			return
+		}
+		err = handler.TokenStore.Delete(tokenID)
+		if err != nil {
+			apierror.Send(w, "failed to delete API token", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to delete API token", "err", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apierror.Send(w, "api/tokens endpoint does not exist.", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/apierror"
+	"gitlab.com/glatteis/earthwalker/auth"
+	"gitlab.com/glatteis/earthwalker/config"
+	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/logging"
+)
+
+const maxUsernameLength = 20
+const minPasswordLength = 8
+
+// credentials of a User, as sent by the client to register or log in
+type credentials struct {
+	Username string
+	Password string
+}
+
+type Users struct {
+	UserStore domain.UserStore
+	Sessions  auth.Sessions
+	// the current config, for the IDs of new users
+	Config *config.Provider
+
+	StatsHandler Stats
+}
+
+func (handler Users) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	head, tail := shiftPath(r.URL.Path)
+	switch {
+	case len(head) == 0 && r.Method == http.MethodPost:
+		handler.register(w, r)
+	case head == "me" && r.Method == http.MethodGet:
+		user, err := handler.Sessions.CurrentUser(r, handler.UserStore)
+		if err != nil {
+			apierror.Send(w, "not logged in", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(user)
+	case len(head) > 0 && r.Method == http.MethodGet:
+		if sub, _ := shiftPath(tail); sub != "stats" {
+			apierror.Send(w, "api/users endpoint does not exist.", http.StatusNotFound)
+			return
+		}
+		user, err := handler.UserStore.Get(head)
+		if err != nil {
+			apierror.Send(w, "user not found", http.StatusNotFound)
+			return
+		}
+		handler.StatsHandler.serveUserStats(w, r, user)
+	default:
+		apierror.Send(w, "api/users endpoint does not exist.", http.StatusNotFound)
+	}
+}
+
+// register a new User and log them in
+func (handler Users) register(w http.ResponseWriter, r *http.Request) {
+	creds, err := credentialsFromRequest(r)
+	if err != nil {
+		apierror.Send(w, "failed to read credentials from request", http.StatusBadRequest)
+		return
+	}
+	if len(creds.Username) == 0 || len(creds.Username) > maxUsernameLength || strings.Contains(creds.Username, "/") {
+		apierror.Send(w, fmt.Sprintf("username must be 1 to %d characters long and must not contain '/'", maxUsernameLength), http.StatusBadRequest)
+		return
+	}
+	if len(creds.Password) < minPasswordLength {
+		apierror.Send(w, fmt.Sprintf("password must be at least %d characters long", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+	_, err = handler.UserStore.GetByUsername(creds.Username)
+	if err == nil {
+		apierror.Send(w, "username is already taken", http.StatusConflict)
+		return
+	}
+	if !errors.Is(err, domain.ErrNotFound) {
+		apierror.Send(w, "failed to check whether username is taken", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to get user by name from store", "err", err)
+		return
+	}
+	hash, err := auth.HashPassword(creds.Password)
+	if err != nil {
+		apierror.Send(w, "failed to hash password", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to hash password", "err", err)
+		return
+	}
+	newUser := domain.User{
+		Username:     creds.Username,
+		PasswordHash: hash,
+		CreatedAt:    time.Now(),
+	}
+	newUser.UserID, err = insertNew(handler.Config.Get().IDs(), func(id string) error {
+		newUser.UserID = id
+		return handler.UserStore.InsertNew(newUser)
+	})
+	// someone registered the same name since it was checked above
+	if errors.Is(err, domain.ErrUsernameTaken) {
+		apierror.Send(w, "username is already taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		apierror.Send(w, "failed to insert user into store", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to insert user into store", "err", err)
+		return
+	}
+	_, err = handler.Sessions.Login(w, r, newUser.UserID)
+	if err != nil {
+		apierror.Send(w, "failed to log in", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to log in new user", "err", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newUser)
+}
+
+func credentialsFromRequest(r *http.Request) (credentials, error) {
+	creds := credentials{}
+	err := json.NewDecoder(r.Body).Decode(&creds)
+	if err != nil {
+		return creds, fmt.Errorf("failed to decode credentials from request: %v", err)
+	}
+	creds.Username = strings.TrimSpace(creds.Username)
+	return creds, nil
+}
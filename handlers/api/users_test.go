@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.com/glatteis/earthwalker/auth"
+	"gitlab.com/glatteis/earthwalker/config"
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+// do a request against handler, passing along the given cookies
+func do(t *testing.T, handler http.Handler, method string, url string, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func sessionCookie(recorder *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range recorder.Result().Cookies() {
+		if cookie.Name == auth.SessionCookieName {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// racingUserStore finds no username, as if the user registered after that
+type racingUserStore struct {
+	memUserStore
+}
+
+func (store racingUserStore) GetByUsername(username string) (domain.User, error) {
+	return domain.User{}, domain.ErrNotFound
+}
+
+func TestUserAccounts(t *testing.T) {
+	users := memUserStore{}
+	sessions := auth.Sessions{Store: memSessionStore{}}
+	challenges := memChallengeStore{"c": {ChallengeID: "c", Places: []domain.ChallengePlace{{ChallengeID: "c"}}}}
+	results := memChallengeResultStore{}
+	provider := config.NewProvider(withIDs(domain.Config{}))
+	handler := Root{
+		UsersHandler:    Users{UserStore: users, Sessions: sessions, Config: provider},
+		SessionsHandler: Sessions{UserStore: users, Sessions: sessions},
+		ResultsHandler:  Results{ChallengeStore: challenges, ChallengeResultStore: results, Sessions: sessions, Config: provider},
+		GuessesHandler:  Guesses{ChallengeStore: challenges, ChallengeResultStore: results, Sessions: sessions},
+	}
+	creds := `{"Username": "Alice", "Password": "correct horse"}`
+
+	if rec := do(t, handler, "POST", "/users", `{"Username": "Alice", "Password": "short"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("registering with a short password: got status %d", rec.Code)
+	}
+	rec := do(t, handler, "POST", "/users", creds)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("registering: got status %d: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "PasswordHash") {
+		t.Error("password hash was sent to the client")
+	}
+	if rec := do(t, handler, "POST", "/users", `{"Username": "alice", "Password": "another password"}`); rec.Code != http.StatusConflict {
+		t.Errorf("registering a taken username: got status %d", rec.Code)
+	}
+	// as if someone else registered the name between the check and insertion
+	racing := Root{UsersHandler: Users{UserStore: racingUserStore{users}, Sessions: sessions, Config: provider}}
+	if rec := do(t, racing, "POST", "/users", `{"Username": "ALICE", "Password": "another password"}`); rec.Code != http.StatusConflict {
+		t.Errorf("registering a username taken meanwhile: got status %d", rec.Code)
+	}
+	if len(users) != 1 {
+		t.Errorf("expected only one user, got %d", len(users))
+	}
+
+	if rec := do(t, handler, "POST", "/sessions", `{"Username": "alice", "Password": "wrong password"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("logging in with a wrong password: got status %d", rec.Code)
+	}
+	rec = do(t, handler, "POST", "/sessions", creds)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("logging in: got status %d: %s", rec.Code, rec.Body)
+	}
+	loggedIn := sessionCookie(rec)
+	if loggedIn == nil {
+		t.Fatal("logging in didn't set a session cookie")
+	}
+	rec = do(t, handler, "GET", "/users/me", "", loggedIn)
+	var me domain.User
+	if err := json.NewDecoder(rec.Body).Decode(&me); err != nil || me.Username != "Alice" {
+		t.Fatalf("got %+v (%v) for /users/me, expected Alice", me, err)
+	}
+
+	// results are linked to the logged in user, and only they may guess
+	rec = do(t, handler, "POST", "/results", `{"ChallengeID": "c", "Nickname": "Alice", "UserID": "spoofed"}`, loggedIn)
+	var result domain.ChallengeResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil || result.UserID != me.UserID {
+		t.Fatalf("got result %+v (%v), expected UserID %s", result, err, me.UserID)
+	}
+	guess := `{"ChallengeResultID": "` + result.ChallengeResultID + `", "RoundNum": 0}`
+	if rec := do(t, handler, "POST", "/guesses", guess); rec.Code != http.StatusForbidden {
+		t.Errorf("guessing without a session: got status %d", rec.Code)
+	}
+	if rec := do(t, handler, "POST", "/guesses", guess, loggedIn); rec.Code != http.StatusOK {
+		t.Errorf("guessing as the owner: got status %d: %s", rec.Code, rec.Body)
+	}
+
+	// anonymous play keeps working
+	rec = do(t, handler, "POST", "/results", `{"ChallengeID": "c", "Nickname": "Bob"}`)
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil || result.UserID != "" {
+		t.Fatalf("got anonymous result %+v (%v)", result, err)
+	}
+	guess = `{"ChallengeResultID": "` + result.ChallengeResultID + `", "RoundNum": 0}`
+	if rec := do(t, handler, "POST", "/guesses", guess); rec.Code != http.StatusOK {
+		t.Errorf("guessing anonymously: got status %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := do(t, handler, "DELETE", "/sessions", "", loggedIn); rec.Code != http.StatusNoContent {
+		t.Errorf("logging out: got status %d", rec.Code)
+	}
+	if rec := do(t, handler, "GET", "/users/me", "", loggedIn); rec.Code != http.StatusUnauthorized {
+		t.Errorf("/users/me after logging out: got status %d", rec.Code)
+	}
+}
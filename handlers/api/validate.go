@@ -0,0 +1,231 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gitlab.com/glatteis/earthwalker/apierror"
+	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/logging"
+)
+
+const (
+	maxNameLength     = 100
+	maxNicknameLength = 20
+)
+
+// fieldError is a problem with one field of a request body, e.g.
+// "Places[2].Location.Lat"
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError lists every invalid field of a request body
+type validationError []fieldError
+
+func (invalid validationError) Error() string {
+	var problems []string
+	for _, problem := range invalid {
+		problems = append(problems, problem.Field+": "+problem.Message)
+	}
+	return strings.Join(problems, "; ")
+}
+
+// check that ok holds for field, adding a fieldError otherwise
+func (invalid *validationError) check(ok bool, field string, format string, args ...interface{}) {
+	if !ok {
+		*invalid = append(*invalid, fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// err is nil if nothing is invalid
+func (invalid validationError) err() error {
+	if len(invalid) == 0 {
+		return nil
+	}
+	return invalid
+}
+
+// decodeRequest decodes the JSON body of r into v.  Unknown fields and values
+// of the wrong type are returned as a validationError.
+func decodeRequest(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return validationError{{Field: typeErr.Field, Message: fmt.Sprintf("must be %s, not %s", typeErr.Type, typeErr.Value)}}
+	}
+	// encoding/json has no type for this one
+	if err != nil && strings.HasPrefix(err.Error(), "json: unknown field ") {
+		field, unquoteErr := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		if unquoteErr == nil {
+			return validationError{{Field: field, Message: "unknown field"}}
+		}
+	}
+	return err
+}
+
+// sendRequestError for err from decoding or validating a request body: 422
+// Unprocessable Entity with the invalid fields for a validationError, 413 if
+// the body was too large (see limits.Body), 400 if it isn't JSON and 500
+// otherwise
+func sendRequestError(w http.ResponseWriter, r *http.Request, text string, err error) {
+	var invalid validationError
+	var tooLarge *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &invalid):
+		logging.FromContext(r.Context()).Info("Invalid request", "err", err)
+		apierror.SendFields(w, text, http.StatusUnprocessableEntity, map[string]interface{}{"fields": invalid})
+	case errors.As(err, &tooLarge):
+		logging.FromContext(r.Context()).Info("Request body too large", "err", err)
+		apierror.Send(w, text, http.StatusRequestEntityTooLarge)
+	case errors.As(err, &syntaxErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		logging.FromContext(r.Context()).Info("Malformed request", "err", err)
+		apierror.Send(w, text, http.StatusBadRequest)
+	default:
+		logging.FromContext(r.Context()).Error("Failed to handle request", "err", err)
+		apierror.Send(w, text, http.StatusInternalServerError)
+	}
+}
+
+// validateMap m, with the limits of conf
+func validateMap(m domain.Map, conf domain.Config) error {
+	var invalid validationError
+	invalid.check(utf8.RuneCountInString(m.Name) <= maxNameLength, "Name", "must be at most %d characters", maxNameLength)
+	if m.NumRounds < 1 {
+		invalid.check(false, "NumRounds", "must be at least 1")
+	} else {
+		invalid.check(conf.MaxRounds == 0 || m.NumRounds <= conf.MaxRounds, "NumRounds", "must be at most %d", conf.MaxRounds)
+	}
+	invalid.check(m.TimeLimit >= 0, "TimeLimit", "must not be negative")
+	invalid.check(m.GraceDistance >= 0, "GraceDistance", "must not be negative")
+	invalid.check(m.Area >= 0, "Area", "must not be negative")
+	invalid.check(m.MinDensity >= 0 && m.MinDensity <= 100, "MinDensity", "must be between 0 and 100")
+	invalid.check(m.MaxDensity >= 0 && m.MaxDensity <= 100, "MaxDensity", "must be between 0 and 100")
+	invalid.check(m.MinDensity <= m.MaxDensity, "MaxDensity", "must not be less than MinDensity")
+	invalid.check(m.Connectedness >= domain.ConnectedAny && m.Connectedness <= domain.ConnectedNever,
+		"Connectedness", "must be 0 (any), 1 (always) or 2 (never)")
+	invalid.check(m.Copyright >= domain.CopyrightAny && m.Copyright <= domain.CopyrightThirdParty,
+		"Copyright", "must be 0 (any), 1 (Google only) or 2 (third party only)")
+	invalid.check(m.Source >= domain.SourceAny && m.Source <= domain.SourceOutdoors,
+		"Source", "must be 0 (any) or 1 (outdoors)")
+	vertices := countVertices(m.Polygon)
+	for _, polygon := range m.DrawnPolygons {
+		vertices += countVertices(polygon)
+	}
+	invalid.check(conf.MaxPolygonVertices == 0 || vertices <= conf.MaxPolygonVertices,
+		"Polygon", "must have at most %d vertices together with DrawnPolygons, not %d", conf.MaxPolygonVertices, vertices)
+	return invalid.err()
+}
+
+// countVertices in decoded geoJSON, i.e. its positions like [lng, lat]
+func countVertices(geoJSON interface{}) int {
+	count := 0
+	switch value := geoJSON.(type) {
+	case []interface{}:
+		if len(value) > 0 {
+			if _, ok := value[0].(float64); ok {
+				return 1
+			}
+		}
+		for _, item := range value {
+			count += countVertices(item)
+		}
+	case map[string]interface{}:
+		for _, item := range value {
+			count += countVertices(item)
+		}
+	}
+	return count
+}
+
+// validateChallenge c, which must be of an existing Map and have a Place for
+// each of at most its NumRounds rounds
+func validateChallenge(c domain.Challenge, maps domain.MapStore, conf domain.Config) error {
+	var invalid validationError
+	numRounds := conf.MaxRounds
+	if len(c.MapID) == 0 {
+		invalid.check(false, "MapID", "must be set")
+	} else if m, err := maps.Get(c.MapID); errors.Is(err, domain.ErrNotFound) {
+		invalid.check(false, "MapID", "there is no map with ID '%s'", c.MapID)
+	} else if err != nil {
+		return fmt.Errorf("failed to get map of challenge: %v", err)
+	} else if numRounds == 0 || m.NumRounds < numRounds {
+		numRounds = m.NumRounds
+	}
+	if len(c.Places) == 0 {
+		invalid.check(false, "Places", "must not be empty")
+	} else {
+		invalid.check(numRounds == 0 || len(c.Places) <= numRounds, "Places", "must have at most %d places", numRounds)
+	}
+	seen := make(map[int]bool)
+	for i, place := range c.Places {
+		field := fmt.Sprintf("Places[%d]", i)
+		invalid.check(place.RoundNum >= 0 && place.RoundNum < len(c.Places),
+			field+".RoundNum", "must be between 0 and %d", len(c.Places)-1)
+		invalid.check(!seen[place.RoundNum], field+".RoundNum", "round %d has more than one place", place.RoundNum)
+		seen[place.RoundNum] = true
+		checkCoords(&invalid, field+".Location", place.Location)
+	}
+	return invalid.err()
+}
+
+// validateResult, which must be of an existing Challenge
+func validateResult(result domain.ChallengeResult, challenges domain.ChallengeStore) error {
+	var invalid validationError
+	if len(result.ChallengeID) == 0 {
+		invalid.check(false, "ChallengeID", "must be set")
+	} else if _, err := challenges.Get(result.ChallengeID); errors.Is(err, domain.ErrNotFound) {
+		invalid.check(false, "ChallengeID", "there is no challenge with ID '%s'", result.ChallengeID)
+	} else if err != nil {
+		return fmt.Errorf("failed to get challenge of result: %v", err)
+	}
+	nicknameLength := utf8.RuneCountInString(result.Nickname)
+	invalid.check(len(strings.TrimSpace(result.Nickname)) > 0 && nicknameLength <= maxNicknameLength,
+		"Nickname", "must be between 1 and %d characters", maxNicknameLength)
+	invalid.check(len(result.Guesses) == 0, "Guesses", "must be empty, guesses are submitted one by one")
+	return invalid.err()
+}
+
+// validateGuess, which must be the next round of an existing ChallengeResult,
+// and return that result
+func validateGuess(guess domain.Guess, results domain.ChallengeResultStore, challenges domain.ChallengeStore) (domain.ChallengeResult, error) {
+	var invalid validationError
+	checkCoords(&invalid, "Location", guess.Location)
+	if len(guess.ChallengeResultID) == 0 {
+		invalid.check(false, "ChallengeResultID", "must be set")
+		return domain.ChallengeResult{}, invalid.err()
+	}
+	result, err := results.Get(guess.ChallengeResultID)
+	if errors.Is(err, domain.ErrNotFound) {
+		invalid.check(false, "ChallengeResultID", "there is no result with ID '%s'", guess.ChallengeResultID)
+		return result, invalid.err()
+	} else if err != nil {
+		return result, fmt.Errorf("failed to get result of guess: %v", err)
+	}
+	challenge, err := challenges.Get(result.ChallengeID)
+	if err != nil {
+		return result, fmt.Errorf("failed to get challenge of guess: %v", err)
+	}
+	if len(result.Guesses) >= len(challenge.Places) {
+		invalid.check(false, "RoundNum", "every round of the challenge has been guessed already")
+	} else {
+		invalid.check(guess.RoundNum == len(result.Guesses), "RoundNum", "must be %d, the next round", len(result.Guesses))
+	}
+	return result, invalid.err()
+}
+
+// checkCoords of field
+func checkCoords(invalid *validationError, field string, coords domain.Coords) {
+	invalid.check(coords.Lat >= -90 && coords.Lat <= 90, field+".Lat", "must be between -90 and 90")
+	invalid.check(coords.Lng >= -180 && coords.Lng <= 180, field+".Lng", "must be between -180 and 180")
+}
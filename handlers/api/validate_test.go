@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"gitlab.com/glatteis/earthwalker/config"
+	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/limits"
+)
+
+// invalidFields of err, which must be nil or a validationError
+func invalidFields(t *testing.T, err error) []string {
+	t.Helper()
+	var invalid validationError
+	if err != nil && !errors.As(err, &invalid) {
+		t.Fatal("unexpected error:", err)
+	}
+	var fields []string
+	for _, problem := range invalid {
+		fields = append(fields, problem.Field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestValidateMap(t *testing.T) {
+	conf := domain.Config{MaxRounds: 10, MaxPolygonVertices: 4}
+	valid := domain.Map{Name: "Alps", NumRounds: 5, MinDensity: 15, MaxDensity: 100, Connectedness: domain.ConnectedAlways}
+	square := map[string]interface{}{"type": "Polygon", "coordinates": []interface{}{[]interface{}{
+		[]interface{}{0.0, 0.0}, []interface{}{1.0, 0.0}, []interface{}{1.0, 1.0}, []interface{}{0.0, 0.0},
+	}}}
+
+	tests := []struct {
+		name     string
+		modify   func(m *domain.Map)
+		expected []string
+	}{
+		{"valid", func(m *domain.Map) {}, nil},
+		{"polygon", func(m *domain.Map) { m.Polygon = square }, nil},
+		{"too many vertices", func(m *domain.Map) { m.Polygon, m.DrawnPolygons = square, []map[string]interface{}{square} }, []string{"Polygon"}},
+		{"no rounds", func(m *domain.Map) { m.NumRounds = 0 }, []string{"NumRounds"}},
+		{"negative rounds", func(m *domain.Map) { m.NumRounds = -1 }, []string{"NumRounds"}},
+		{"too many rounds", func(m *domain.Map) { m.NumRounds = 11 }, []string{"NumRounds"}},
+		{"long name", func(m *domain.Map) { m.Name = strings.Repeat("a", 101) }, []string{"Name"}},
+		{"negative time limit", func(m *domain.Map) { m.TimeLimit = -1 }, []string{"TimeLimit"}},
+		{"densities swapped", func(m *domain.Map) { m.MinDensity, m.MaxDensity = 50, 20 }, []string{"MaxDensity"}},
+		{"density out of range", func(m *domain.Map) { m.MinDensity, m.MaxDensity = -1, 101 }, []string{"MaxDensity", "MinDensity"}},
+		{"enums out of range", func(m *domain.Map) { m.Connectedness, m.Copyright, m.Source = 3, -1, 2 }, []string{"Connectedness", "Copyright", "Source"}},
+	}
+	for _, test := range tests {
+		m := valid
+		test.modify(&m)
+		if fields := invalidFields(t, validateMap(m, conf)); !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("%s: got invalid fields %v, expected %v", test.name, fields, test.expected)
+		}
+	}
+}
+
+func TestValidateChallenge(t *testing.T) {
+	maps := memMapStore{"m": {MapID: "m", NumRounds: 2}}
+	conf := domain.Config{MaxRounds: 10}
+	place := func(round int, lat float64, lng float64) domain.ChallengePlace {
+		return domain.ChallengePlace{RoundNum: round, Location: domain.Coords{Lat: lat, Lng: lng}}
+	}
+
+	tests := []struct {
+		name      string
+		challenge domain.Challenge
+		expected  []string
+	}{
+		{"valid", domain.Challenge{MapID: "m", Places: []domain.ChallengePlace{place(1, 45, 7), place(0, -33.9, 151.2)}}, nil},
+		{"no map", domain.Challenge{Places: []domain.ChallengePlace{place(0, 0, 0)}}, []string{"MapID"}},
+		{"missing map", domain.Challenge{MapID: "x", Places: []domain.ChallengePlace{place(0, 0, 0)}}, []string{"MapID"}},
+		{"no places", domain.Challenge{MapID: "m"}, []string{"Places"}},
+		{"more places than rounds", domain.Challenge{MapID: "m", Places: []domain.ChallengePlace{place(0, 0, 0), place(1, 0, 0), place(2, 0, 0)}}, []string{"Places"}},
+		{"repeated round", domain.Challenge{MapID: "m", Places: []domain.ChallengePlace{place(0, 0, 0), place(0, 0, 0)}}, []string{"Places[1].RoundNum"}},
+		{"round out of range", domain.Challenge{MapID: "m", Places: []domain.ChallengePlace{place(0, 0, 0), place(2, 0, 0)}}, []string{"Places[1].RoundNum"}},
+		{"coords out of range", domain.Challenge{MapID: "m", Places: []domain.ChallengePlace{place(0, 91, -181)}}, []string{"Places[0].Location.Lat", "Places[0].Location.Lng"}},
+	}
+	for _, test := range tests {
+		if fields := invalidFields(t, validateChallenge(test.challenge, maps, conf)); !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("%s: got invalid fields %v, expected %v", test.name, fields, test.expected)
+		}
+	}
+}
+
+func TestValidateResult(t *testing.T) {
+	challenges := memChallengeStore{"c": {ChallengeID: "c"}}
+	tests := []struct {
+		name     string
+		result   domain.ChallengeResult
+		expected []string
+	}{
+		{"valid", domain.ChallengeResult{ChallengeID: "c", Nickname: "Ada"}, nil},
+		{"multibyte nickname", domain.ChallengeResult{ChallengeID: "c", Nickname: strings.Repeat("ü", 20)}, nil},
+		{"no challenge", domain.ChallengeResult{Nickname: "Ada"}, []string{"ChallengeID"}},
+		{"missing challenge", domain.ChallengeResult{ChallengeID: "x", Nickname: "Ada"}, []string{"ChallengeID"}},
+		{"blank nickname", domain.ChallengeResult{ChallengeID: "c", Nickname: "  "}, []string{"Nickname"}},
+		{"long nickname", domain.ChallengeResult{ChallengeID: "c", Nickname: strings.Repeat("a", 21)}, []string{"Nickname"}},
+		{"guesses", domain.ChallengeResult{ChallengeID: "c", Nickname: "Ada", Guesses: []domain.Guess{{}}}, []string{"Guesses"}},
+	}
+	for _, test := range tests {
+		if fields := invalidFields(t, validateResult(test.result, challenges)); !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("%s: got invalid fields %v, expected %v", test.name, fields, test.expected)
+		}
+	}
+}
+
+func TestValidateGuess(t *testing.T) {
+	challenges := memChallengeStore{"c": {ChallengeID: "c", Places: []domain.ChallengePlace{{RoundNum: 0}, {RoundNum: 1}}}}
+	results := memChallengeResultStore{
+		"new":  {ChallengeResultID: "new", ChallengeID: "c"},
+		"half": {ChallengeResultID: "half", ChallengeID: "c", Guesses: []domain.Guess{{RoundNum: 0}}},
+		"done": {ChallengeResultID: "done", ChallengeID: "c", Guesses: []domain.Guess{{RoundNum: 0}, {RoundNum: 1}}},
+	}
+	tests := []struct {
+		name     string
+		guess    domain.Guess
+		expected []string
+	}{
+		{"first round", domain.Guess{ChallengeResultID: "new", RoundNum: 0, Location: domain.Coords{Lat: 48.1, Lng: 11.6}}, nil},
+		{"next round", domain.Guess{ChallengeResultID: "half", RoundNum: 1}, nil},
+		{"no result", domain.Guess{RoundNum: 0}, []string{"ChallengeResultID"}},
+		{"missing result", domain.Guess{ChallengeResultID: "x", RoundNum: 0}, []string{"ChallengeResultID"}},
+		{"repeated round", domain.Guess{ChallengeResultID: "half", RoundNum: 0}, []string{"RoundNum"}},
+		{"skipped round", domain.Guess{ChallengeResultID: "new", RoundNum: 1}, []string{"RoundNum"}},
+		{"past the last round", domain.Guess{ChallengeResultID: "done", RoundNum: 2}, []string{"RoundNum"}},
+		{"coords out of range", domain.Guess{ChallengeResultID: "new", RoundNum: 0, Location: domain.Coords{Lat: -90.5, Lng: 180.5}}, []string{"Location.Lat", "Location.Lng"}},
+	}
+	for _, test := range tests {
+		_, err := validateGuess(test.guess, results, challenges)
+		if fields := invalidFields(t, err); !reflect.DeepEqual(fields, test.expected) {
+			t.Errorf("%s: got invalid fields %v, expected %v", test.name, fields, test.expected)
+		}
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	provider := config.NewProvider(withIDs(domain.Config{MaxRequestBodyKB: 1}))
+	maps := memMapStore{}
+	handler := limits.Body(func() int { return provider.Get().MaxRequestBodyKB }, Root{
+		MapsHandler: Maps{MapStore: maps, Config: provider},
+	})
+
+	tests := []struct {
+		body     string
+		expected int
+		fields   []string
+	}{
+		{`{"Name": "Alps", "NumRounds": 5}`, http.StatusOK, nil},
+		{`{"NumRounds": -1, "MinDensity": 50, "MaxDensity": 20}`, http.StatusUnprocessableEntity, []string{"NumRounds", "MaxDensity"}},
+		{`{"NumRounds": 5, "Rounds": 5}`, http.StatusUnprocessableEntity, []string{"Rounds"}},
+		{`{"NumRounds": "5"}`, http.StatusUnprocessableEntity, []string{"NumRounds"}},
+		{`{"NumRounds": `, http.StatusBadRequest, nil},
+		{``, http.StatusBadRequest, nil},
+		{`{"Name": "` + strings.Repeat("a", 1024) + `"}`, http.StatusRequestEntityTooLarge, nil},
+	}
+	for _, test := range tests {
+		rec := do(t, handler, "POST", "/maps", test.body)
+		if rec.Code != test.expected {
+			t.Errorf("POST /maps %.40s: got status %d, expected %d", test.body, rec.Code, test.expected)
+			continue
+		}
+		if test.fields == nil {
+			continue
+		}
+		var body struct {
+			Error  string
+			Fields []fieldError
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		var fields []string
+		for _, problem := range body.Fields {
+			fields = append(fields, problem.Field)
+		}
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("POST /maps %.40s: got invalid fields %v, expected %v", test.body, fields, test.fields)
+		}
+	}
+	if len(maps) != 1 {
+		t.Errorf("expected only the valid map to be stored, got %d", len(maps))
+	}
+}
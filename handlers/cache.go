@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Cache holds upstream responses, so that we don't fetch (and, where possible,
+// filter) the same resource for every player.
+// Entries are kept in memory and, if a directory is given, on disk; both are
+// bounded in size and evict the least recently used entries first.
+// A nil *Cache is valid and caches nothing.
+type Cache struct {
+	dir            string
+	maxMemoryBytes int64
+	maxDiskBytes   int64
+	defaultTTL     time.Duration
+
+	mu          sync.Mutex
+	memory      map[string]*list.Element // key -> *cacheEntry
+	memoryLRU   *list.List
+	memoryBytes int64
+	disk        map[string]*list.Element // file name -> *diskEntry
+	diskLRU     *list.List
+	diskBytes   int64
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// CachedResponse is what the Cache stores per URL
+type CachedResponse struct {
+	Header  http.Header
+	Body    []byte
+	Expires time.Time
+}
+
+type cacheEntry struct {
+	key      string
+	response CachedResponse
+}
+
+type diskEntry struct {
+	name string
+	size int64
+}
+
+// CacheStats is a snapshot of a Cache's counters
+type CacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Evictions     uint64
+	MemoryEntries int
+	MemoryBytes   int64
+	DiskEntries   int
+	DiskBytes     int64
+}
+
+const cacheFileSuffix = ".cache"
+
+// NewCache with the given limits.  dir may be empty to only cache in memory.
+// defaultTTL is used for responses without explicit freshness information,
+// 0 means those aren't cached at all.
+func NewCache(dir string, maxMemoryBytes int64, maxDiskBytes int64, defaultTTL time.Duration) (*Cache, error) {
+	cache := &Cache{
+		dir:            dir,
+		maxMemoryBytes: maxMemoryBytes,
+		maxDiskBytes:   maxDiskBytes,
+		defaultTTL:     defaultTTL,
+		memory:         make(map[string]*list.Element),
+		memoryLRU:      list.New(),
+		disk:           make(map[string]*list.Element),
+		diskLRU:        list.New(),
+	}
+	if len(dir) == 0 || maxDiskBytes <= 0 {
+		cache.dir = ""
+		return cache, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	// pick up entries from previous runs, oldest first so they're evicted first
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %v", err)
+	}
+	var cached []os.FileInfo
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), cacheFileSuffix) {
+			cached = append(cached, f)
+		}
+	}
+	sort.Slice(cached, func(i, j int) bool {
+		return cached[i].ModTime().Before(cached[j].ModTime())
+	})
+	for _, f := range cached {
+		cache.disk[f.Name()] = cache.diskLRU.PushFront(&diskEntry{name: f.Name(), size: f.Size()})
+		cache.diskBytes += f.Size()
+	}
+	cache.evictDisk()
+	return cache, nil
+}
+
+// Get the unexpired response cached for key
+func (cache *Cache) Get(key string) (CachedResponse, bool) {
+	if cache == nil {
+		return CachedResponse{}, false
+	}
+	now := time.Now()
+	cache.mu.Lock()
+	if elem, ok := cache.memory[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if now.Before(entry.response.Expires) {
+			cache.memoryLRU.MoveToFront(elem)
+			cache.mu.Unlock()
+			atomic.AddUint64(&cache.hits, 1)
+			return entry.response, true
+		}
+		cache.removeMemory(elem)
+	}
+	cache.mu.Unlock()
+
+	response, ok := cache.getDisk(key, now)
+	if !ok {
+		atomic.AddUint64(&cache.misses, 1)
+		return CachedResponse{}, false
+	}
+	atomic.AddUint64(&cache.hits, 1)
+	cache.mu.Lock()
+	cache.putMemory(key, response)
+	cache.mu.Unlock()
+	return response, true
+}
+
+// Put response for key into the cache, if it fits
+func (cache *Cache) Put(key string, response CachedResponse) {
+	if cache == nil {
+		return
+	}
+	cache.mu.Lock()
+	cache.putMemory(key, response)
+	cache.mu.Unlock()
+	if err := cache.putDisk(key, response); err != nil {
+		log.Printf("Failed to write cache entry to disk: %v\n", err)
+	}
+}
+
+// Expiry returns until when res may be cached, and false if it may not be.
+// Entries are keyed by URL only, so responses that vary on anything but
+// Accept-Encoding (which we always send the same) aren't cached either.
+func (cache *Cache) Expiry(res *http.Response) (time.Time, bool) {
+	if cache == nil || res.StatusCode != http.StatusOK || !cacheableVary(res.Header) {
+		return time.Time{}, false
+	}
+	now := time.Now()
+	ttl := cache.defaultTTL
+	explicit := false
+	for _, directive := range strings.Split(res.Header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store", directive == "private", directive == "no-cache",
+			strings.HasPrefix(directive, "private="), strings.HasPrefix(directive, "no-cache="):
+			return time.Time{}, false
+		case strings.HasPrefix(directive, "max-age="), strings.HasPrefix(directive, "s-maxage="):
+			seconds, err := strconv.Atoi(directive[strings.Index(directive, "=")+1:])
+			if err == nil && (!explicit || strings.HasPrefix(directive, "s-maxage=")) {
+				ttl = time.Duration(seconds) * time.Second
+				explicit = true
+			}
+		}
+	}
+	if !explicit {
+		if expires, err := http.ParseTime(res.Header.Get("Expires")); err == nil {
+			ttl = expires.Sub(now)
+		}
+	}
+	if ttl <= 0 {
+		return time.Time{}, false
+	}
+	return now.Add(ttl), true
+}
+
+// cacheableVary returns whether header's Vary allows keying by URL alone
+func cacheableVary(header http.Header) bool {
+	for _, vary := range header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			name = strings.TrimSpace(name)
+			if len(name) > 0 && !strings.EqualFold(name, "Accept-Encoding") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Stats of cache
+func (cache *Cache) Stats() CacheStats {
+	if cache == nil {
+		return CacheStats{}
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return CacheStats{
+		Hits:          atomic.LoadUint64(&cache.hits),
+		Misses:        atomic.LoadUint64(&cache.misses),
+		Evictions:     atomic.LoadUint64(&cache.evictions),
+		MemoryEntries: len(cache.memory),
+		MemoryBytes:   cache.memoryBytes,
+		DiskEntries:   len(cache.disk),
+		DiskBytes:     cache.diskBytes,
+	}
+}
+
+// putMemory, cache.mu must be held
+func (cache *Cache) putMemory(key string, response CachedResponse) {
+	size := int64(len(response.Body))
+	if size > cache.maxMemoryBytes {
+		return
+	}
+	if elem, ok := cache.memory[key]; ok {
+		cache.removeMemory(elem)
+	}
+	cache.memory[key] = cache.memoryLRU.PushFront(&cacheEntry{key: key, response: response})
+	cache.memoryBytes += size
+	for cache.memoryBytes > cache.maxMemoryBytes {
+		cache.removeMemory(cache.memoryLRU.Back())
+		atomic.AddUint64(&cache.evictions, 1)
+	}
+}
+
+// removeMemory, cache.mu must be held
+func (cache *Cache) removeMemory(elem *list.Element) {
+	entry := cache.memoryLRU.Remove(elem).(*cacheEntry)
+	delete(cache.memory, entry.key)
+	cache.memoryBytes -= int64(len(entry.response.Body))
+}
+
+func cacheFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + cacheFileSuffix
+}
+
+func (cache *Cache) getDisk(key string, now time.Time) (CachedResponse, bool) {
+	var response CachedResponse
+	if len(cache.dir) == 0 {
+		return response, false
+	}
+	name := cacheFileName(key)
+	cache.mu.Lock()
+	elem, ok := cache.disk[name]
+	if ok {
+		cache.diskLRU.MoveToFront(elem)
+	}
+	cache.mu.Unlock()
+	if !ok {
+		return response, false
+	}
+	data, err := ioutil.ReadFile(filepath.Join(cache.dir, name))
+	if err == nil {
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(&response)
+	}
+	if err != nil || !now.Before(response.Expires) {
+		cache.mu.Lock()
+		if elem, ok := cache.disk[name]; ok {
+			cache.removeDisk(elem)
+		}
+		cache.mu.Unlock()
+		return CachedResponse{}, false
+	}
+	return response, true
+}
+
+func (cache *Cache) putDisk(key string, response CachedResponse) error {
+	if len(cache.dir) == 0 {
+		return nil
+	}
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(response); err != nil {
+		return err
+	}
+	size := int64(buffer.Len())
+	if size > cache.maxDiskBytes {
+		return nil
+	}
+	// write to a temporary file first, so readers never see half an entry
+	tmp, err := ioutil.TempFile(cache.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buffer.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	name := cacheFileName(key)
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(cache.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if elem, ok := cache.disk[name]; ok {
+		cache.diskBytes -= elem.Value.(*diskEntry).size
+		cache.diskLRU.Remove(elem)
+	}
+	cache.disk[name] = cache.diskLRU.PushFront(&diskEntry{name: name, size: size})
+	cache.diskBytes += size
+	cache.evictDisk()
+	return nil
+}
+
+// evictDisk until the disk cache fits, cache.mu must be held
+func (cache *Cache) evictDisk() {
+	for cache.diskBytes > cache.maxDiskBytes && cache.diskLRU.Len() > 0 {
+		cache.removeDisk(cache.diskLRU.Back())
+		atomic.AddUint64(&cache.evictions, 1)
+	}
+}
+
+// removeDisk, cache.mu must be held
+func (cache *Cache) removeDisk(elem *list.Element) {
+	entry := cache.diskLRU.Remove(elem).(*diskEntry)
+	delete(cache.disk, entry.name)
+	cache.diskBytes -= entry.size
+	if err := os.Remove(filepath.Join(cache.dir, entry.name)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove cache entry from disk: %v\n", err)
+	}
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func cachedBody(body string) CachedResponse {
+	return CachedResponse{Body: []byte(body), Expires: time.Now().Add(time.Hour)}
+}
+
+func TestCacheMemoryEviction(t *testing.T) {
+	cache, err := NewCache("", 10, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put("a", cachedBody("aaaa"))
+	cache.Put("b", cachedBody("bbbb"))
+	// a is now more recently used than b
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	cache.Put("c", cachedBody("cccc"))
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("expected b to be evicted")
+	}
+	if res, ok := cache.Get("a"); !ok || string(res.Body) != "aaaa" {
+		t.Fatal("expected a to be cached, got", string(res.Body))
+	}
+	// too large to ever fit
+	cache.Put("d", cachedBody("ddddddddddddddd"))
+	if _, ok := cache.Get("d"); ok {
+		t.Fatal("expected d not to be cached")
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Evictions != 1 || stats.MemoryBytes != 8 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCacheExpired(t *testing.T) {
+	cache, err := NewCache("", 100, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Put("a", CachedResponse{Body: []byte("a"), Expires: time.Now().Add(-time.Second)})
+	if _, ok := cache.Get("a"); ok {
+		t.Fatal("expected expired entry not to be returned")
+	}
+}
+
+func TestCacheDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "earthwalker-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(dir, 100, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{"Content-Type": []string{"text/javascript"}}
+	cache.Put("https://www.google.com/maps/a.js", CachedResponse{
+		Header:  header,
+		Body:    []byte("filtered"),
+		Expires: time.Now().Add(time.Hour),
+	})
+
+	// a new cache in the same directory, like after a restart
+	cache, err = NewCache(dir, 100, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, ok := cache.Get("https://www.google.com/maps/a.js")
+	if !ok {
+		t.Fatal("expected entry to be read from disk")
+	}
+	if string(res.Body) != "filtered" || res.Header.Get("Content-Type") != "text/javascript" {
+		t.Fatalf("unexpected cached response %+v", res)
+	}
+	if stats := cache.Stats(); stats.DiskEntries != 1 || stats.MemoryEntries != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// a disk limit smaller than the entry evicts it on startup
+	cache, err = NewCache(dir, 100, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get("https://www.google.com/maps/a.js"); ok {
+		t.Fatal("expected entry to be evicted")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Fatal("expected cache directory to be empty, got", len(files), "files")
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	cache, err := NewCache("", 100, 0, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		status  int
+		header  http.Header
+		ok      bool
+		minimum time.Duration
+		maximum time.Duration
+	}{
+		{http.StatusOK, http.Header{}, true, 9 * time.Minute, 10 * time.Minute},
+		{http.StatusNotFound, http.Header{}, false, 0, 0},
+		{http.StatusOK, http.Header{"Cache-Control": {"public, max-age=60"}}, true, 59 * time.Second, time.Minute},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=60, s-maxage=7200"}}, true, 119 * time.Minute, 2 * time.Hour},
+		{http.StatusOK, http.Header{"Cache-Control": {"private, no-store"}}, false, 0, 0},
+		{http.StatusOK, http.Header{"Cache-Control": {"private, max-age=60"}}, false, 0, 0},
+		{http.StatusOK, http.Header{"Cache-Control": {"no-cache"}}, false, 0, 0},
+		{http.StatusOK, http.Header{"Cache-Control": {`no-cache="Set-Cookie", max-age=60`}}, false, 0, 0},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=0"}}, false, 0, 0},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding"}}, true, 59 * time.Second, time.Minute},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Encoding, Accept-Language"}}, false, 0, 0},
+		{http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, false, 0, 0},
+		{http.StatusOK, http.Header{"Expires": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}, true, 58 * time.Minute, time.Hour},
+		{http.StatusOK, http.Header{"Expires": {"0"}}, true, 9 * time.Minute, 10 * time.Minute},
+	}
+	for _, test := range tests {
+		name := strings.TrimSpace(test.header.Get("Cache-Control") + " " + test.header.Get("Expires") + " " + test.header.Get("Vary"))
+		expires, ok := cache.Expiry(&http.Response{StatusCode: test.status, Header: test.header})
+		if ok != test.ok {
+			t.Errorf("%d %q: expected ok %v, got %v", test.status, name, test.ok, ok)
+			continue
+		}
+		ttl := time.Until(expires)
+		if ok && (ttl < test.minimum || ttl > test.maximum) {
+			t.Errorf("%d %q: expected ttl between %v and %v, got %v", test.status, name, test.minimum, test.maximum, ttl)
+		}
+	}
+
+	var noCache *Cache
+	if _, ok := noCache.Expiry(&http.Response{StatusCode: http.StatusOK}); ok {
+		t.Error("expected nil cache not to cache anything")
+	}
+}
@@ -0,0 +1,96 @@
+// Package fakeupstream is a stand-in for Google Maps, serving recorded
+// fixture pages, so that the play proxy can be tested and developed offline.
+//
+// Point handlers.Upstream (or UpstreamURL in the config) at a Server to use
+// it.  Street View itself won't load, as its scripts and tiles aren't
+// recorded, but everything earthwalker does to the responses can be observed.
+package fakeupstream
+
+import (
+	"embed"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+//go:embed fixtures
+var fixtures embed.FS
+
+// fixture served for requests whose path starts with prefix
+type fixture struct {
+	prefix       string
+	file         string
+	contentType  string
+	cacheControl string
+}
+
+// ordered by specificity, the main page matches everything else under /maps/@
+var routes = []fixture{
+	{"/maps/photometa/", "fixtures/photometa.txt", "application/json; charset=UTF-8", "no-cache, no-store, max-age=0, must-revalidate"},
+	{"/maps/_/js/", "fixtures/app.js", "text/javascript; charset=UTF-8", "public, max-age=31536000"},
+	{"/maps/@", "fixtures/maps.html", "text/html; charset=UTF-8", "no-cache, no-store, max-age=0, must-revalidate"},
+}
+
+// Upstream is an http.Handler pretending to be www.google.com.
+// It counts the requests it receives, per path.
+type Upstream struct {
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+// New Upstream
+func New() *Upstream {
+	return &Upstream{requests: make(map[string]int)}
+}
+
+// NewServer starts an httptest.Server with a new Upstream, which the caller
+// must Close
+func NewServer() (*httptest.Server, *Upstream) {
+	upstream := New()
+	return httptest.NewServer(upstream), upstream
+}
+
+func (upstream *Upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upstream.mu.Lock()
+	upstream.requests[r.URL.Path]++
+	upstream.mu.Unlock()
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	for _, route := range routes {
+		if !strings.HasPrefix(r.URL.Path, route.prefix) {
+			continue
+		}
+		body, err := fixtures.ReadFile(route.file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", route.contentType)
+		w.Header().Set("Cache-Control", route.cacheControl)
+		w.Write(body)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// Requests returns how often path was requested
+func (upstream *Upstream) Requests(path string) int {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	return upstream.requests[path]
+}
+
+// TotalRequests returns how many requests were received in total
+func (upstream *Upstream) TotalRequests() int {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	total := 0
+	for _, n := range upstream.requests {
+		total += n
+	}
+	return total
+}
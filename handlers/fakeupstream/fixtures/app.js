@@ -0,0 +1,5 @@
+this._=this._||{};(function(_){var window=this;
+_.Fixture=function(a){return"https://www.google.com/maps/vt?pb="+a};
+_.ConsentUrl="https://consent.google.com/ml";
+_.TilesUrl="https://maps.google.com/maps/vt/pb=";
+}).call(this,this._);
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checkTimeout is how long each readiness check may take
+const checkTimeout = 5 * time.Second
+
+// Healthz responds 200 as long as the process is serving requests at all
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("ok\n"))
+}
+
+// Check returns an error if something we need to serve players isn't working
+type Check func(ctx context.Context) error
+
+// Readyz responds 200 if all Checks pass, and 503 otherwise, with the result
+// of every check as JSON
+type Readyz struct {
+	Checks map[string]Check
+}
+
+// ReadyzResponse is the body of Readyz responses
+type ReadyzResponse struct {
+	Status string `json:"status"` // "ok" or "unavailable"
+	// "ok" or the error, by name of check
+	Checks map[string]string `json:"checks"`
+}
+
+func (handler Readyz) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	response := ReadyzResponse{Status: "ok", Checks: make(map[string]string)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range handler.Checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			result := "ok"
+			if err := check(ctx); err != nil {
+				result = err.Error()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			response.Checks[name] = result
+			if result != "ok" {
+				response.Status = "unavailable"
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if response.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// StaticCheck fails if the frontend or modify.html are missing from static
+func StaticCheck(static *Static) Check {
+	return func(ctx context.Context) error {
+		var missing []string
+		for _, name := range []string{"index.html", modifyHTMLPath} {
+			if !static.Exists(name) {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("missing static files: %s", strings.Join(missing, ", "))
+		}
+		return nil
+	}
+}
+
+// Version of this build
+type Version struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit"`
+	CommitTime string `json:"commit_time,omitempty"`
+	// whether there were uncommitted changes
+	Modified  bool   `json:"modified"`
+	GoVersion string `json:"go_version"`
+	// of the database, see badgerdb.SchemaVersion
+	SchemaVersion int `json:"schema_version"`
+}
+
+// ReadVersion of this build from the information embedded by go build.
+// version overrides the module version, which is "(devel)" unless earthwalker
+// was installed with go install.
+func ReadVersion(version string, schemaVersion int) Version {
+	v := Version{Version: version, Commit: "unknown", SchemaVersion: schemaVersion}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return v
+	}
+	if len(v.Version) == 0 {
+		v.Version = info.Main.Version
+	}
+	v.GoVersion = info.GoVersion
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			v.Commit = setting.Value
+		case "vcs.time":
+			v.CommitTime = setting.Value
+		case "vcs.modified":
+			v.Modified = setting.Value == "true"
+		}
+	}
+	return v
+}
+
+func (v Version) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/handlers/fakeupstream"
+)
+
+func TestHealthz(t *testing.T) {
+	if rec := get(http.HandlerFunc(Healthz), "/healthz"); rec.Code != http.StatusOK {
+		t.Error("expected 200, got", rec.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	broken := func(ctx context.Context) error { return errors.New("broken") }
+	hanging := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	tests := []struct {
+		checks map[string]Check
+		status int
+	}{
+		{map[string]Check{}, http.StatusOK},
+		{map[string]Check{"db": ok, "static": ok}, http.StatusOK},
+		{map[string]Check{"db": ok, "static": broken}, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		rec := get(Readyz{Checks: test.checks}, "/readyz")
+		if rec.Code != test.status {
+			t.Errorf("%d checks: expected %d, got %d", len(test.checks), test.status, rec.Code)
+		}
+		var response ReadyzResponse
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if len(response.Checks) != len(test.checks) {
+			t.Error("expected the result of every check, got", response.Checks)
+		}
+		if test.checks["static"] != nil && rec.Code != http.StatusOK && response.Checks["static"] != "broken" {
+			t.Error("expected the error of the failed check, got", response.Checks)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	Readyz{Checks: map[string]Check{"upstream": hanging}}.ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Error("expected a check which doesn't finish in time to fail, got", rec.Code)
+	}
+}
+
+func TestStaticCheck(t *testing.T) {
+	complete, err := NewStatic(fstest.MapFS{
+		"index.html":   {Data: []byte("<html></html>")},
+		modifyHTMLPath: {Data: []byte(testModifyHTML)},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := StaticCheck(complete)(context.Background()); err != nil {
+		t.Error("expected the frontend to be complete:", err)
+	}
+	incomplete, err := NewStatic(fstest.MapFS{"index.html": {Data: []byte("<html></html>")}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := StaticCheck(incomplete)(context.Background()); err == nil {
+		t.Error("expected missing modify.html to fail the check")
+	}
+}
+
+func TestUpstreamPing(t *testing.T) {
+	server, _ := fakeupstream.NewServer()
+	defer server.Close()
+	upstream, err := NewUpstream(server.URL, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upstream.Ping(context.Background()); err != nil {
+		t.Error("expected the fake upstream to be reachable:", err)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	upstream, err = NewUpstream(failing.URL, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := upstream.Ping(context.Background()); err == nil {
+		t.Error("expected a 502 from upstream to fail the check")
+	}
+	failing.Close()
+	if err := upstream.Ping(context.Background()); err == nil {
+		t.Error("expected an unreachable upstream to fail the check")
+	}
+}
+
+func TestReadVersion(t *testing.T) {
+	v := ReadVersion("v1.2.3", 7)
+	if v.Version != "v1.2.3" || v.SchemaVersion != 7 || len(v.GoVersion) == 0 {
+		t.Error("unexpected version", v)
+	}
+	if v := ReadVersion("", 1); len(v.Version) == 0 {
+		t.Error("expected the module version without an override, got", v)
+	}
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+)
+
+// InFlight counts the requests being handled.  http.Server.Close doesn't wait
+// for handlers, so shutting down waits for them here before closing the db.
+type InFlight struct {
+	mu      sync.Mutex
+	count   int
+	closing bool
+	// idle is closed once the last request has finished while closing
+	idle chan struct{}
+}
+
+// Track the requests to next.  Once Wait has been called, new requests get
+// 503 Service Unavailable.
+func (inFlight *InFlight) Track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !inFlight.start() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		defer inFlight.done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Count of the requests in flight
+func (inFlight *InFlight) Count() int {
+	inFlight.mu.Lock()
+	defer inFlight.mu.Unlock()
+	return inFlight.count
+}
+
+// Wait until the requests in flight have finished
+func (inFlight *InFlight) Wait() {
+	inFlight.mu.Lock()
+	inFlight.closing = true
+	if inFlight.count == 0 {
+		inFlight.mu.Unlock()
+		return
+	}
+	if inFlight.idle == nil {
+		inFlight.idle = make(chan struct{})
+	}
+	idle := inFlight.idle
+	inFlight.mu.Unlock()
+	<-idle
+}
+
+func (inFlight *InFlight) start() bool {
+	inFlight.mu.Lock()
+	defer inFlight.mu.Unlock()
+	if inFlight.closing {
+		return false
+	}
+	inFlight.count++
+	return true
+}
+
+func (inFlight *InFlight) done() {
+	inFlight.mu.Lock()
+	defer inFlight.mu.Unlock()
+	inFlight.count--
+	if inFlight.count == 0 && inFlight.idle != nil {
+		close(inFlight.idle)
+		inFlight.idle = nil
+	}
+}
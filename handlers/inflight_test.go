@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInFlight(t *testing.T) {
+	var inFlight InFlight
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := inFlight.Track(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+
+	finished := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		close(finished)
+	}()
+	<-started
+	if inFlight.Count() != 1 {
+		t.Error("expected 1 request in flight, got", inFlight.Count())
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(waited)
+	}()
+	for closing := false; !closing; {
+		time.Sleep(time.Millisecond)
+		inFlight.mu.Lock()
+		closing = inFlight.closing
+		inFlight.mu.Unlock()
+	}
+	// the server is closing, nothing new may start
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Error("expected 503 while closing, got", rec.Code)
+	}
+	select {
+	case <-waited:
+		t.Fatal("expected Wait to wait for the request in flight")
+	default:
+	}
+
+	close(release)
+	<-finished
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("expected Wait to return once the request has finished")
+	}
+	if inFlight.Count() != 0 {
+		t.Error("expected no requests in flight, got", inFlight.Count())
+	}
+}
@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Google prefixes JSON responses with this, so that they can't be included
+// as scripts from other sites
+const xssiPrefix = ")]}'"
+
+// localized text in photometa (addresses, road names, place names and
+// categories) is encoded as ["text", "language"] pairs
+var languageCodeRegex = regexp.MustCompile("^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$")
+
+const annotationIconPrefix = "https://maps.gstatic.com/mapfiles/annotations/icons/"
+
+// panoramasIndex is where a photometa packet has its panoramas.  Everything
+// else in it is status information, without labels.
+const panoramasIndex = 1
+
+// filterPhotometa removes everything from a street view packet which gives
+// away where it was taken: localized labels and place icons.  Packets which
+// can't be parsed, or have labels outside the panoramas, are filtered with the
+// regexes instead.
+func filterPhotometa(body string) string {
+	filtered, err := filterPhotometaStructured(body)
+	if err != nil {
+		return filterPhotometaRegex(body)
+	}
+	return filtered
+}
+
+// filterPhotometaStructured parses body as the nested array it is, and blanks
+// every label of the panoramas and the icons within it
+func filterPhotometaStructured(body string) (string, error) {
+	prefix := ""
+	if strings.HasPrefix(body, xssiPrefix) {
+		prefix = xssiPrefix
+		body = body[len(xssiPrefix):]
+		// keep the whitespace separating the prefix from the payload
+		trimmed := strings.TrimLeft(body, " \t\r\n")
+		prefix += body[:len(body)-len(trimmed)]
+		body = trimmed
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	var packet interface{}
+	if err := decoder.Decode(&packet); err != nil {
+		return "", err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return "", errors.New("unexpected data after photometa packet")
+	}
+
+	array, ok := packet.([]interface{})
+	if !ok || len(array) <= panoramasIndex {
+		return "", errors.New("no panoramas in photometa packet")
+	}
+	if _, ok := array[panoramasIndex].([]interface{}); !ok {
+		return "", errors.New("no panoramas in photometa packet")
+	}
+	for i := range array {
+		if i != panoramasIndex && hasLabels(array[i]) {
+			return "", errors.New("labels outside the panoramas of photometa packet")
+		}
+	}
+	blankLabels(array[panoramasIndex])
+	stripIcons(packet)
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(packet); err != nil {
+		return "", err
+	}
+	// Encode appends a newline, keep the original trailing whitespace instead
+	encoded := strings.TrimSuffix(buffer.String(), "\n")
+	trailing := body[len(strings.TrimRight(body, " \t\r\n")):]
+	return prefix + encoded + trailing, nil
+}
+
+// hasLabels returns whether value has a label pair anywhere within it
+func hasLabels(value interface{}) bool {
+	array, ok := value.([]interface{})
+	if !ok {
+		return false
+	}
+	if isLabel(array) {
+		return true
+	}
+	for i := range array {
+		if hasLabels(array[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// blankLabels in value, recursively
+func blankLabels(value interface{}) {
+	array, ok := value.([]interface{})
+	if !ok {
+		return
+	}
+	for i := range array {
+		if label, ok := array[i].([]interface{}); ok && isLabel(label) {
+			array[i] = []interface{}{"", ""}
+		} else {
+			blankLabels(array[i])
+		}
+	}
+}
+
+// stripIcons of places from value, recursively.  Their URLs are the same
+// everywhere, so they're stripped wherever they are.
+func stripIcons(value interface{}) {
+	array, ok := value.([]interface{})
+	if !ok {
+		return
+	}
+	for i := range array {
+		if icon, ok := array[i].(string); ok && strings.HasPrefix(icon, annotationIconPrefix) {
+			array[i] = ""
+		} else {
+			stripIcons(array[i])
+		}
+	}
+}
+
+// isLabel returns whether array is a ["text", "language"] pair
+func isLabel(array []interface{}) bool {
+	if len(array) != 2 {
+		return false
+	}
+	text, ok := array[0].(string)
+	if !ok || len(text) == 0 {
+		return false
+	}
+	language, ok := array[1].(string)
+	return ok && languageCodeRegex.MatchString(language)
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the .golden files in testdata")
+
+// TestFilterPhotometaGolden filters the packets in testdata/photometa and
+// compares the results with the .golden files next to them.  The packets are
+// written in the layout of photometa responses, with made up panorama IDs;
+// responses saved from the browser's network tab can be added next to them.
+// Run with -update after changing the filter, and review the diff.
+func TestFilterPhotometaGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "photometa", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no photometa packets in testdata")
+	}
+	for _, input := range inputs {
+		t.Run(filepath.Base(input), func(t *testing.T) {
+			body, err := ioutil.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := filterPhotometa(string(body))
+			golden := strings.TrimSuffix(input, ".txt") + ".golden"
+			if *update {
+				if err := ioutil.WriteFile(golden, []byte(out), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != string(expected) {
+				t.Errorf("Expected\n%s\nbut got\n%s", expected, out)
+			}
+		})
+	}
+}
+
+func TestFilterPhotometaStructured(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		// labels the regex misses, in the address
+		{`[[1],[[null,null,null,[null,null,[["Rue de l'Église","fr"],["Straße (B 2)","de-AT"]]]]]]`,
+			`[[1],[[null,null,null,[null,null,[["",""],["",""]]]]]]`},
+		// places and road names
+		{`[[1],[[null,null,null,null,null,[[null,null,null,null,null,null,null,null,null,[[null,["A","en"]]],null,null,[[[["B","de"]]]]]]]]]`,
+			`[[1],[[null,null,null,null,null,[[null,null,null,null,null,null,null,null,null,[[null,["",""]]],null,null,[[[["",""]]]]]]]]]`},
+		// labels anywhere in the panoramas, pairs which aren't labels are kept
+		{`[[1],[[["2019","05"],null,null,[["x","en"],null,[["",""],["a",1]]],[["Secret Street","en"]]],[["Hidden Town","en"]]]]`,
+			`[[1],[[["2019","05"],null,null,[["",""],null,[["",""],["a",1]]],[["",""]]],[["",""]]]]`},
+		// numbers are kept as they are
+		{`[[1],[[1.50,-0,1e-7,12345678901234567890]]]`, `[[1],[[1.50,-0,1e-7,12345678901234567890]]]`},
+		{")]}'\n[[1],[[null,null,null,[null,null,[[\"x\",\"en\"]]]]]]\n", ")]}'\n[[1],[[null,null,null,[null,null,[[\"\",\"\"]]]]]]\n"},
+		// icons are stripped anywhere
+		{`[[1],[["https://maps.gstatic.com/mapfiles/annotations/icons/cafe.png"]],"https://maps.gstatic.com/mapfiles/annotations/icons/bar.png"]`,
+			`[[1],[[""]],""]`},
+	}
+	for _, test := range tests {
+		out, err := filterPhotometaStructured(test.input)
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		if out != test.output {
+			t.Errorf("Expected\n%s\nbut got\n%s", test.output, out)
+		}
+	}
+
+	for _, invalid := range []string{"", ")]}'", `[["a","en"]`, `[["a","en"]]]`, `[] []`, `[["a","en"]]`, `{"label":["a","en"]}`,
+		// labels outside the panoramas are left to the regex
+		`[[1],[],[["Secret Street","en"]]]`, `[["Hidden Town","en"],[[null]]]`} {
+		if _, err := filterPhotometaStructured(invalid); err == nil {
+			t.Errorf("expected '%s' not to be parsed", invalid)
+		}
+	}
+}
+
+func TestFilterPhotometaFallback(t *testing.T) {
+	out := filterPhotometa(`[["Hidden Town","en"],[[null,[["Secret Street","en"]]]],[["Secret Street","en"]]]`)
+	if strings.Contains(out, "Secret") || strings.Contains(out, "Hidden") {
+		t.Error("expected every label to be filtered, got", out)
+	}
+}
+
+func FuzzFilterPhotometa(f *testing.F) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "photometa", "*.txt"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, input := range inputs {
+		body, err := ioutil.ReadFile(input)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(body))
+	}
+	f.Add(`[["Rue de l'Église","fr"]]`)
+
+	f.Fuzz(func(t *testing.T, body string) {
+		out := filterPhotometa(body)
+		if filterPhotometa(out) != out {
+			t.Errorf("filtering isn't idempotent for %q", body)
+		}
+		payload := strings.TrimPrefix(body, xssiPrefix)
+		if json.Valid([]byte(payload)) && !json.Valid([]byte(strings.TrimPrefix(out, xssiPrefix))) {
+			t.Errorf("valid packet %q became invalid: %q", body, out)
+		}
+	})
+}
@@ -2,16 +2,23 @@
 package handlers
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"net/http"
+	"net/url"
 	"strconv"
-	"strings"
+	"time"
 
+	"gitlab.com/glatteis/earthwalker/auth"
 	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/logging"
+	"golang.org/x/net/html"
 )
 
+// These cookies are read by the frontend.  The server only falls back to
+// them if the session doesn't know the challenge or result.
 const challengeCookieName = "earthwalker_lastChallenge"
 const resultCookiePrefix = "earthwalker_lastResult_"
 
@@ -19,34 +26,98 @@ const resultCookiePrefix = "earthwalker_lastResult_"
 type Play struct {
 	ChallengeStore       domain.ChallengeStore
 	ChallengeResultStore domain.ChallengeResultStore
-	Config               domain.Config
+	Sessions             auth.Sessions
+	// ModifyHTML is inserted into the head of every page, see LoadModifyHTML
+	ModifyHTML []byte
+	Upstream   Upstream
+	// Cache may be nil
+	Cache *Cache
+	// TileServers returns the URL templates of the tile servers of the map
+	// on the page, whose images it may load.  May be nil.
+	TileServers func() []string
+}
+
+// modifyHTMLPath within the static files
+const modifyHTMLPath = "modify_frontend/modify.html"
+
+// LoadModifyHTML reads the HTML which Play inserts into Street View pages
+// from the static files, and makes sure it's usable
+func LoadModifyHTML(static *Static) ([]byte, error) {
+	modifyHTML, err := static.ReadFile(modifyHTMLPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read modify.html: %v", err)
+	}
+	if len(bytes.TrimSpace(modifyHTML)) == 0 {
+		return nil, errors.New("modify.html is empty")
+	}
+	tokenizer := html.NewTokenizer(bytes.NewReader(modifyHTML))
+	elements := 0
+	for tokenType := tokenizer.Next(); tokenType != html.ErrorToken; tokenType = tokenizer.Next() {
+		if tokenType == html.StartTagToken || tokenType == html.SelfClosingTagToken {
+			elements++
+		}
+	}
+	if err := tokenizer.Err(); err != io.EOF {
+		return nil, fmt.Errorf("failed to parse modify.html: %v", err)
+	}
+	if elements == 0 {
+		return nil, errors.New("modify.html contains no elements")
+	}
+	return modifyHTML, nil
 }
 
 func (handler Play) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	challengeID, err := getChallengeID(r)
+	session, err := handler.Sessions.Start(r)
+	if err != nil {
+		http.Error(w, "failed to start session", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to start session", "err", err)
+		return
+	}
+	challengeID, err := getChallengeID(r, session)
+	if err != nil {
+		// nothing to play, let them pick a challenge
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	challenge, err := handler.ChallengeStore.Get(challengeID)
+	if errors.Is(err, domain.ErrNotFound) || (err == nil && len(challenge.Places) == 0) {
+		logging.FromContext(r.Context()).Info("Redirecting player from invalid challenge", "challenge_id", challengeID)
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
 	if err != nil {
-		http.Error(w, "no challengeID in request URL or cookies", http.StatusBadRequest)
-		log.Printf("No challengeID in request URL or cookies: %v", err)
+		http.Error(w, "failed to retrieve challenge", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to retrieve challenge from store", "challenge_id", challengeID, "err", err)
+		return
 	}
-	resultID, err := getResultID(r, challengeID)
+	resultID, err := getResultID(r, session, challengeID)
 	if err != nil {
 		// no result ID, redirect to /join?id=<challengeID>
-		http.Redirect(w, r, "/join?id="+challengeID, http.StatusTemporaryRedirect)
+		http.Redirect(w, r, "/join?id="+url.QueryEscape(challengeID), http.StatusTemporaryRedirect)
 		return
 	}
 	result, err := handler.ChallengeResultStore.Get(resultID)
-	if err != nil {
-		http.Error(w, "failed to retrieve result", http.StatusInternalServerError)
-		log.Printf("Failed to retrieve result with ID '%s' from store: %v", resultID, err)
+	if errors.Is(err, domain.ErrNotFound) || (err == nil && result.ChallengeID != challengeID) {
+		// a stale cookie, or a result of another challenge: start afresh
+		http.Redirect(w, r, "/join?id="+url.QueryEscape(challengeID), http.StatusTemporaryRedirect)
+		return
 	}
-	challenge, err := handler.ChallengeStore.Get(result.ChallengeID)
 	if err != nil {
-		http.Error(w, "failed to retrieve challenge", http.StatusInternalServerError)
-		log.Printf("Failed to retrieve challenge with ID '%s' from store: %v", result.ChallengeID, err)
+		http.Error(w, "failed to retrieve result", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to retrieve result from store", "challenge_result_id", resultID, "err", err)
+		return
 	}
 	// user has already finished this challenge, redirect to /summary
 	if len(result.Guesses) >= len(challenge.Places) {
-		http.Redirect(w, r, "/summary", http.StatusTemporaryRedirect)
+		http.Redirect(w, r, "/summary?id="+url.QueryEscape(challengeID), http.StatusTemporaryRedirect)
+		return
+	}
+	session.Results[result.ChallengeID] = result.ChallengeResultID
+	session.LastChallengeID = result.ChallengeID
+	err = handler.Sessions.Save(w, r, session)
+	if err != nil {
+		http.Error(w, "failed to save session", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to save session", "err", err)
 		return
 	}
 	// (re)set cookies
@@ -55,6 +126,7 @@ func (handler Play) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Value:    result.ChallengeID,
 		MaxAge:   172800,
 		Path:     "/",
+		Secure:   handler.Sessions.ClientIP.Secure(r),
 		SameSite: http.SameSiteLaxMode,
 	})
 	http.SetCookie(w, &http.Cookie{
@@ -62,21 +134,22 @@ func (handler Play) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Value:    result.ChallengeResultID,
 		MaxAge:   172800,
 		Path:     "/",
+		Secure:   handler.Sessions.ClientIP.Secure(r),
 		SameSite: http.SameSiteLaxMode,
 	})
-	log.Println(challenge.Places[len(result.Guesses)].Location)
-	// TODO: FIXME: this fails catastrophically if the player has already
-	//              completed the challenge and tries to navigate back to /play
 	handler.ServeLocation(challenge.Places[len(result.Guesses)].Location, w, r)
 }
 
-func getChallengeID(r *http.Request) (string, error) {
+func getChallengeID(r *http.Request, session domain.Session) (string, error) {
 	// try url params first
 	ids, ok := r.URL.Query()["id"]
 	if ok && len(ids[0]) > 0 {
 		return ids[0], nil
 	}
-	// if no id param, look in cookies
+	// if no id param, look in the session, then in cookies
+	if len(session.LastChallengeID) > 0 {
+		return session.LastChallengeID, nil
+	}
 	challengeCookie, err := r.Cookie(challengeCookieName)
 	if err != nil {
 		return "", fmt.Errorf("no challenge cookie found: %v", err)
@@ -84,7 +157,10 @@ func getChallengeID(r *http.Request) (string, error) {
 	return challengeCookie.Value, nil
 }
 
-func getResultID(r *http.Request, challengeID string) (string, error) {
+func getResultID(r *http.Request, session domain.Session, challengeID string) (string, error) {
+	if resultID, ok := session.Results[challengeID]; ok {
+		return resultID, nil
+	}
 	resultCookie, err := r.Cookie(resultCookiePrefix + challengeID)
 	if err != nil {
 		return "", fmt.Errorf("no result cookie found: %v", err)
@@ -93,61 +169,60 @@ func getResultID(r *http.Request, challengeID string) (string, error) {
 }
 
 func (handler Play) modifyMainPage(target string, w http.ResponseWriter, r *http.Request) {
-	res, err := http.Get(target)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusForbidden)
-		return
+	var tileServers []string
+	if handler.TileServers != nil {
+		tileServers = handler.TileServers()
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	rewriter, err := newHTMLRewriter(tileServers)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusForbidden)
+		http.Error(w, "failed to prepare page", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to create rewriter", "err", err)
 		return
 	}
-	bodyAsString := string(body)
 
-	insertBody, err := ioutil.ReadFile(handler.Config.StaticPath + "/public/modify_frontend/modify.html")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	replacedBody := strings.Replace(bodyAsString, "<head>", "<head> "+string(insertBody), 1)
-	w.Write([]byte(filterUrls(replacedBody)))
-}
-
-func modifyInformation(target string, w http.ResponseWriter, r *http.Request) {
-	req, err := http.NewRequest("GET", target, nil)
-	req.Header.Add("User-Agent", r.Header.Get("User-Agent"))
-	req.Header.Add("Accept", r.Header.Get("Accept"))
-
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusForbidden)
-		return
+	// the page is cached as it was fetched, because it must be rewritten with
+	// a new nonce every time
+	var page io.Reader
+	var toCache *bytes.Buffer
+	var expires time.Time
+	if cached, ok := handler.Cache.Get(target); ok {
+		page = bytes.NewReader(cached.Body)
+	} else {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target, nil)
+		if err != nil {
+			http.Error(w, "failed to create upstream request", http.StatusInternalServerError)
+			logging.FromContext(r.Context()).Error("Failed to create upstream request", "url", target, "err", err)
+			return
+		}
+		res, err := handler.Upstream.do(req, "page")
+		if err != nil {
+			sendUpstreamError(w, r, target, err)
+			return
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			// an error page isn't street view, and mustn't be cached
+			sendUpstreamError(w, r, target, fmt.Errorf("upstream responded %s", res.Status))
+			return
+		}
+		// the page is decoded by the transport, the limit applies to that
+		page = limitBody(res.Body, handler.Upstream.MaxBodyBytes)
+		if expires, ok = handler.Cache.Expiry(res); ok {
+			toCache = &bytes.Buffer{}
+			page = io.TeeReader(page, toCache)
+		}
 	}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		fmt.Println(err.Error())
-		http.Error(w, err.Error(), http.StatusForbidden)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", rewriter.ContentSecurityPolicy())
+	if err := rewriter.Rewrite(w, page, handler.ModifyHTML); err != nil {
+		// the response has already begun, all we can do is stop
+		logging.FromContext(r.Context()).Error("Failed to rewrite page", "url", target, "err", err)
 		return
 	}
-	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusForbidden)
-		return
+	if toCache != nil {
+		handler.Cache.Put(target, CachedResponse{Body: toCache.Bytes(), Expires: expires})
 	}
-
-	if strings.Contains(target, "photometa") {
-		body = []byte(filterPhotometa(string(body)))
-	} else {
-		body = []byte(filterUrls(string(body)))
-	}
-
-	for header := range res.Header {
-		w.Header().Add(header, res.Header.Get(header))
-	}
-	w.Write(body)
 }
 
 func floatToString(number float64) string {
@@ -155,10 +230,10 @@ func floatToString(number float64) string {
 }
 
 // buildURL builds google street view urls from coordinates
-func buildURL(location domain.Coords) string {
+func buildURL(upstream Upstream, location domain.Coords) string {
 
-	template := "https://www.google.com/maps/@%f,%f,3a,90y,0h,90t/data=!3m7!1e1!3m5!1s%s!2e0!3e11!7i3512!8i894?hl=en"
-	return fmt.Sprintf(template, location.Lat, location.Lng, location.PanoID)
+	template := "/maps/@%f,%f,3a,90y,0h,90t/data=!3m7!1e1!3m5!1s%s!2e0!3e11!7i3512!8i894?hl=en"
+	return upstream.url(fmt.Sprintf(template, location.Lat, location.Lng, location.PanoID))
 
 	// 	baseURL, err := url.Parse("https://www.google.com/maps")
 	// 	if err != nil {
@@ -180,15 +255,6 @@ func buildURL(location domain.Coords) string {
 
 // ServeLocation serves a specific location to the user.
 func (handler Play) ServeLocation(l domain.Coords, w http.ResponseWriter, r *http.Request) {
-	mapsURL := buildURL(l)
+	mapsURL := buildURL(handler.Upstream, l)
 	handler.modifyMainPage(mapsURL, w, r)
 }
-
-// ServeGoogle is a proxy to google
-func ServeGoogle(w http.ResponseWriter, r *http.Request) {
-	fullURL := r.URL
-	fullURL.Host = "www.google.com"
-	fullURL.Scheme = "https"
-
-	modifyInformation(fullURL.String(), w, r)
-}
@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/auth"
+	"gitlab.com/glatteis/earthwalker/clientip"
+	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/handlers/fakeupstream"
+)
+
+// Play only ever gets challenges and results, the other methods panic
+type challengeGetter struct {
+	domain.ChallengeStore
+	challenges map[string]domain.Challenge
+}
+
+func (store challengeGetter) Get(challengeID string) (domain.Challenge, error) {
+	challenge, ok := store.challenges[challengeID]
+	if !ok {
+		return challenge, domain.ErrNotFound
+	}
+	return challenge, nil
+}
+
+type resultGetter struct {
+	domain.ChallengeResultStore
+	results map[string]domain.ChallengeResult
+}
+
+func (store resultGetter) Get(challengeResultID string) (domain.ChallengeResult, error) {
+	result, ok := store.results[challengeResultID]
+	if !ok {
+		return result, domain.ErrNotFound
+	}
+	return result, nil
+}
+
+type sessionMap map[string]domain.Session
+
+func (store sessionMap) Insert(session domain.Session) error {
+	store[session.SessionID] = session
+	return nil
+}
+
+func (store sessionMap) Get(sessionID string) (domain.Session, error) {
+	session, ok := store[sessionID]
+	if !ok {
+		return session, domain.ErrNotFound
+	}
+	return session, nil
+}
+
+func (store sessionMap) Delete(sessionID string) error {
+	delete(store, sessionID)
+	return nil
+}
+
+const testModifyHTML = "<script>/* earthwalker */</script>"
+
+// newTestPlay returns a Play and a Proxy in front of a fake upstream, with one
+// challenge "c" of two rounds, result "r" with no guesses and result "done"
+// with both guesses made.
+func newTestPlay(t *testing.T) (Play, Proxy, *fakeupstream.Upstream) {
+	server, fake := fakeupstream.NewServer()
+	t.Cleanup(server.Close)
+	upstream, err := NewUpstream(server.URL, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := NewCache("", 1<<20, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	places := []domain.ChallengePlace{
+		{ChallengeID: "c", RoundNum: 0, Location: domain.Coords{Lat: 48.137154, Lng: 11.576124}},
+		{ChallengeID: "c", RoundNum: 1, Location: domain.Coords{Lat: -33.8568, Lng: 151.2153}},
+	}
+	guesses := []domain.Guess{{ChallengeResultID: "done", RoundNum: 0}, {ChallengeResultID: "done", RoundNum: 1}}
+	play := Play{
+		ChallengeStore: challengeGetter{challenges: map[string]domain.Challenge{
+			"c":     {ChallengeID: "c", Places: places},
+			"empty": {ChallengeID: "empty"},
+		}},
+		ChallengeResultStore: resultGetter{results: map[string]domain.ChallengeResult{
+			"r":     {ChallengeResultID: "r", ChallengeID: "c"},
+			"done":  {ChallengeResultID: "done", ChallengeID: "c", Guesses: guesses},
+			"other": {ChallengeResultID: "other", ChallengeID: "empty"},
+		}},
+		Sessions:   auth.Sessions{Store: sessionMap{}},
+		ModifyHTML: []byte(testModifyHTML),
+		Upstream:   upstream,
+		Cache:      cache,
+	}
+	return play, Proxy{Upstream: upstream, Cache: cache}, fake
+}
+
+func get(handler http.Handler, url string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPlayServesModifiedPage(t *testing.T) {
+	play, _, fake := newTestPlay(t)
+
+	rec := get(play, "/play?id=c", &http.Cookie{Name: resultCookiePrefix + "c", Value: "r"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `<head><script nonce="`) || !strings.Contains(body, "/* earthwalker */") {
+		t.Error("expected modify.html to be inserted into the head")
+	}
+	for _, url := range []string{`"https://www.google.com/maps/preview/"`, `href="https://www.google.com/`, `src="https://www.google.com/`} {
+		if strings.Contains(body, url) {
+			t.Errorf("expected %s to be rewritten", url)
+		}
+	}
+	if !strings.Contains(rec.Header().Get("Content-Security-Policy"), "'nonce-") {
+		t.Error("expected a Content-Security-Policy with a nonce, got", rec.Header().Get("Content-Security-Policy"))
+	}
+	if fake.TotalRequests() != 1 {
+		t.Error("expected 1 upstream request, got", fake.TotalRequests())
+	}
+	if fake.Requests("/maps/@48.137154,11.576124,3a,90y,0h,90t/data=!3m7!1e1!3m5!1s!2e0!3e11!7i3512!8i894") != 1 {
+		t.Error("expected the first place to be requested")
+	}
+
+	// the result is remembered by the session now, no cookie needed
+	var session *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == auth.SessionCookieName {
+			session = cookie
+		}
+	}
+	if session == nil {
+		t.Fatal("expected a session cookie")
+	}
+	if rec := get(play, "/play", session); rec.Code != http.StatusOK {
+		t.Errorf("expected 200 with session, got %d", rec.Code)
+	}
+}
+
+func TestPlayCookiesBehindProxy(t *testing.T) {
+	play, _, _ := newTestPlay(t)
+	trusted, err := clientip.ParseNets([]string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	play.Sessions.ClientIP = clientip.Resolver{TrustedProxies: trusted}
+
+	req := httptest.NewRequest(http.MethodGet, "/play?id=c", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.AddCookie(&http.Cookie{Name: resultCookiePrefix + "c", Value: "r"})
+	rec := httptest.NewRecorder()
+	play.ServeHTTP(rec, req)
+	cookies := rec.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("expected cookies")
+	}
+	for _, cookie := range cookies {
+		if !cookie.Secure {
+			t.Errorf("expected cookie %s to be secure behind a trusted HTTPS proxy", cookie.Name)
+		}
+	}
+}
+
+func TestPlayUpstreamErrorPage(t *testing.T) {
+	play, _, _ := newTestPlay(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("<html><body>sorry</body></html>"))
+	}))
+	t.Cleanup(server.Close)
+	upstream, err := NewUpstream(server.URL, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	play.Upstream = upstream
+
+	for i := 0; i < 2; i++ {
+		rec := get(play, "/play?id=c", &http.Cookie{Name: resultCookiePrefix + "c", Value: "r"})
+		if rec.Code != http.StatusBadGateway || strings.Contains(rec.Body.String(), "sorry") {
+			t.Errorf("expected 502 without the error page, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	if requests != 2 {
+		t.Error("expected the error page not to be cached, got", requests, "upstream requests")
+	}
+}
+
+func TestPlayPageTooLarge(t *testing.T) {
+	play, _, _ := newTestPlay(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Cache-Control", "max-age=600")
+		w.Write([]byte("<html><head></head><body>" + strings.Repeat("x", 1000) + "</body></html>"))
+	}))
+	t.Cleanup(server.Close)
+	upstream, err := NewUpstream(server.URL, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.MaxBodyBytes = 100
+	play.Upstream = upstream
+
+	for i := 0; i < 2; i++ {
+		rec := get(play, "/play?id=c", &http.Cookie{Name: resultCookiePrefix + "c", Value: "r"})
+		if strings.Contains(rec.Body.String(), "</body>") {
+			t.Error("expected the page to be cut off")
+		}
+	}
+	if requests != 2 {
+		t.Error("expected the page not to be cached, got", requests, "upstream requests")
+	}
+}
+
+func TestPlayRedirects(t *testing.T) {
+	play, _, fake := newTestPlay(t)
+
+	tests := []struct {
+		url      string
+		resultID string
+		location string
+	}{
+		{"/play", "", "/"},
+		{"/play?id=c", "", "/join?id=c"},
+		{"/play?id=c", "done", "/summary?id=c"},
+		{"/play?id=missing", "r", "/"},
+		{"/play?id=empty", "other", "/"},
+		// stale cookies
+		{"/play?id=c", "missing", "/join?id=c"},
+		{"/play?id=c", "other", "/join?id=c"},
+	}
+	for _, test := range tests {
+		var cookies []*http.Cookie
+		if len(test.resultID) > 0 {
+			challengeID := strings.TrimPrefix(test.url, "/play?id=")
+			cookies = append(cookies, &http.Cookie{Name: resultCookiePrefix + challengeID, Value: test.resultID})
+		}
+		rec := get(play, test.url, cookies...)
+		if rec.Code != http.StatusTemporaryRedirect || rec.Header().Get("Location") != test.location {
+			t.Errorf("%s with result '%s': expected redirect to %s, got %d %s",
+				test.url, test.resultID, test.location, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+	if fake.TotalRequests() != 0 {
+		t.Error("expected no upstream requests, got", fake.TotalRequests())
+	}
+}
+
+func TestLoadModifyHTML(t *testing.T) {
+	for content, valid := range map[string]bool{
+		testModifyHTML:         true,
+		" \n":                  false,
+		"just text, no HTML\n": false,
+	} {
+		static, err := NewStatic(fstest.MapFS{modifyHTMLPath: {Data: []byte(content)}}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modifyHTML, err := LoadModifyHTML(static)
+		if valid && (err != nil || string(modifyHTML) != content) {
+			t.Errorf("expected %q to be loaded, got %q, %v", content, modifyHTML, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("expected %q to be rejected", content)
+		}
+	}
+
+	static, err := NewStatic(fstest.MapFS{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadModifyHTML(static); err == nil {
+		t.Error("expected missing modify.html to be an error")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	handler := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var places []domain.ChallengePlace
+		_ = places[1]
+	}))
+	rec := get(handler, "/play")
+	if rec.Code != http.StatusInternalServerError {
+		t.Error("expected 500 after a panic, got", rec.Code)
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	tests := []struct {
+		port     string
+		url      string
+		location string
+	}{
+		{"443", "http://example.com/play?id=c", "https://example.com/play?id=c"},
+		{"443", "http://example.com:80/", "https://example.com/"},
+		{"8443", "http://192.168.0.2:8080/api/maps", "https://192.168.0.2:8443/api/maps"},
+		{"8443", "http://[::1]:8080/", "https://[::1]:8443/"},
+	}
+	for _, test := range tests {
+		rec := get(RedirectHTTPS(test.port), test.url)
+		if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != test.location {
+			t.Errorf("%s: expected redirect to %s, got %d %s", test.url, test.location, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	_, proxy, fake := newTestPlay(t)
+
+	for i := 0; i < 2; i++ {
+		rec := get(proxy, "/maps/photometa/v1?authuser=0&hl=en&gl=de&pb=fixture")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		body := rec.Body.String()
+		// the regex fallback would miss the parentheses
+		for _, label := range []string{"Marienplatz", "München", "The Body Shop", "Apotheke", "Alter Peter", "maps.gstatic.com"} {
+			if strings.Contains(body, label) {
+				t.Errorf("expected '%s' to be filtered from photometa", label)
+			}
+		}
+		if !json.Valid([]byte(strings.TrimPrefix(body, xssiPrefix))) {
+			t.Error("expected photometa to stay valid JSON, got", body)
+		}
+	}
+	// photometa must be filtered afresh every time
+	if n := fake.Requests("/maps/photometa/v1"); n != 2 {
+		t.Error("expected photometa to bypass the cache, got", n, "upstream requests")
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := get(proxy, "/maps/_/js/k=maps.m.en.fixture/m=sc2/rt=j/d=1")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+		if strings.Contains(rec.Body.String(), "https://www.google.com/") {
+			t.Error("expected google URLs to be rewritten")
+		}
+		if rec.Header().Get("Content-Type") != "text/javascript; charset=UTF-8" {
+			t.Error("expected upstream headers, got Content-Type", rec.Header().Get("Content-Type"))
+		}
+	}
+	if n := fake.Requests("/maps/_/js/k=maps.m.en.fixture/m=sc2/rt=j/d=1"); n != 1 {
+		t.Error("expected script to be served from the cache, got", n, "upstream requests")
+	}
+}
+
+func TestNewUpstream(t *testing.T) {
+	for _, invalid := range []string{"", "www.google.com", "ftp://www.google.com", "https://"} {
+		if _, err := NewUpstream(invalid, time.Second); err == nil {
+			t.Errorf("expected '%s' to be rejected", invalid)
+		}
+	}
+	upstream, err := NewUpstream("http://localhost:8081/", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url := upstream.url("/maps/a?b=c"); url != "http://localhost:8081/maps/a?b=c" {
+		t.Error("unexpected upstream URL", url)
+	}
+	if url := (Upstream{}).url("/maps/a"); url != "https://www.google.com/maps/a" {
+		t.Error("unexpected default upstream URL", url)
+	}
+}
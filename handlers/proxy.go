@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+
+	"gitlab.com/glatteis/earthwalker/logging"
+)
+
+// Proxy to google, serving everything under /maps/
+type Proxy struct {
+	Upstream Upstream
+	// Cache may be nil
+	Cache *Cache
+}
+
+// hopHeaders only apply to one connection, so they aren't forwarded
+// (RFC 7230 section 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// privateHeaders are meant for us, or would identify the player to google
+var privateHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+}
+
+// upstreamEncodings are the content encodings we can decode to filter bodies
+const upstreamEncodings = "gzip, br"
+
+func (proxy Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// street view only needs to fetch things, anything else would let clients
+	// act on google through us
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target := proxy.Upstream.url(r.URL.RequestURI())
+	// photometa contains the labels we strip, which must be filtered afresh
+	// every time, in case the filters have changed since
+	isPhotometa := strings.Contains(target, "photometa")
+	cacheable := r.Method == http.MethodGet && !isPhotometa
+	if cacheable {
+		if cached, ok := proxy.Cache.Get(target); ok {
+			proxy.writeProxied(w, r, http.StatusOK, cached.Header, cached.Body)
+			return
+		}
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target, nil)
+	if err != nil {
+		http.Error(w, "failed to create upstream request", http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Error("Failed to create upstream request", "url", target, "err", err)
+		return
+	}
+	req.Header = r.Header.Clone()
+	removeHopHeaders(req.Header)
+	for _, header := range privateHeaders {
+		req.Header.Del(header)
+	}
+	req.Header.Set("Accept-Encoding", upstreamEncodings)
+
+	kind := "other"
+	if isPhotometa {
+		kind = "photometa"
+	}
+	res, err := proxy.Upstream.do(req, kind)
+	if err != nil {
+		sendUpstreamError(w, r, target, err)
+		return
+	}
+	defer res.Body.Close()
+	body, err := proxy.Upstream.readBody(res)
+	if err != nil {
+		sendUpstreamError(w, r, target, err)
+		return
+	}
+
+	header := res.Header.Clone()
+	removeHopHeaders(header)
+	// recomputed when writing
+	header.Del("Content-Length")
+	if isPhotometa || isText(header.Get("Content-Type")) {
+		body, err = filterEncoded(header.Get("Content-Encoding"), body, proxy.Upstream.MaxBodyBytes, func(decoded string) string {
+			if isPhotometa {
+				return filterPhotometa(decoded)
+			}
+			return filterUrls(decoded)
+		})
+		if errors.Is(err, errBodyTooLarge) {
+			sendUpstreamError(w, r, target, err)
+			return
+		}
+		if err != nil {
+			// we must not pass on what we couldn't filter
+			http.Error(w, "failed to filter upstream response", http.StatusBadGateway)
+			logging.FromContext(r.Context()).Error("Failed to filter upstream response", "url", target, "err", err)
+			return
+		}
+	}
+
+	if expires, ok := proxy.Cache.Expiry(res); ok && cacheable {
+		// cookies are meant for one client only
+		cachedHeader := header.Clone()
+		cachedHeader.Del("Set-Cookie")
+		proxy.Cache.Put(target, CachedResponse{Header: cachedHeader, Body: body, Expires: expires})
+	}
+	proxy.writeProxied(w, r, res.StatusCode, header, body)
+}
+
+// writeProxied writes body, which is encoded as header says, decoding it if
+// the client doesn't accept that encoding
+func (proxy Proxy) writeProxied(w http.ResponseWriter, r *http.Request, status int, header http.Header, body []byte) {
+	encoding := header.Get("Content-Encoding")
+	if len(encoding) > 0 && !acceptsEncoding(r, encoding) {
+		decoded, err := decodeBody(encoding, body, proxy.Upstream.MaxBodyBytes)
+		if errors.Is(err, errBodyTooLarge) {
+			sendUpstreamError(w, r, r.URL.RequestURI(), err)
+			return
+		}
+		if err != nil {
+			http.Error(w, "failed to decode upstream response", http.StatusBadGateway)
+			logging.FromContext(r.Context()).Error("Failed to decode upstream response", "encoding", encoding, "err", err)
+			return
+		}
+		body = decoded
+		header = header.Clone()
+		header.Del("Content-Encoding")
+	}
+	for key, values := range header {
+		w.Header()[key] = append([]string(nil), values...)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// sendUpstreamError responds 504 if upstream took too long and 502 otherwise,
+// e.g. if its response was too large
+func sendUpstreamError(w http.ResponseWriter, r *http.Request, target string, err error) {
+	if r.Context().Err() != nil {
+		// the client has gone away, there's nobody to respond to
+		return
+	}
+	if isTimeout(err) {
+		http.Error(w, "upstream timed out", http.StatusGatewayTimeout)
+	} else if errors.Is(err, errBodyTooLarge) {
+		http.Error(w, "upstream response too large", http.StatusBadGateway)
+	} else {
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	}
+	logging.FromContext(r.Context()).Error("Failed to fetch from upstream", "url", target, "err", err)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// removeHopHeaders from header, including those named in its Connection header
+func removeHopHeaders(header http.Header) {
+	for _, connection := range header.Values("Connection") {
+		for _, name := range strings.Split(connection, ",") {
+			if name = strings.TrimSpace(name); len(name) > 0 {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// isText returns whether bodies of contentType may contain URLs to filter.
+// Anything else (images, fonts, protobuf) is passed on untouched.
+func isText(contentType string) bool {
+	if len(contentType) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "javascript") ||
+		strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "xml")
+}
+
+// acceptsEncoding returns whether the client making r accepts encoding
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, accepted := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(accepted, ";")
+			name = strings.TrimSpace(name)
+			if !strings.EqualFold(name, encoding) && name != "*" {
+				continue
+			}
+			return qValue(params) > 0
+		}
+	}
+	return false
+}
+
+// qValue of the parameters of an Accept-Encoding entry, 1 if there is none
+func qValue(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(key, "q") {
+			q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return 0
+			}
+			return q
+		}
+	}
+	return 1
+}
+
+// filterEncoded decodes body, filters it, and encodes it again
+func filterEncoded(encoding string, body []byte, maxBytes int64, filter func(string) string) ([]byte, error) {
+	decoded, err := decodeBody(encoding, body, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return encodeBody(encoding, []byte(filter(string(decoded))))
+}
+
+// decodeBody, failing with errBodyTooLarge if it's decoded to more than
+// maxBytes, 0 for no limit
+func decodeBody(encoding string, body []byte, maxBytes int64) ([]byte, error) {
+	var reader io.Reader
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip header: %v", err)
+		}
+		reader = gzipReader
+	case "br":
+		reader = brotli.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("unsupported content encoding '%s'", encoding)
+	}
+	decoded, err := ioutil.ReadAll(limitBody(reader, maxBytes))
+	if errors.Is(err, errBodyTooLarge) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s body: %v", encoding, err)
+	}
+	return decoded, nil
+}
+
+func encodeBody(encoding string, body []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	var writer io.WriteCloser
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		writer = gzip.NewWriter(&buffer)
+	case "br":
+		writer = brotli.NewWriter(&buffer)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding '%s'", encoding)
+	}
+	if _, err := writer.Write(body); err != nil {
+		return nil, fmt.Errorf("failed to encode %s body: %v", encoding, err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode %s body: %v", encoding, err)
+	}
+	return buffer.Bytes(), nil
+}
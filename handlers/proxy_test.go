@@ -0,0 +1,335 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"gitlab.com/glatteis/earthwalker/metrics"
+)
+
+// newTestProxy returns a Proxy in front of an upstream served by handler
+func newTestProxy(t *testing.T, handler http.HandlerFunc, timeout time.Duration) Proxy {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	upstream, err := NewUpstream(server.URL, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Proxy{Upstream: upstream}
+}
+
+func TestProxyForwarding(t *testing.T) {
+	requests := 0
+	proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		for _, header := range []string{"Cookie", "Authorization", "X-Forwarded-For", "Forwarded"} {
+			if len(r.Header.Get(header)) > 0 {
+				t.Errorf("expected %s not to be forwarded", header)
+			}
+		}
+		if r.Header.Get("User-Agent") != "test-agent" || r.Header.Get("Accept-Language") != "de" {
+			t.Error("expected end-to-end headers to be forwarded, got", r.Header)
+		}
+		if r.Header.Get("Accept-Encoding") != upstreamEncodings {
+			t.Error("expected Accept-Encoding to be", upstreamEncodings, "got", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Add("X-Multi", "a")
+		w.Header().Add("X-Multi", "b")
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte(`go to https://www.google.com/maps`))
+	}, time.Second)
+
+	req := httptest.NewRequest(http.MethodGet, "/maps/preview/log204", nil)
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set("Accept-Language", "de")
+	req.Header.Set("Cookie", "earthwalker_session=secret")
+	req.Header.Set("Authorization", "Bearer ew_secret")
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusTeapot {
+		t.Error("expected upstream status to be passed through, got", rec.Code)
+	}
+	if values := rec.Header().Values("X-Multi"); len(values) != 2 {
+		t.Error("expected both values of X-Multi, got", values)
+	}
+	if rec.Body.String() != "go to /maps" {
+		t.Error("expected filtered body, got", rec.Body.String())
+	}
+	if rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) {
+		t.Error("expected Content-Length to be recomputed, got", rec.Header().Get("Content-Length"))
+	}
+
+	// only fetching is forwarded
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/maps/preview/log204", strings.NewReader("ping")))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("expected 405 allowing GET and HEAD for POST, got %d allowing '%s'", rec.Code, rec.Header().Get("Allow"))
+	}
+	if requests != 1 {
+		t.Error("expected POST not to be forwarded, got", requests, "upstream requests")
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":        {"X-Hop, keep-alive"},
+		"X-Hop":             {"1"},
+		"Keep-Alive":        {"timeout=5"},
+		"Transfer-Encoding": {"chunked"},
+		"Cache-Control":     {"max-age=60"},
+	}
+	removeHopHeaders(header)
+	if len(header) != 1 || header.Get("Cache-Control") != "max-age=60" {
+		t.Error("expected only Cache-Control to remain, got", header)
+	}
+}
+
+func TestProxyEncodings(t *testing.T) {
+	script := `var u = "https://www.google.com/maps/vt";`
+	filtered := `var u = "/maps/vt";`
+	png := []byte("\x89PNG https://www.google.com/ \x00")
+	encode := func(encoding string, body []byte) []byte {
+		var buffer bytes.Buffer
+		switch encoding {
+		case "gzip":
+			writer := gzip.NewWriter(&buffer)
+			writer.Write(body)
+			writer.Close()
+		case "br":
+			writer := brotli.NewWriter(&buffer)
+			writer.Write(body)
+			writer.Close()
+		default:
+			buffer.Write(body)
+		}
+		return buffer.Bytes()
+	}
+	proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		encoding := r.URL.Query().Get("encoding")
+		if len(encoding) > 0 {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		if r.URL.Path == "/maps/image.png" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(encode(encoding, png))
+			return
+		}
+		w.Header().Set("Content-Type", "text/javascript; charset=UTF-8")
+		w.Write(encode(encoding, []byte(script)))
+	}, time.Second)
+
+	tests := []struct {
+		url            string
+		acceptEncoding string
+		encoding       string
+		body           []byte
+	}{
+		{"/maps/a.js", "gzip, deflate, br", "", []byte(filtered)},
+		{"/maps/a.js?encoding=gzip", "gzip, deflate, br", "gzip", []byte(filtered)},
+		{"/maps/a.js?encoding=br", "gzip, deflate, br", "br", []byte(filtered)},
+		{"/maps/a.js?encoding=br", "gzip", "", []byte(filtered)},
+		{"/maps/a.js?encoding=gzip", "gzip;q=0, br", "", []byte(filtered)},
+		{"/maps/a.js?encoding=gzip", "", "", []byte(filtered)},
+		{"/maps/a.js?encoding=compress", "*", "", nil},
+		{"/maps/image.png?encoding=gzip", "gzip", "gzip", png},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.url, nil)
+		if len(test.acceptEncoding) > 0 {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+
+		if test.body == nil {
+			if rec.Code != http.StatusBadGateway {
+				t.Errorf("%s: expected 502 for a body which can't be filtered, got %d", test.url, rec.Code)
+			}
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected 200, got %d", test.url, rec.Code)
+			continue
+		}
+		if encoding := rec.Header().Get("Content-Encoding"); encoding != test.encoding {
+			t.Errorf("%s (Accept-Encoding %s): expected encoding '%s', got '%s'", test.url, test.acceptEncoding, test.encoding, encoding)
+		}
+		if rec.Header().Get("Content-Length") != strconv.Itoa(rec.Body.Len()) {
+			t.Errorf("%s: Content-Length %s doesn't match body length %d", test.url, rec.Header().Get("Content-Length"), rec.Body.Len())
+		}
+		body, err := decodeBody(rec.Header().Get("Content-Encoding"), rec.Body.Bytes(), 0)
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+			continue
+		}
+		if !bytes.Equal(body, test.body) {
+			t.Errorf("%s: expected body %q, got %q", test.url, test.body, body)
+		}
+	}
+}
+
+func TestProxyUpstreamFailures(t *testing.T) {
+	registry := metrics.NewRegistry()
+	errors := registry.Counter("errors_total", "", "kind", "reason")
+	duration := registry.Histogram("duration_seconds", "", metrics.DefaultBuckets, "kind")
+
+	// nothing listens here anymore
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	upstream, err := NewUpstream(closed.URL, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.Errors, upstream.Duration = errors, duration
+	rec := httptest.NewRecorder()
+	Proxy{Upstream: upstream}.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/maps/a.js", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Error("expected 502 for an unreachable upstream, got", rec.Code)
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	slow := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}, 50*time.Millisecond)
+	slow.Upstream.Errors, slow.Upstream.Duration = errors, duration
+	rec = httptest.NewRecorder()
+	slow.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/maps/photometa/v1", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Error("expected 504 for a slow upstream, got", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		`errors_total{kind="other",reason="unavailable"} 1`,
+		`errors_total{kind="photometa",reason="timeout"} 1`,
+		`duration_seconds_count{kind="other"} 1`,
+		`duration_seconds_count{kind="photometa"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("expected '%s' in\n%s", line, rec.Body.String())
+		}
+	}
+}
+
+func TestProxyMaxBodyBytes(t *testing.T) {
+	proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".js") {
+			// small, but large once decoded
+			w.Header().Set("Content-Type", "text/javascript")
+			w.Header().Set("Content-Encoding", "gzip")
+			writer := gzip.NewWriter(w)
+			writer.Write(bytes.Repeat([]byte("x"), 1000))
+			writer.Close()
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(bytes.Repeat([]byte("x"), 10))
+	}, time.Second)
+	cache, err := NewCache("", 1<<20, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Cache = cache
+
+	for _, test := range []struct {
+		maximum int64
+		status  int
+	}{
+		{0, http.StatusOK},
+		{10, http.StatusOK},
+		{9, http.StatusBadGateway},
+	} {
+		proxy.Upstream.MaxBodyBytes = test.maximum
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/maps/%d.jpg", test.maximum), nil))
+		if rec.Code != test.status {
+			t.Errorf("maximum %d: expected %d, got %d", test.maximum, test.status, rec.Code)
+		}
+		if _, cached := proxy.Cache.Get(proxy.Upstream.url(fmt.Sprintf("/maps/%d.jpg", test.maximum))); cached != (test.status == http.StatusOK) {
+			t.Errorf("maximum %d: expected cached %v", test.maximum, test.status == http.StatusOK)
+		}
+	}
+
+	// the limit applies to the decoded body too
+	proxy.Upstream.MaxBodyBytes = 100
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/maps/bomb.js", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Error("expected 502 for a body too large once decoded, got", rec.Code)
+	}
+}
+
+func TestProxyCancellation(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}, 10*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/maps/a.js", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		proxy.ServeHTTP(rec, req)
+		close(done)
+	}()
+	<-started
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the upstream request to be cancelled with the client's")
+	}
+	<-done
+	if rec.Body.Len() != 0 {
+		t.Error("expected nothing to be written to a client which has gone away, got", rec.Body.String())
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header   string
+		encoding string
+		accepts  bool
+	}{
+		{"gzip, deflate, br", "gzip", true},
+		{"gzip, deflate, br", "br", true},
+		{"deflate", "gzip", false},
+		{"", "gzip", false},
+		{"GZIP", "gzip", true},
+		{"gzip;q=0", "gzip", false},
+		{"gzip; q=0.5", "gzip", true},
+		{"*", "br", true},
+		{"*;q=0", "br", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", test.header)
+		if acceptsEncoding(req, test.encoding) != test.accepts {
+			t.Errorf("Accept-Encoding '%s' with %s: expected %v", test.header, test.encoding, test.accepts)
+		}
+	}
+}
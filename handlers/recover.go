@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"gitlab.com/glatteis/earthwalker/logging"
+)
+
+// Recover from panics in next, so that one broken request can't take the
+// server (and the database with it) down
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				// deliberately aborted, net/http doesn't log these either
+				panic(err)
+			}
+			logging.FromContext(r.Context()).Error("Panic serving request", "method", r.Method, "path", r.URL.Path,
+				"panic", fmt.Sprint(err), "stack", string(debug.Stack()))
+			// if the response has already begun, this only logs a warning
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -21,9 +21,10 @@ var compiledGoogleMapsRegex *regexp.Regexp = regexp.MustCompile(googleMapsRegex)
 var googleConsentRegex = "https:\\/\\/consent\\.google\\.com/"
 var compiledGoogleConsentRegex *regexp.Regexp = regexp.MustCompile(googleConsentRegex)
 
-// filterStrings filters all string contents from a given string (as byte array),
-// used to strip all localization information from a specific street view packet
-func filterPhotometa(body string) string {
+// filterPhotometaRegex filters all string contents from a given string (as byte array),
+// used to strip all localization information from a specific street view packet.
+// It is the fallback of filterPhotometa for packets which it can't parse.
+func filterPhotometaRegex(body string) string {
 	result := compiledListOfStringsRegex.ReplaceAllString(body, replaceListOfStringsWith)
 	result = compiledIconRegex.ReplaceAllString(result, replaceIconWith)
 	return result
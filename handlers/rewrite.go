@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// contentSecurityPolicy of proxied pages.  Only scripts carrying the nonce,
+// and scripts loaded by those, may run.  The nonce is put on the scripts
+// which google put its own nonce on, and on ours.
+// The hosts are those of street view, the Maps JavaScript API and its fonts;
+// images may also come from the tile servers of the map.
+const contentSecurityPolicy = "default-src 'self'; " +
+	"script-src 'nonce-%s' 'strict-dynamic' 'self' https://maps.googleapis.com https://maps.gstatic.com https://www.gstatic.com; " +
+	"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com https://maps.gstatic.com https://www.gstatic.com; " +
+	"img-src 'self' data: blob: " + googleHosts + "%s; " +
+	"font-src 'self' data: https://fonts.gstatic.com; " +
+	"connect-src 'self' " + googleHosts + "; " +
+	"worker-src 'self' blob:; " +
+	"frame-src 'self'; " +
+	"object-src 'none'; " +
+	"base-uri 'self'; " +
+	"form-action 'self'; " +
+	"frame-ancestors 'self'"
+
+// googleHosts serve street view panoramas, tiles and their metadata
+const googleHosts = "https://*.google.com https://*.googleapis.com https://*.gstatic.com https://*.ggpht.com https://*.googleusercontent.com"
+
+// tileHostRegex matches hosts which may be put into a policy as they are
+var tileHostRegex = regexp.MustCompile(`^(\*\.)?[a-zA-Z0-9-]+(\.[a-zA-Z0-9-]+)*(:[0-9]+)?$`)
+
+// urlAttributes are rewritten if their value is a google URL
+var urlAttributes = map[string]bool{
+	"action":     true,
+	"background": true,
+	"cite":       true,
+	"content":    true, // <meta itemprop="image" content="...">
+	"data":       true,
+	"formaction": true,
+	"href":       true,
+	"poster":     true,
+	"src":        true,
+	"srcset":     true,
+}
+
+// googleURLPrefixRegex matches a google URL at the start of a value
+var googleURLPrefixRegex = regexp.MustCompile(`^\s*(` + googleMapsRegex + `|` + googleConsentRegex + `)`)
+
+// scriptURLRegex matches google URLs at the start of string literals in
+// scripts.  URLs elsewhere in scripts (e.g. in query parameters) are data,
+// which the page may rely on.
+var scriptURLRegex = regexp.MustCompile("([\"'`])(" + googleMapsRegex + "|" + googleConsentRegex + ")")
+
+// htmlRewriter rewrites a page so that it is served by us instead of google
+type htmlRewriter struct {
+	// nonce must be unique for every response
+	nonce string
+	// tileHosts the page may load images from, as CSP host sources
+	tileHosts []string
+}
+
+// newHTMLRewriter for pages showing a map with tiles from tileServers, which
+// are URL templates like Config.TileServerURL
+func newHTMLRewriter(tileServers []string) (htmlRewriter, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return htmlRewriter{}, fmt.Errorf("failed to generate CSP nonce: %v", err)
+	}
+	rewriter := htmlRewriter{nonce: base64.StdEncoding.EncodeToString(b)}
+	for _, server := range tileServers {
+		if host, ok := tileHost(server); ok {
+			rewriter.tileHosts = append(rewriter.tileHosts, host)
+		}
+	}
+	return rewriter, nil
+}
+
+// tileHost returns the CSP host source of the tile server template, e.g.
+// "https://*.tile.openstreetmap.org" for
+// "https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png"
+func tileHost(template string) (string, bool) {
+	scheme := "https://"
+	if strings.HasPrefix(template, "http://") {
+		scheme = "http://"
+	} else if !strings.HasPrefix(template, scheme) {
+		return "", false
+	}
+	host := strings.TrimPrefix(template, scheme)
+	if i := strings.IndexAny(host, "/?#"); i >= 0 {
+		host = host[:i]
+	}
+	host = strings.Replace(host, "{s}.", "*.", 1)
+	if !tileHostRegex.MatchString(host) {
+		return "", false
+	}
+	return scheme + host, true
+}
+
+// ContentSecurityPolicy for the pages written by rewriter
+func (rewriter htmlRewriter) ContentSecurityPolicy() string {
+	tileHosts := ""
+	for _, host := range rewriter.tileHosts {
+		tileHosts += " " + host
+	}
+	return fmt.Sprintf(contentSecurityPolicy, rewriter.nonce, tileHosts)
+}
+
+// Rewrite src to dst while reading it, inserting inject at the start of the
+// head element.  If the page has no head element, one is inserted before the
+// body.
+func (rewriter htmlRewriter) Rewrite(dst io.Writer, src io.Reader, inject []byte) error {
+	page := &pageRewriter{htmlRewriter: rewriter, w: bufio.NewWriter(dst), inject: inject}
+	if err := page.copy(src); err != nil {
+		return err
+	}
+	return page.w.Flush()
+}
+
+// pageRewriter is the state of one Rewrite
+type pageRewriter struct {
+	htmlRewriter
+	w *bufio.Writer
+	// inject is nil once it has been written
+	inject []byte
+	// injecting is true while writing inject, whose scripts are ours
+	injecting bool
+}
+
+func (page *pageRewriter) copy(src io.Reader) error {
+	z := html.NewTokenizer(src)
+	inScript := false
+	for {
+		tokenType := z.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return z.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := z.Token()
+			if isMetaCSP(token) {
+				// ours is the only policy, it'd be intersected with this one
+				continue
+			}
+			token = page.rewriteTag(token, page.injecting)
+			inScript = token.Data == "script" && tokenType == html.StartTagToken
+			switch {
+			case page.inject != nil && token.Data == "head":
+				page.w.WriteString(token.String())
+				if err := page.writeInject(); err != nil {
+					return err
+				}
+			case page.inject != nil && token.Data == "body":
+				page.w.WriteString("<head>")
+				if err := page.writeInject(); err != nil {
+					return err
+				}
+				page.w.WriteString("</head>")
+				page.w.WriteString(token.String())
+			default:
+				page.w.WriteString(token.String())
+			}
+		case html.TextToken:
+			if inScript {
+				page.w.WriteString(scriptURLRegex.ReplaceAllString(string(z.Raw()), "$1/"))
+			} else {
+				page.w.Write(z.Raw())
+			}
+		default:
+			inScript = false
+			page.w.Write(z.Raw())
+		}
+	}
+}
+
+func (page *pageRewriter) writeInject() error {
+	inject := page.inject
+	page.inject = nil
+	page.injecting = true
+	defer func() { page.injecting = false }()
+	return page.copy(bytes.NewReader(inject))
+}
+
+// rewriteTag points the URLs in token at us, and puts the nonce on scripts
+// which have one, or on all scripts if ours is true
+func (rewriter htmlRewriter) rewriteTag(token html.Token, ours bool) html.Token {
+	nonced := false
+	for i, attr := range token.Attr {
+		switch {
+		case attr.Key == "nonce" && token.Data == "script":
+			token.Attr[i].Val = rewriter.nonce
+			nonced = true
+		case urlAttributes[attr.Key] && len(attr.Namespace) == 0:
+			token.Attr[i].Val = rewriteURLs(attr.Key, attr.Val)
+		}
+	}
+	if token.Data == "script" && !nonced && ours {
+		token.Attr = append(token.Attr, html.Attribute{Key: "nonce", Val: rewriter.nonce})
+	}
+	return token
+}
+
+// rewriteURLs in the value of attribute key
+func rewriteURLs(key string, value string) string {
+	if key != "srcset" {
+		return googleURLPrefixRegex.ReplaceAllString(value, "/")
+	}
+	// "url 1x, url 2x"
+	candidates := strings.Split(value, ",")
+	for i := range candidates {
+		candidates[i] = googleURLPrefixRegex.ReplaceAllString(candidates[i], "/")
+	}
+	return strings.Join(candidates, ",")
+}
+
+func isMetaCSP(token html.Token) bool {
+	if token.Data != "meta" {
+		return false
+	}
+	for _, attr := range token.Attr {
+		if attr.Key == "http-equiv" && strings.EqualFold(strings.TrimSpace(attr.Val), "content-security-policy") {
+			return true
+		}
+	}
+	return false
+}
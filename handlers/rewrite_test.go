@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRewriteHTML(t *testing.T) {
+	rewriter := htmlRewriter{nonce: "n0nce"}
+	inject := []byte(`<script src="https://maps.google.com/maps/api/js"></script>`)
+	injected := `<script src="/maps/api/js" nonce="n0nce"></script>`
+
+	tests := []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{
+			"head",
+			`<!-- <head> --><html><head lang="en"><title>Maps</title></head><body></body></html>`,
+			`<!-- <head> --><html><head lang="en">` + injected + `<title>Maps</title></head><body></body></html>`,
+		},
+		{
+			"no head",
+			`<html><body><p>hi</p></body></html>`,
+			`<html><head>` + injected + `</head><body><p>hi</p></body></html>`,
+		},
+		{
+			"only the first head",
+			`<head></head><head></head>`,
+			`<head>` + injected + `</head><head></head>`,
+		},
+		{
+			"head in script",
+			`<script>var s = "<head>";</script><head></head>`,
+			`<script>var s = "<head>";</script><head>` + injected + `</head>`,
+		},
+		{
+			"only nonced scripts of the page are ours",
+			`<head></head><script nonce="theirs"></script><script src="https://evil.example/x.js"></script>`,
+			`<head>` + injected + `</head><script nonce="n0nce"></script><script src="https://evil.example/x.js"></script>`,
+		},
+		{
+			"url attributes",
+			`<head></head><a href="https://www.google.com/maps/place" data-url="https://www.google.com/x">https://www.google.com/</a>` +
+				`<img srcset="https://maps.google.com/a.png 1x, https://google.com/b.png 2x"><form action="https://consent.google.com/save">`,
+			`<head>` + injected + `</head><a href="/maps/place" data-url="https://www.google.com/x">https://www.google.com/</a>` +
+				`<img srcset="/a.png 1x,/b.png 2x"><form action="/save">`,
+		},
+		{
+			"urls in scripts",
+			`<head></head><script nonce="theirs">f("https://www.google.com/maps", 'https://maps.google.com/x?next=https://www.google.com/');</script>`,
+			`<head>` + injected + `</head><script nonce="n0nce">f("/maps", '/x?next=https://www.google.com/');</script>`,
+		},
+		{
+			"meta CSP",
+			`<head><meta http-equiv="Content-Security-Policy" content="script-src 'none'"></head>`,
+			`<head>` + injected + `</head>`,
+		},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := rewriter.Rewrite(&out, strings.NewReader(test.input), inject); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if out.String() != test.output {
+			t.Errorf("%s: Expected\n%s\nbut got\n%s", test.name, test.output, out.String())
+		}
+	}
+}
+
+func TestHTMLRewriterNonce(t *testing.T) {
+	a, err := newHTMLRewriter([]string{"https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png", "https://mt.google.com/vt/lyrs=m&x={x}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newHTMLRewriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.nonce) == 0 || a.nonce == b.nonce {
+		t.Error("expected unique nonces, got", a.nonce, b.nonce)
+	}
+	policy := a.ContentSecurityPolicy()
+	if !strings.Contains(policy, "'nonce-"+a.nonce+"'") {
+		t.Error("expected the nonce in the policy, got", policy)
+	}
+	if !strings.Contains(policy, " https://*.tile.openstreetmap.org https://mt.google.com;") {
+		t.Error("expected the tile hosts in the policy, got", policy)
+	}
+	if strings.Contains(policy, "'unsafe-eval'") || strings.Contains(policy, " https:;") || strings.Contains(policy, " https: ") {
+		t.Error("expected no 'unsafe-eval' and no https: in the policy, got", policy)
+	}
+}
+
+func TestTileHost(t *testing.T) {
+	tests := []struct {
+		template string
+		host     string
+		ok       bool
+	}{
+		{"https://{s}.tile.openstreetmap.org/{z}/{x}/{y}.png", "https://*.tile.openstreetmap.org", true},
+		{"http://localhost:8082/{z}/{x}/{y}.png", "http://localhost:8082", true},
+		{"https://mt.google.com/vt?x={x}", "https://mt.google.com", true},
+		{"https://tiles.example.com; script-src *", "", false},
+		{"https://{z}.example.com/", "", false},
+		{"/tiles/{z}/{x}/{y}.png", "", false},
+	}
+	for _, test := range tests {
+		host, ok := tileHost(test.template)
+		if host != test.host || ok != test.ok {
+			t.Errorf("%s: expected %q %v, got %q %v", test.template, test.host, test.ok, host, ok)
+		}
+	}
+}
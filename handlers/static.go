@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// hashedAssetRegex matches file names with a content hash, like
+// main-5d41402abc.js or bundle.5d41402abc.css, which never change
+var hashedAssetRegex = regexp.MustCompile(`[.-][0-9a-fA-F]{8,}\.[a-zA-Z0-9]+$`)
+
+const (
+	immutableCacheControl = "public, max-age=31536000, immutable"
+	// revalidate with the ETag (or Last-Modified) every time
+	revalidateCacheControl = "no-cache"
+)
+
+// Static serves the built frontend (the contents of public) from an fs.FS
+type Static struct {
+	fsys fs.FS
+	// etags by file name, nil if the files may change while we're running
+	etags map[string]string
+}
+
+// NewStatic serves fsys.  If immutable, e.g. for an embed.FS, ETags are
+// computed once now and hashed assets may be cached forever.
+func NewStatic(fsys fs.FS, immutable bool) (*Static, error) {
+	static := &Static{fsys: fsys}
+	if !immutable {
+		return static, nil
+	}
+	static.etags = make(map[string]string)
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		static.etags[name] = `"` + hex.EncodeToString(sum[:16]) + `"`
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash static files: %v", err)
+	}
+	return static, nil
+}
+
+// ReadFile name from the static files
+func (static *Static) ReadFile(name string) ([]byte, error) {
+	return fs.ReadFile(static.fsys, name)
+}
+
+// Exists returns whether there is a file called name
+func (static *Static) Exists(name string) bool {
+	info, err := fs.Stat(static.fsys, name)
+	return err == nil && !info.IsDir()
+}
+
+// ServeHTTP serves the file at the request path, which must be relative to
+// public, e.g. behind http.StripPrefix("/public/", ...)
+func (static *Static) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	static.ServeFile(w, r, r.URL.Path)
+}
+
+// ServeFile name to w
+func (static *Static) ServeFile(w http.ResponseWriter, r *http.Request, name string) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if len(name) == 0 || strings.HasPrefix(path.Base(name), ".") {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := static.fsys.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		// no directory listings
+		http.NotFound(w, r)
+		return
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(f)
+		if err != nil {
+			http.Error(w, "failed to read file", http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+
+	modTime := info.ModTime()
+	if etag, ok := static.etags[name]; ok {
+		w.Header().Set("ETag", etag)
+		// embedded files have no modification time anyway
+		modTime = time.Time{}
+		if hashedAssetRegex.MatchString(name) {
+			w.Header().Set("Cache-Control", immutableCacheControl)
+		} else {
+			w.Header().Set("Cache-Control", revalidateCacheControl)
+		}
+	} else {
+		w.Header().Set("Cache-Control", revalidateCacheControl)
+	}
+	// ServeContent sets Content-Type by extension, and handles If-None-Match,
+	// If-Modified-Since and ranges
+	http.ServeContent(w, r, name, modTime, content)
+}
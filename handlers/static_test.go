@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/fstest"
+)
+
+var testPublic = fstest.MapFS{
+	"index.html":                  {Data: []byte("<html></html>")},
+	"main-5d41402abc4b2a76.js":    {Data: []byte("console.log('hi');")},
+	"bundle.5d41402abc4b2a76.css": {Data: []byte("body {}")},
+	"assets/logo.png":             {Data: []byte("\x89PNG")},
+	".gitkeep":                    {Data: []byte{}},
+}
+
+func TestStatic(t *testing.T) {
+	static, err := NewStatic(testPublic, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path         string
+		status       int
+		contentType  string
+		cacheControl string
+	}{
+		{"/index.html", http.StatusOK, "text/html; charset=utf-8", revalidateCacheControl},
+		{"/main-5d41402abc4b2a76.js", http.StatusOK, "text/javascript; charset=utf-8", immutableCacheControl},
+		{"/bundle.5d41402abc4b2a76.css", http.StatusOK, "text/css; charset=utf-8", immutableCacheControl},
+		{"/assets/logo.png", http.StatusOK, "image/png", revalidateCacheControl},
+		{"/assets/", http.StatusNotFound, "", ""},
+		{"/", http.StatusNotFound, "", ""},
+		{"/.gitkeep", http.StatusNotFound, "", ""},
+		{"/missing.js", http.StatusNotFound, "", ""},
+		{"/../static.go", http.StatusNotFound, "", ""},
+	}
+	for _, test := range tests {
+		rec := get(static, test.path)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.path, test.status, rec.Code)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		if rec.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("%s: expected Content-Type %s, got %s", test.path, test.contentType, rec.Header().Get("Content-Type"))
+		}
+		if rec.Header().Get("Cache-Control") != test.cacheControl {
+			t.Errorf("%s: expected Cache-Control %s, got %s", test.path, test.cacheControl, rec.Header().Get("Cache-Control"))
+		}
+		etag := rec.Header().Get("ETag")
+		if len(etag) == 0 {
+			t.Errorf("%s: expected an ETag", test.path)
+			continue
+		}
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		req.Header.Set("If-None-Match", etag)
+		rec = httptest.NewRecorder()
+		static.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotModified {
+			t.Errorf("%s: expected 304 with matching ETag, got %d", test.path, rec.Code)
+		}
+	}
+}
+
+func TestStaticMutable(t *testing.T) {
+	static, err := NewStatic(testPublic, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := get(static, "/main-5d41402abc4b2a76.js")
+	if rec.Code != http.StatusOK || rec.Body.String() != "console.log('hi');" {
+		t.Fatalf("expected the file, got %d %s", rec.Code, rec.Body.String())
+	}
+	// the file may change, e.g. when rebuilt during development
+	if rec.Header().Get("Cache-Control") != revalidateCacheControl || len(rec.Header().Get("ETag")) > 0 {
+		t.Error("expected files to be revalidated, got", rec.Header())
+	}
+}
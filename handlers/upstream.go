@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/metrics"
+)
+
+// DefaultUpstreamURL is the Google Maps host proxied by Play and Proxy
+const DefaultUpstreamURL = "https://www.google.com"
+
+// Upstream is the server which Play and Proxy fetch Google Maps from.
+// The zero value fetches from DefaultUpstreamURL using http.DefaultClient.
+type Upstream struct {
+	// BaseURL is scheme and host, e.g. "https://www.google.com"
+	BaseURL string
+	Client  *http.Client
+	// Duration (until the response headers) by kind of request ("page",
+	// "photometa" or "other") and Errors by kind and reason ("timeout",
+	// "unavailable" or "status" for 5xx responses).  Both may be nil.
+	Duration *metrics.Histogram
+	Errors   *metrics.Counter
+	// MaxBodyBytes of responses read by Proxy and Play, both as sent and
+	// decoded, 0 for no limit
+	MaxBodyBytes int64
+}
+
+// errBodyTooLarge is returned by readBody for bodies above MaxBodyBytes
+var errBodyTooLarge = errors.New("upstream response body too large")
+
+// NewUpstream for baseURL, giving up on requests which take longer than timeout
+func NewUpstream(baseURL string, timeout time.Duration) (Upstream, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return Upstream{}, fmt.Errorf("failed to parse upstream URL: %v", err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+		return Upstream{}, fmt.Errorf("upstream URL '%s' must be http(s)://host", baseURL)
+	}
+	return Upstream{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (upstream Upstream) client() *http.Client {
+	if upstream.Client == nil {
+		return http.DefaultClient
+	}
+	return upstream.Client
+}
+
+// do req, which is of the given kind, recording metrics
+func (upstream Upstream) do(req *http.Request, kind string) (*http.Response, error) {
+	start := time.Now()
+	res, err := upstream.client().Do(req)
+	upstream.Duration.Observe(time.Since(start).Seconds(), kind)
+	switch {
+	case errors.Is(req.Context().Err(), context.Canceled):
+		// the client has gone away, that's not upstream's fault
+	case err != nil && isTimeout(err):
+		upstream.Errors.Inc(kind, "timeout")
+	case err != nil:
+		upstream.Errors.Inc(kind, "unavailable")
+	case res.StatusCode >= 500:
+		upstream.Errors.Inc(kind, "status")
+	}
+	return res, err
+}
+
+// readBody of res, failing with errBodyTooLarge if it's above MaxBodyBytes
+func (upstream Upstream) readBody(res *http.Response) ([]byte, error) {
+	return ioutil.ReadAll(limitBody(res.Body, upstream.MaxBodyBytes))
+}
+
+// limitBody to maxBytes, reading any more fails with errBodyTooLarge.  0 is
+// no limit.
+func limitBody(body io.Reader, maxBytes int64) io.Reader {
+	if maxBytes <= 0 {
+		return body
+	}
+	return &limitedBody{reader: body, left: maxBytes}
+}
+
+type limitedBody struct {
+	reader io.Reader
+	left   int64
+}
+
+func (body *limitedBody) Read(p []byte) (int, error) {
+	// one byte more than is left tells whether there is more
+	if int64(len(p)) > body.left+1 {
+		p = p[:body.left+1]
+	}
+	n, err := body.reader.Read(p)
+	body.left -= int64(n)
+	if body.left < 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// Ping upstream, failing if it can't be reached or responds with a server
+// error
+func (upstream Upstream) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, upstream.url("/maps"), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create upstream request: %v", err)
+	}
+	res, err := upstream.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("upstream unreachable: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode >= 500 {
+		return fmt.Errorf("upstream responded %s", res.Status)
+	}
+	return nil
+}
+
+func (upstream Upstream) baseURL() string {
+	if len(upstream.BaseURL) == 0 {
+		return DefaultUpstreamURL
+	}
+	return upstream.BaseURL
+}
+
+// url of requestURI (path and query) on upstream
+func (upstream Upstream) url(requestURI string) string {
+	return upstream.baseURL() + requestURI
+}
@@ -0,0 +1,131 @@
+// Package limits protects the server against clients which send too many or
+// too large requests, e.g. to spam maps.
+package limits
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/apierror"
+	"gitlab.com/glatteis/earthwalker/clientip"
+	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/logging"
+	"gitlab.com/glatteis/earthwalker/metrics"
+)
+
+// sweepInterval is how often buckets which have filled up again are removed
+const sweepInterval = time.Minute
+
+// Limiter limits requests per client IP with a token bucket for every client.
+// The zero Limiter (with a Limit) is ready to use, and must not be copied.
+type Limiter struct {
+	// Route the Limiter protects, for logs and metrics
+	Route    string
+	ClientIP clientip.Resolver
+	// Limit returns the current RateLimit, which may be reloaded
+	Limit func() domain.RateLimit
+	// Rejected counts requests rejected by route, may be nil
+	Rejected *metrics.Counter
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// bucket of a client, holding tokens at updated
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill b as of now, returning its tokens
+func (b *bucket) refill(limit domain.RateLimit, now time.Time) float64 {
+	perSecond := float64(limit.Requests) / limit.Period.Seconds()
+	b.tokens = math.Min(float64(limit.Requests), b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+	return b.tokens
+}
+
+// Allow a request by client, or return how long until it would be allowed
+func (limiter *Limiter) Allow(client string) (ok bool, retryAfter time.Duration) {
+	limit := limiter.Limit()
+	if limit.Requests == 0 {
+		return true, 0
+	}
+	now := time.Now()
+	if limiter.now != nil {
+		now = limiter.now()
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.buckets == nil {
+		limiter.buckets = make(map[string]*bucket)
+	}
+	if now.Sub(limiter.lastSweep) > sweepInterval {
+		// full buckets are the same as new ones
+		for key, b := range limiter.buckets {
+			if b.refill(limit, now) >= float64(limit.Requests) {
+				delete(limiter.buckets, key)
+			}
+		}
+		limiter.lastSweep = now
+	}
+	b, found := limiter.buckets[client]
+	if !found {
+		b = &bucket{tokens: float64(limit.Requests), updated: now}
+		limiter.buckets[client] = b
+	}
+	if b.refill(limit, now) >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	perSecond := float64(limit.Requests) / limit.Period.Seconds()
+	return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+}
+
+// Protect next so that requests with method are only passed on while their
+// client is within the Limit.  Others get 429 Too Many Requests with a
+// Retry-After header.  Requests with other methods are always passed on.
+func (limiter *Limiter) Protect(method string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, retryAfter := limiter.Allow(limiter.ClientIP.Resolve(r).String())
+		if ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		seconds := int(math.Ceil(retryAfter.Seconds()))
+		limiter.Rejected.Inc(limiter.Route)
+		logging.FromContext(r.Context()).Warn("Rate limited request", "route", limiter.Route, "retry_after_seconds", seconds)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		apierror.Send(w, fmt.Sprintf("too many requests, try again in %s.", time.Duration(seconds)*time.Second), http.StatusTooManyRequests)
+	})
+}
+
+// Body limits the size of request bodies to next to maxKB() kilobytes, unless
+// it's 0.  Reading a larger body fails with an *http.MaxBytesError, requests
+// which announce a larger Content-Length fail right away with 413 Request
+// Entity Too Large.
+func Body(maxKB func() int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		maxBytes := int64(maxKB()) << 10
+		if maxBytes > 0 {
+			if r.ContentLength > maxBytes {
+				apierror.Send(w, fmt.Sprintf("request body is larger than %d KB.", maxKB()), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
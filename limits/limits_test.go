@@ -0,0 +1,126 @@
+package limits
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/logging"
+)
+
+func TestAllow(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	limit := domain.RateLimit{Requests: 2, Period: time.Minute}
+	limiter := &Limiter{
+		Limit: func() domain.RateLimit { return limit },
+		now:   func() time.Time { return now },
+	}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("request %d within the burst was rejected", i)
+		}
+	}
+	ok, retryAfter := limiter.Allow("a")
+	if ok || retryAfter != 30*time.Second {
+		t.Errorf("expected the third request to be rejected for 30s, got %v, %s", ok, retryAfter)
+	}
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Error("another client was rejected")
+	}
+	now = now.Add(30 * time.Second)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Error("expected a token to be refilled after 30s")
+	}
+	if ok, _ := limiter.Allow("a"); ok {
+		t.Error("expected only one token to be refilled after 30s")
+	}
+
+	// full buckets are swept
+	now = now.Add(time.Hour)
+	limiter.Allow("c")
+	if len(limiter.buckets) != 1 {
+		t.Errorf("expected only the bucket of c to be left, got %d buckets", len(limiter.buckets))
+	}
+
+	limit = domain.RateLimit{}
+	for i := 0; i < 10; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatal("the zero RateLimit rejected a request")
+		}
+	}
+}
+
+func TestProtect(t *testing.T) {
+	limiter := &Limiter{
+		Route: "maps",
+		Limit: func() domain.RateLimit { return domain.RateLimit{Requests: 1, Period: time.Hour} },
+	}
+	handler := limiter.Protect(http.MethodPost, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(method string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		recorder.Header().Set(logging.RequestIDHeader, "abc")
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, "/api/maps", nil))
+		return recorder
+	}
+
+	if rec := do(http.MethodPost); rec.Code != http.StatusOK {
+		t.Errorf("first request: got status %d", rec.Code)
+	}
+	rec := do(http.MethodPost)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "3600" {
+		t.Errorf("second request: got status %d, Retry-After %s", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if expected := `{"error":"too many requests, try again in 1h0m0s.","request_id":"abc"}` + "\n"; rec.Body.String() != expected {
+		t.Errorf("second request: expected %s, got %s", expected, rec.Body.String())
+	}
+	if rec := do(http.MethodGet); rec.Code != http.StatusOK {
+		t.Errorf("GET request: got status %d", rec.Code)
+	}
+}
+
+func TestBody(t *testing.T) {
+	handler := Body(func() int { return 1 }, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var tooLarge *http.MaxBytesError
+		if _, err := io.ReadAll(r.Body); errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	}))
+	tests := []struct {
+		body          io.Reader
+		contentLength int64
+		expected      int
+		// of the error sent by Body itself
+		error string
+	}{
+		{strings.NewReader("{}"), 2, http.StatusOK, ""},
+		{strings.NewReader(strings.Repeat("a", 1024)), 1024, http.StatusOK, ""},
+		{strings.NewReader(strings.Repeat("a", 2048)), 2048, http.StatusRequestEntityTooLarge, `{"error":"request body is larger than 1 KB."}` + "\n"},
+		// chunked, so it's up to next to fail when reading
+		{strings.NewReader(strings.Repeat("a", 2048)), -1, http.StatusRequestEntityTooLarge, ""},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/maps", test.body)
+		req.ContentLength = test.contentLength
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		if recorder.Code != test.expected {
+			t.Errorf("request %d: got status %d, expected %d", i, recorder.Code, test.expected)
+		}
+		if recorder.Body.String() != test.error {
+			t.Errorf("request %d: expected body %q, got %q", i, test.error, recorder.Body.String())
+		}
+	}
+
+	unlimited := Body(func() int { return 0 }, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, err := io.ReadAll(r.Body); err != nil || len(body) != 1<<20 {
+			t.Errorf("expected the whole body without a limit, got %d bytes and %v", len(body), err)
+		}
+	}))
+	unlimited.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/maps", strings.NewReader(strings.Repeat("a", 1<<20))))
+}
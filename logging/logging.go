@@ -0,0 +1,129 @@
+// Package logging sets up structured logging with log/slog.  Every request
+// gets an ID, which is logged with everything logged about the request and
+// returned to the client, so that errors reported by players can be found in
+// the logs.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/clientip"
+	"gitlab.com/glatteis/earthwalker/metrics"
+)
+
+// RequestIDHeader is set on every response.  If a request has one already
+// (e.g. from a reverse proxy), that ID is used.
+const RequestIDHeader = "X-Request-Id"
+
+// Redacted replaces the values of sensitive attributes
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys whose values are never logged, like
+// answer locations or credentials
+var sensitiveKeys = map[string]bool{
+	"authorization": true,
+	"cookie":        true,
+	"lat":           true,
+	"lng":           true,
+	"location":      true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+}
+
+// requestIDRegex matches request IDs we accept from clients, anything else
+// could be used to forge log lines
+var requestIDRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// New logger writing to w at level ("debug", "info", "warn" or "error") in
+// format ("json" or "text")
+func New(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level '%s', expected debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: minLevel, ReplaceAttr: redact}
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format '%s', expected json or text", format)
+}
+
+func redact(groups []string, attr slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(attr.Key)] {
+		attr.Value = slog.StringValue(Redacted)
+	}
+	return attr
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// FromContext returns the logger of the request with context ctx, which
+// logs its ID, or slog.Default() outside of requests
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// RequestID of the request with context ctx, empty outside of requests
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Middleware assigns every request an ID and a logger logging it, and logs
+// every request once it's done
+func Middleware(logger *slog.Logger, clientIPs clientip.Resolver, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDRegex.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		requestLogger := logger.With("request_id", id)
+		ctx := context.WithValue(r.Context(), loggerKey, requestLogger)
+		ctx = context.WithValue(ctx, requestIDKey, id)
+
+		recorder := &metrics.StatusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.Status == 0 {
+			recorder.Status = http.StatusOK
+		}
+		requestLogger.LogAttrs(ctx, slog.LevelInfo, "request",
+			slog.String("client_ip", clientIPs.Resolve(r).String()),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", recorder.Status),
+			slog.Duration("duration", time.Since(start)),
+		)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// IDs only need to be unique enough to find requests in the logs
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
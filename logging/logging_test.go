@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.com/glatteis/earthwalker/clientip"
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+func TestNew(t *testing.T) {
+	var buffer bytes.Buffer
+	for _, valid := range [][2]string{{"debug", "json"}, {"INFO", "text"}, {"warn", "JSON"}, {"error", "text"}} {
+		if _, err := New(&buffer, valid[0], valid[1]); err != nil {
+			t.Errorf("expected level %s and format %s to be valid: %v", valid[0], valid[1], err)
+		}
+	}
+	for _, invalid := range [][2]string{{"verbose", "json"}, {"info", "xml"}, {"", "json"}} {
+		if _, err := New(&buffer, invalid[0], invalid[1]); err == nil {
+			t.Errorf("expected level '%s' and format '%s' to be rejected", invalid[0], invalid[1])
+		}
+	}
+
+	logger, err := New(&buffer, "warn", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("too verbose")
+	if buffer.Len() > 0 {
+		t.Error("expected info not to be logged at level warn, got", buffer.String())
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, err := New(&buffer, "info", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := domain.Coords{Lat: 48.137154, Lng: 11.576124}
+	logger.Info("guess",
+		"guess", answer,
+		"location", "48.137154,11.576124",
+		"Authorization", "Bearer ew_secret",
+		"config", domain.Config{Port: "8080", AllowedIPs: []string{"10.9.8.0/24"}},
+	)
+	line := buffer.String()
+	for _, secret := range []string{"48.137", "11.576", "ew_secret", "10.9.8"} {
+		if strings.Contains(line, secret) {
+			t.Errorf("expected '%s' to be redacted from %s", secret, line)
+		}
+	}
+	if !strings.Contains(line, `"Port":"8080"`) {
+		t.Error("expected the rest of the config to be logged, got", line)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, err := New(&buffer, "info", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := Middleware(logger, clientip.Resolver{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).Error("Failed to do something")
+		http.Error(w, "oops", http.StatusTeapot)
+	}))
+
+	serve := func(requestID string) (string, []map[string]interface{}) {
+		buffer.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/api/maps", nil)
+		if len(requestID) > 0 {
+			req.Header.Set(RequestIDHeader, requestID)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		var lines []map[string]interface{}
+		decoder := json.NewDecoder(&buffer)
+		for decoder.More() {
+			var line map[string]interface{}
+			if err := decoder.Decode(&line); err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, line)
+		}
+		return rec.Header().Get(RequestIDHeader), lines
+	}
+
+	id, lines := serve("")
+	if len(id) == 0 {
+		t.Fatal("expected a request ID to be assigned")
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected the error and the request to be logged, got %v", lines)
+	}
+	for _, line := range lines {
+		if line["request_id"] != id {
+			t.Errorf("expected request_id %s, got %v", id, line)
+		}
+	}
+	if access := lines[1]; access["status"] != float64(http.StatusTeapot) || access["path"] != "/api/maps" {
+		t.Error("unexpected request log", access)
+	}
+
+	if id, _ := serve("from-proxy.1"); id != "from-proxy.1" {
+		t.Error("expected the request ID of the proxy to be kept, got", id)
+	}
+	if id, _ := serve("forged\nlog line"); id == "forged\nlog line" || len(id) == 0 {
+		t.Error("expected an invalid request ID to be replaced, got", id)
+	}
+}
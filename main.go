@@ -17,135 +17,472 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"log"
-	"math/rand"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
+	"sync"
 	"syscall"
 	"time"
 	"encoding/json"
 
+	"gitlab.com/glatteis/earthwalker/auth"
+	"gitlab.com/glatteis/earthwalker/clientip"
 	"gitlab.com/glatteis/earthwalker/handlers"
 
 	"gitlab.com/glatteis/earthwalker/badgerdb"
 	"gitlab.com/glatteis/earthwalker/config"
+	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/geocode"
 	"gitlab.com/glatteis/earthwalker/handlers/api"
+	"gitlab.com/glatteis/earthwalker/limits"
+	"gitlab.com/glatteis/earthwalker/logging"
+	"gitlab.com/glatteis/earthwalker/metrics"
+	"gitlab.com/glatteis/earthwalker/tlscert"
 )
 
+// version of earthwalker, set with -ldflags "-X main.version=v1.2.3".  If it's
+// empty, the module version is used.
+var version string
+
+// certCheckInterval is how often the TLS certificate files are checked for
+// changes
+const certCheckInterval = 30 * time.Second
+
+// configCheckInterval is how often the config file is checked for changes
+const configCheckInterval = 10 * time.Second
+
 func main() {
-	// TODO: can we get rid of this?
-	rand.Seed(time.Now().UnixNano())
+	os.Exit(run(os.Args[1:]))
+}
 
+// serve earthwalker, configured by the flags in args, until SIGINT or SIGTERM
+func serve(args []string) int {
 	// == CONFIG ========
-	conf, err := config.Read()
-	if err != nil {
+	conf, _, err := config.Read(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	} else if err != nil {
 		log.Fatalf("Failed to read config: %v\n", err)
 	}
+	if err := config.Validate(conf); err != nil {
+		log.Fatalf("Invalid config:\n%v\n", err)
+	}
+	// handlers get the current config from provider, which is updated when
+	// the config is reloaded
+	provider := config.NewProvider(conf)
+
+	// == LOGGING ========
+	logger, err := logging.New(os.Stderr, conf.LogLevel, conf.LogFormat)
+	if err != nil {
+		log.Fatalf("Invalid logging config: %v\n", err)
+	}
+	// the log package logs via logger from now on
+	slog.SetDefault(logger)
+
+	// == STATIC FILES ========
+	// fail now rather than for every player
+	static, err := staticFiles(conf)
+	if err != nil {
+		log.Fatalf("Failed to load the frontend: %v\n", err)
+	}
+	modifyHTML, err := handlers.LoadModifyHTML(static)
+	if err != nil {
+		log.Fatalf("Failed to load the Street View modifications: %v\n", err)
+	}
 
-	// get port from flag
-	// TODO: can we get rid of this?
-	port := conf.Port
-	if port == "" {
-		portFlag := flag.Int("port", 8080, "the port the server is running on")
-		flag.Parse()
-		port = strconv.Itoa(*portFlag)
+	// == CLIENT IPS ========
+	var clientIPs clientip.Resolver
+	if conf.IsBehindProxy {
+		clientIPs.TrustedProxies, err = clientip.ParseNets(conf.TrustedProxies)
+		if err != nil {
+			log.Fatalf("Invalid TrustedProxies: %v\n", err)
+		}
+	}
+
+	// == GEOCODING ========
+	// optional, places just won't be annotated without the dataset
+	var geocoder domain.Geocoder
+	offlineGeocoder, err := geocode.Load(conf.GeoDataPath)
+	if err != nil {
+		log.Printf("Reverse geocoding disabled: %v\n", err)
+	} else {
+		geocoder = offlineGeocoder
+	}
+
+	// == PROXY CACHE ========
+	proxyCache, err := handlers.NewCache(conf.ProxyCachePath,
+		int64(conf.ProxyCacheMemoryMB)<<20, int64(conf.ProxyCacheDiskMB)<<20, time.Duration(conf.ProxyCacheTTL))
+	if err != nil {
+		log.Fatalf("Failed to open proxy cache at %s: %v\n", conf.ProxyCachePath, err)
+	}
+
+	// == UPSTREAM ========
+	upstream, err := handlers.NewUpstream(conf.UpstreamURL, time.Duration(conf.UpstreamTimeout))
+	if err != nil {
+		log.Fatalf("Invalid UpstreamURL: %v\n", err)
+	}
+	upstream.MaxBodyBytes = int64(conf.UpstreamMaxBodyMB) << 20
+
+	// == SERVER ========
+	readHeaderTimeout := time.Duration(conf.ReadHeaderTimeout)
+	readTimeout := time.Duration(conf.ReadTimeout)
+	writeTimeout := time.Duration(conf.WriteTimeout)
+	idleTimeout := time.Duration(conf.IdleTimeout)
+	shutdownTimeout := time.Duration(conf.ShutdownTimeout)
+	dbGCInterval := time.Duration(conf.DBGCInterval)
+
+	// == TLS ========
+	var tlsConfig *tls.Config
+	var certs *tlscert.Reloader
+	if len(conf.TLSCertPath) > 0 {
+		certs, err = tlscert.NewReloader(conf.TLSCertPath, conf.TLSKeyPath)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v\n", err)
+		}
+		var adminCAs *x509.CertPool
+		if len(conf.AdminClientCAPath) > 0 {
+			adminCAs, err = tlscert.LoadCertPool(conf.AdminClientCAPath)
+			if err != nil {
+				log.Fatalf("Invalid AdminClientCAPath: %v\n", err)
+			}
+		}
+		tlsConfig = tlscert.ServerConfig(certs, adminCAs)
 	}
 
 	// == DATABASE ========
+	// opened last, as log.Fatal above wouldn't close it
 	db, err := badgerdb.Init(conf.DBPath)
 	if err != nil {
 		log.Fatalf("Failed to open db at %s: %v\n", conf.DBPath, err)
 	}
-
-	// Either defer cleanup for when the program exits...
-	defer badgerdb.Close(db)
-	// Or listen for SIGTERM and also clean up.
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		badgerdb.Close(db)
-		os.Exit(0)
-	}()
-
 	indexStore := &badgerdb.IndexStore{DB: db}
 	mapStore := badgerdb.MapStore{DB: db, Index: indexStore}
 	challengeStore := badgerdb.ChallengeStore{DB: db, Index: indexStore}
 	challengeResultStore := badgerdb.ChallengeResultStore{DB: db, Index: indexStore}
+	userStore := badgerdb.UserStore{DB: db, Index: indexStore}
+	tokenStore := badgerdb.APITokenStore{DB: db, Index: indexStore}
+	sessions := auth.Sessions{Store: badgerdb.SessionStore{DB: db}, ClientIP: clientIPs}
+
+	policy := auth.Policy{
+		Config:     provider,
+		Sessions:   sessions,
+		UserStore:  userStore,
+		TokenStore: tokenStore,
+		ClientIP:   clientIPs,
+	}
+	if err := challengeResultStore.IndexNicknames(); err != nil {
+		log.Printf("Failed to index results by nickname, stats may be incomplete: %v\n", err)
+	}
+
+	// == BACKGROUND WORKERS ========
+	// stopped by cancelling workers, and waited for before closing the db
+	workers, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	var running sync.WaitGroup
+	if dbGCInterval > 0 {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			badgerdb.RunGC(workers, db, dbGCInterval)
+		}()
+	}
+	reloadConfig := make(chan os.Signal, 1)
+	signal.Notify(reloadConfig, syscall.SIGHUP)
+	running.Add(1)
+	go func() {
+		defer running.Done()
+		config.Watch(workers, provider, args, configCheckInterval, reloadConfig)
+	}()
+	if certs != nil {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			certs.Watch(workers, certCheckInterval, reload)
+		}()
+	}
+
+	// == METRICS ========
+	registry := metrics.NewRegistry()
+	upstream.Duration = registry.Histogram("earthwalker_upstream_request_duration_seconds",
+		"Time until the headers of responses from the Google Maps upstream, by kind of request.",
+		metrics.DefaultBuckets, "kind")
+	upstream.Errors = registry.Counter("earthwalker_upstream_errors_total",
+		"Failed requests to the Google Maps upstream, by kind of request and reason.", "kind", "reason")
+	apiRequests := registry.Counter("earthwalker_api_requests_total",
+		"Requests to /api, by route, method and status code.", "route", "method", "code")
+	apiDuration := registry.Histogram("earthwalker_api_request_duration_seconds",
+		"Time taken to respond to requests to /api, by route and method.",
+		metrics.DefaultBuckets, "route", "method")
+	guessesSubmitted := registry.Counter("earthwalker_guesses_total",
+		"Guesses submitted, rate(earthwalker_guesses_total[5m]) * 60 is guesses per minute.")
+	dbSize := registry.Gauge("earthwalker_db_size_bytes", "Size of the database on disk, by part.", "part")
+	dbKeys := registry.Gauge("earthwalker_db_keys", "Number of keys in the database, by prefix.", "prefix")
+	mapCount := registry.Gauge("earthwalker_maps", "Number of maps.")
+	challengeCount := registry.Gauge("earthwalker_challenges", "Number of challenges.")
+	resultCount := registry.Gauge("earthwalker_challenge_results", "Number of challenge results.")
+	rateLimited := registry.Counter("earthwalker_rate_limited_requests_total",
+		"Requests rejected by rate limits, by route.", "route")
+	cacheHits := registry.Counter("earthwalker_proxy_cache_hits_total", "Requests answered by the proxy cache.")
+	cacheMisses := registry.Counter("earthwalker_proxy_cache_misses_total", "Requests the proxy cache couldn't answer.")
+	cacheEvictions := registry.Counter("earthwalker_proxy_cache_evictions_total", "Entries evicted from the proxy cache.")
+	cacheSize := registry.Gauge("earthwalker_proxy_cache_size_bytes", "Size of the proxy cache, by tier.", "tier")
+	cacheEntries := registry.Gauge("earthwalker_proxy_cache_entries", "Number of entries in the proxy cache, by tier.", "tier")
+	registry.OnScrape(func() {
+		stats := proxyCache.Stats()
+		cacheHits.Set(float64(stats.Hits))
+		cacheMisses.Set(float64(stats.Misses))
+		cacheEvictions.Set(float64(stats.Evictions))
+		cacheSize.Set(float64(stats.MemoryBytes), "memory")
+		cacheSize.Set(float64(stats.DiskBytes), "disk")
+		cacheEntries.Set(float64(stats.MemoryEntries), "memory")
+		cacheEntries.Set(float64(stats.DiskEntries), "disk")
+	})
+	registry.OnScrape(func() {
+		stats, err := badgerdb.ReadStats(db)
+		if err != nil {
+			log.Printf("Failed to read db stats for metrics: %v\n", err)
+			return
+		}
+		dbSize.Set(float64(stats.LSMSize), "lsm")
+		dbSize.Set(float64(stats.ValueLogSize), "vlog")
+		dbKeys.Reset()
+		for prefix, count := range stats.Keys {
+			dbKeys.Set(float64(count), prefix)
+		}
+		mapCount.Set(float64(stats.Maps))
+		challengeCount.Set(float64(stats.Challenges))
+		resultCount.Set(float64(stats.ChallengeResults))
+	})
 
 	// == HANDLERS ========
+	readyz := handlers.Readyz{Checks: map[string]handlers.Check{
+		"db": func(ctx context.Context) error {
+			return badgerdb.Ping(db)
+		},
+		"static": handlers.StaticCheck(static),
+	}}
+	if conf.ReadinessCheckUpstream {
+		readyz.Checks["upstream"] = upstream.Ping
+	}
+	adminHandler := policy.Require(auth.ActionAdmin, api.Admin{
+		UserStore: userStore,
+	})
+	if len(conf.AdminClientCAPath) > 0 {
+		adminHandler = auth.RequireClientCert(adminHandler)
+	}
+	// rate limits per client, which are read for every request, so they
+	// can be reloaded
+	rateLimit := func(route string, limit func(conf domain.Config) domain.RateLimit) *limits.Limiter {
+		return &limits.Limiter{
+			Route:    route,
+			ClientIP: clientIPs,
+			Limit: func() domain.RateLimit {
+				return limit(provider.Get())
+			},
+			Rejected: rateLimited,
+		}
+	}
+	mapLimiter := rateLimit("maps", func(conf domain.Config) domain.RateLimit { return conf.MapCreationRateLimit })
+	challengeLimiter := rateLimit("challenges", func(conf domain.Config) domain.RateLimit { return conf.ChallengeCreationRateLimit })
+	resultLimiter := rateLimit("results", func(conf domain.Config) domain.RateLimit { return conf.ResultCreationRateLimit })
+	guessLimiter := rateLimit("guesses", func(conf domain.Config) domain.RateLimit { return conf.GuessRateLimit })
+	maxRequestBodyKB := func() int {
+		return provider.Get().MaxRequestBodyKB
+	}
+	statsHandler := api.Stats{
+		MapStore:             mapStore,
+		ChallengeStore:       challengeStore,
+		ChallengeResultStore: challengeResultStore,
+		Sessions:             sessions,
+	}
 	// API
-	http.Handle("/api/", http.StripPrefix("/api/", api.Root{
-		Config:               conf,
+	http.Handle("/api/", http.StripPrefix("/api/", limits.Body(maxRequestBodyKB, api.Root{
 		MapStore:             mapStore,
 		ChallengeStore:       challengeStore,
 		ChallengeResultStore: challengeResultStore,
 
 		ConfigHandler: api.Config{
-			Config: conf,
+			Config: provider,
 		},
-		MapsHandler: api.Maps{
+		// unauthorized requests don't use up the rate limits
+		MapsHandler: policy.Protect(auth.Rules{
+			http.MethodPost:   auth.ActionCreateMap,
+			http.MethodDelete: auth.ActionDeleteMap,
+		}, mapLimiter.Protect(http.MethodPost, api.Maps{
 			MapStore:             mapStore,
 			ChallengeStore:       challengeStore,
 			ChallengeResultStore: challengeResultStore,
+			Config:               provider,
 			MapDeleteHandler: api.MapDelete{
-				Config:               conf,
 				MapStore:             mapStore,
 				ChallengeStore:       challengeStore,
 				ChallengeResultStore: challengeResultStore,
 			},
-		},
-		ChallengesHandler: api.Challenges{
-			ChallengeStore: challengeStore,
-		},
-		ResultsHandler: api.Results{
+		})),
+		ChallengesHandler: policy.Protect(auth.Rules{
+			http.MethodPost: auth.ActionCreateChallenge,
+		}, challengeLimiter.Protect(http.MethodPost, api.Challenges{
+			MapStore:             mapStore,
+			ChallengeStore:       challengeStore,
 			ChallengeResultStore: challengeResultStore,
-		},
-		GuessesHandler: api.Guesses{
+			Sessions:             sessions,
+			Geocoder:             geocoder,
+			Config:               provider,
+		})),
+		ResultsHandler: resultLimiter.Protect(http.MethodPost, api.Results{
+			ChallengeStore:       challengeStore,
 			ChallengeResultStore: challengeResultStore,
+			Sessions:             sessions,
+			Config:               provider,
+		}),
+		GuessesHandler: guessLimiter.Protect(http.MethodPost, api.Guesses{
+			ChallengeStore:       challengeStore,
+			ChallengeResultStore: challengeResultStore,
+			Sessions:             sessions,
+			Submitted:            guessesSubmitted,
+		}),
+		StatsHandler: statsHandler,
+		UsersHandler: api.Users{
+			UserStore:    userStore,
+			Sessions:     sessions,
+			Config:       provider,
+			StatsHandler: statsHandler,
+		},
+		SessionsHandler: api.Sessions{
+			UserStore: userStore,
+			Sessions:  sessions,
 		},
-	}))
+		TokensHandler: api.Tokens{
+			TokenStore: tokenStore,
+			Policy:     policy,
+		},
+		AdminHandler: adminHandler,
+		Requests:     apiRequests,
+		Duration:     apiDuration,
+	})))
+	http.Handle("/metrics", policy.Require(auth.ActionViewMetrics, registry))
 	// Public static files
-	http.Handle("/public/", http.StripPrefix("/public/", http.FileServer(http.Dir(conf.StaticPath+"/public"))))
+	http.Handle("/public/", http.StripPrefix("/public/", static))
 	// SV sorcery
 	http.Handle("/play/", handlers.Play{
 		ChallengeStore:       challengeStore,
 		ChallengeResultStore: challengeResultStore,
-		Config:               conf,
+		Sessions:             sessions,
+		ModifyHTML:           modifyHTML,
+		Upstream:             upstream,
+		Cache:                proxyCache,
+		TileServers: func() []string {
+			conf := provider.Get()
+			return []string{conf.TileServerURL, conf.NoLabelTileServerURL}
+		},
 	})
-	http.HandleFunc("/maps/", handlers.ServeGoogle)
+	http.Handle("/maps/", handlers.Proxy{Upstream: upstream, Cache: proxyCache})
 
 	http.HandleFunc("/api/my-ip", func(w http.ResponseWriter, r *http.Request) {
-		userIP := r.Header.Get("X-Forwarded-For")
-		if userIP == "" {
-			userIP = r.RemoteAddr
-		}
-		
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(`{"ip": "` + userIP + `"}`))
-	})
-
-	http.HandleFunc("/api/allowed-ips", func(w http.ResponseWriter, r *http.Request) {
-		// Assuming conf is your configuration that holds AllowedIPs
-		allowedIps := conf.AllowedIPs
-	
+		userIP := clientIPs.Resolve(r)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(allowedIps)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ip":      userIP.String(),
+			"allowed": provider.AllowedIPs().Contains(userIP),
+		})
 	})
 
 	// Otherwise, just serve index.html and let the frontend deal with the consequences
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, conf.StaticPath+"/public/index.html")
+		static.ServeFile(w, r, "index.html")
 	})
 	
 	// == ENGAGE ========
-	log.Println("earthwalker is running on ", port)
-	log.Println(conf)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
-	log.Println(conf)
+	// probes come every few seconds, they'd drown out everything else in
+	// the logs
+	inFlight := &handlers.InFlight{}
+	probes := http.NewServeMux()
+	probes.HandleFunc("/healthz", handlers.Healthz)
+	probes.Handle("/readyz", readyz)
+	probes.Handle("/version", handlers.ReadVersion(version, badgerdb.SchemaVersion))
+	probes.Handle("/", logging.Middleware(logger, clientIPs, handlers.Recover(http.DefaultServeMux)))
+	server := &http.Server{
+		Addr:              ":" + conf.Port,
+		Handler:           inFlight.Track(probes),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	servers := []*http.Server{server}
+	served := make(chan error, 2)
+	if tlsConfig == nil {
+		go func() {
+			served <- server.ListenAndServe()
+		}()
+	} else {
+		server.TLSConfig = tlsConfig
+		go func() {
+			served <- server.ListenAndServeTLS("", "")
+		}()
+		if len(conf.HTTPRedirectPort) > 0 {
+			redirect := &http.Server{
+				Addr:              ":" + conf.HTTPRedirectPort,
+				Handler:           handlers.RedirectHTTPS(conf.Port),
+				ReadHeaderTimeout: readHeaderTimeout,
+				ReadTimeout:       readTimeout,
+				WriteTimeout:      writeTimeout,
+				IdleTimeout:       idleTimeout,
+			}
+			servers = append(servers, redirect)
+			go func() {
+				served <- redirect.ListenAndServe()
+			}()
+		}
+	}
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	logger.Info("earthwalker is running", "port", conf.Port, "https", tlsConfig != nil)
+	logger.Info("Configuration", "config", conf)
+
+	failed := false
+	select {
+	case err := <-served:
+		// only returns before Shutdown if we couldn't listen
+		log.Printf("Failed to serve: %v\n", err)
+		failed = true
+	case <-signals.Done():
+		// a second signal kills us right away
+		stopSignals()
+		log.Printf("Shutting down, waiting up to %s for requests in flight\n", shutdownTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Failed to finish all requests in time: %v\n", err)
+			server.Close()
+			failed = true
+		}
+	}
+	cancel()
+	// Close doesn't wait for handlers, but they may still be using the db
+	if n := inFlight.Count(); n > 0 {
+		log.Printf("Waiting for %d requests to finish\n", n)
+	}
+	inFlight.Wait()
+
+	// nothing uses the db anymore once the handlers and workers are done
+	stopWorkers()
+	running.Wait()
+	badgerdb.Close(db)
+	if failed {
+		return 1
+	}
+	logger.Info("earthwalker has shut down")
+	return 0
 }
@@ -0,0 +1,311 @@
+// Package metrics collects counters, gauges and histograms, and serves them in
+// the Prometheus text format (version 0.0.4), so that earthwalker can be
+// scraped by Prometheus or anything compatible.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets for latencies in seconds, the same as Prometheus' defaults
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry of metrics, which serves them all via HTTP
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+	onScrape []func()
+}
+
+// NewRegistry without any metrics
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Counter registers a counter called name, with the given label names
+func (registry *Registry) Counter(name string, help string, labelNames ...string) *Counter {
+	return &Counter{registry.register(name, help, "counter", labelNames, nil)}
+}
+
+// Gauge registers a gauge called name, with the given label names
+func (registry *Registry) Gauge(name string, help string, labelNames ...string) *Gauge {
+	return &Gauge{registry.register(name, help, "gauge", labelNames, nil)}
+}
+
+// Histogram registers a histogram called name, with the given (increasing)
+// bucket upper bounds and label names
+func (registry *Registry) Histogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	return &Histogram{registry.register(name, help, "histogram", labelNames, buckets)}
+}
+
+// OnScrape calls update before every scrape, e.g. to Set gauges which are
+// expensive to keep up to date
+func (registry *Registry) OnScrape(update func()) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.onScrape = append(registry.onScrape, update)
+}
+
+func (registry *Registry) register(name string, help string, kind string, labelNames []string, buckets []float64) *family {
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+	if len(labelNames) == 0 {
+		// there's only one series, which is 0 until something happens
+		f.series[""] = &series{bucketCounts: make([]uint64, len(buckets))}
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	for _, existing := range registry.families {
+		if existing.name == name {
+			panic("metric " + name + " registered twice")
+		}
+	}
+	registry.families = append(registry.families, f)
+	return f
+}
+
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	registry.mu.Lock()
+	onScrape := append([]func(){}, registry.onScrape...)
+	families := append([]*family{}, registry.families...)
+	registry.mu.Unlock()
+
+	for _, update := range onScrape {
+		update()
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(writer)
+	}
+	writer.Flush()
+}
+
+// Counter only ever goes up.  A nil *Counter ignores everything.
+type Counter struct {
+	*family
+}
+
+// Inc the counter with the given label values by one
+func (counter *Counter) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+// Add value, which mustn't be negative
+func (counter *Counter) Add(value float64, labelValues ...string) {
+	if counter == nil {
+		return
+	}
+	counter.update(labelValues, func(s *series) {
+		s.value += value
+	})
+}
+
+// Set the counter to value, to mirror a count kept elsewhere which only goes
+// up, e.g. in OnScrape
+func (counter *Counter) Set(value float64, labelValues ...string) {
+	if counter == nil {
+		return
+	}
+	counter.update(labelValues, func(s *series) {
+		s.value = value
+	})
+}
+
+// Gauge is a value which may go up and down.  A nil *Gauge ignores everything.
+type Gauge struct {
+	*family
+}
+
+// Set the gauge with the given label values
+func (gauge *Gauge) Set(value float64, labelValues ...string) {
+	if gauge == nil {
+		return
+	}
+	gauge.update(labelValues, func(s *series) {
+		s.value = value
+	})
+}
+
+// Reset removes all label values, e.g. before Setting those which still exist
+func (gauge *Gauge) Reset() {
+	if gauge == nil {
+		return
+	}
+	gauge.mu.Lock()
+	defer gauge.mu.Unlock()
+	gauge.series = make(map[string]*series)
+}
+
+// Histogram counts observations in buckets.  A nil *Histogram ignores
+// everything.
+type Histogram struct {
+	*family
+}
+
+// Observe value, e.g. a latency in seconds
+func (histogram *Histogram) Observe(value float64, labelValues ...string) {
+	if histogram == nil {
+		return
+	}
+	histogram.update(labelValues, func(s *series) {
+		if s.bucketCounts == nil {
+			s.bucketCounts = make([]uint64, len(histogram.buckets))
+		}
+		for i, bound := range histogram.buckets {
+			if value <= bound {
+				s.bucketCounts[i]++
+			}
+		}
+		s.count++
+		s.value += value
+	})
+}
+
+// family is a metric with all its label values
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	// the sum of observations of histograms
+	value float64
+	// of histograms only, cumulative
+	bucketCounts []uint64
+	count        uint64
+}
+
+func (f *family) update(labelValues []string, change func(*series)) {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s has labels %v, got values %v", f.name, f.labelNames, labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		f.series[key] = s
+	}
+	change(s)
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escape(f.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			writeSample(w, f.name, f.labels(s, ""), s.value)
+			continue
+		}
+		for i, bound := range f.buckets {
+			writeSample(w, f.name+"_bucket", f.labels(s, formatFloat(bound)), float64(s.bucketCounts[i]))
+		}
+		writeSample(w, f.name+"_bucket", f.labels(s, "+Inf"), float64(s.count))
+		writeSample(w, f.name+"_sum", f.labels(s, ""), s.value)
+		writeSample(w, f.name+"_count", f.labels(s, ""), float64(s.count))
+	}
+}
+
+// labels of s as {name="value",...}, with le if it isn't empty
+func (f *family) labels(s *series, le string) string {
+	var pairs []string
+	for i, name := range f.labelNames {
+		pairs = append(pairs, name+`="`+escape(s.labelValues[i], true)+`"`)
+	}
+	if len(le) > 0 {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeSample(w *bufio.Writer, name string, labels string, value float64) {
+	w.WriteString(name)
+	w.WriteString(labels)
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// escape backslashes and newlines, and double quotes in label values
+func escape(s string, quotes bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quotes {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+// StatusRecorder remembers the status code written to a ResponseWriter
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+// WriteHeader records status and passes it on
+func (recorder *StatusRecorder) WriteHeader(status int) {
+	if recorder.Status == 0 {
+		recorder.Status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *StatusRecorder) Write(b []byte) (int, error) {
+	if recorder.Status == 0 {
+		recorder.Status = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(b)
+}
+
+// Unwrap for http.ResponseController
+func (recorder *StatusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(registry *Registry) string {
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	return rec.Body.String()
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+	requests := registry.Counter("test_requests_total", "Requests by route.", "route", "code")
+	latency := registry.Histogram("test_duration_seconds", "Request latency.", []float64{0.1, 1}, "route")
+	size := registry.Gauge("test_size_bytes", "Size.")
+	registry.Counter("test_unused_total", "Never incremented.")
+	scrapes := 0
+	registry.OnScrape(func() {
+		scrapes++
+		size.Set(float64(1024 * scrapes))
+	})
+
+	requests.Inc("maps", "200")
+	requests.Inc("maps", "200")
+	requests.Add(3, "guesses", "500")
+	requests.Inc(`we"ird`, "200")
+	latency.Observe(0.05, "maps")
+	latency.Observe(0.5, "maps")
+	latency.Observe(5, "maps")
+
+	expected := `# HELP test_duration_seconds Request latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="maps",le="0.1"} 1
+test_duration_seconds_bucket{route="maps",le="1"} 2
+test_duration_seconds_bucket{route="maps",le="+Inf"} 3
+test_duration_seconds_sum{route="maps"} 5.55
+test_duration_seconds_count{route="maps"} 3
+# HELP test_requests_total Requests by route.
+# TYPE test_requests_total counter
+test_requests_total{route="guesses",code="500"} 3
+test_requests_total{route="maps",code="200"} 2
+test_requests_total{route="we\"ird",code="200"} 1
+# HELP test_size_bytes Size.
+# TYPE test_size_bytes gauge
+test_size_bytes 1024
+# HELP test_unused_total Never incremented.
+# TYPE test_unused_total counter
+test_unused_total 0
+`
+	if body := scrape(registry); body != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, body)
+	}
+	if body := scrape(registry); !strings.Contains(body, "test_size_bytes 2048\n") {
+		t.Error("expected gauges to be updated on every scrape, got", body)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var counter *Counter
+	var gauge *Gauge
+	var histogram *Histogram
+	// must not panic, so that metrics are optional
+	counter.Inc("a")
+	counter.Set(1)
+	gauge.Set(1)
+	gauge.Reset()
+	histogram.Observe(1)
+}
+
+func TestCounterSet(t *testing.T) {
+	registry := NewRegistry()
+	hits := registry.Counter("test_hits_total", "Hits counted elsewhere.")
+	counted := 0
+	registry.OnScrape(func() {
+		counted += 2
+		hits.Set(float64(counted))
+	})
+	for _, expected := range []string{"test_hits_total 2\n", "test_hits_total 4\n"} {
+		if body := scrape(registry); !strings.Contains(body, expected) {
+			t.Errorf("expected %q in\n%s", expected, body)
+		}
+	}
+}
+
+func TestStatusRecorder(t *testing.T) {
+	rec := &StatusRecorder{ResponseWriter: httptest.NewRecorder()}
+	rec.Write([]byte("implicitly OK"))
+	if rec.Status != http.StatusOK {
+		t.Error("expected 200, got", rec.Status)
+	}
+	rec = &StatusRecorder{ResponseWriter: httptest.NewRecorder()}
+	http.Error(rec, "nope", http.StatusTooManyRequests)
+	if rec.Status != http.StatusTooManyRequests {
+		t.Error("expected 429, got", rec.Status)
+	}
+}
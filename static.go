@@ -0,0 +1,39 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/glatteis/earthwalker/domain"
+	"gitlab.com/glatteis/earthwalker/handlers"
+)
+
+// embeddedPublic is the frontend, as built by make into public.  "all:" keeps
+// the build working with only the placeholder there, i.e. before the frontend
+// has been built.
+//
+//go:embed all:public
+var embeddedPublic embed.FS
+
+// staticFiles returns the frontend files: from StaticPath if it's set, as it
+// is for frontend development, and from the binary otherwise
+func staticFiles(conf domain.Config) (*handlers.Static, error) {
+	if len(conf.StaticPath) > 0 {
+		return handlers.NewStatic(os.DirFS(filepath.Join(conf.StaticPath, "public")), false)
+	}
+	public, err := fs.Sub(embeddedPublic, "public")
+	if err != nil {
+		return nil, err
+	}
+	static, err := handlers.NewStatic(public, true)
+	if err != nil {
+		return nil, err
+	}
+	if !static.Exists("index.html") {
+		return nil, errors.New("this executable was built without the frontend, run make or set StaticPath")
+	}
+	return static, nil
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/glatteis/earthwalker/badgerdb"
+	"gitlab.com/glatteis/earthwalker/config"
+	"gitlab.com/glatteis/earthwalker/domain"
+)
+
+// stdout of commands, replaced in tests
+var stdout io.Writer = os.Stdout
+
+// stores of the db configured for serve
+type stores struct {
+	maps       domain.MapStore
+	challenges domain.ChallengeStore
+	results    domain.ChallengeResultStore
+	users      domain.UserStore
+	stats      func() (badgerdb.Stats, error)
+}
+
+// openStores of the db configured for serve, which must be closed by calling
+// closeDB
+func openStores() (s stores, closeDB func(), err error) {
+	conf, _, err := config.Read(nil)
+	if err != nil {
+		return s, nil, fmt.Errorf("failed to read config: %v", err)
+	}
+	db, err := badgerdb.Init(conf.DBPath)
+	if err != nil {
+		return s, nil, fmt.Errorf("failed to open db at %s, is earthwalker still running? %v", conf.DBPath, err)
+	}
+	index := &badgerdb.IndexStore{DB: db}
+	s = stores{
+		maps:       badgerdb.MapStore{DB: db, Index: index},
+		challenges: badgerdb.ChallengeStore{DB: db, Index: index},
+		results:    badgerdb.ChallengeResultStore{DB: db, Index: index},
+		users:      badgerdb.UserStore{DB: db, Index: index},
+		stats: func() (badgerdb.Stats, error) {
+			return badgerdb.ReadStats(db)
+		},
+	}
+	return s, func() { badgerdb.Close(db) }, nil
+}
+
+// subcommand of a store command, like "list" of "earthwalker maps"
+type subcommand struct {
+	// of the positional arguments, e.g. "<id>"
+	usage   string
+	minArgs int
+	maxArgs int
+	run     func(s stores, out output, args []string) error
+}
+
+// storeCommand runs the subcommand named by args[0], with the positional
+// arguments and -json flag which follow it
+func storeCommand(name string, subcommands map[string]subcommand, args []string) int {
+	var names []string
+	for subName := range subcommands {
+		names = append(names, subName)
+	}
+	sort.Strings(names)
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: earthwalker %s %s ...\n", name, strings.Join(names, "|"))
+		return 2
+	}
+	sub, ok := subcommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s %s', expected one of %s\n", name, args[0], strings.Join(names, ", "))
+		return 2
+	}
+	flags := flag.NewFlagSet("earthwalker "+name+" "+args[0], flag.ContinueOnError)
+	jsonOutput := flags.Bool("json", false, "print JSON instead of a table")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: earthwalker %s %s %s [-json]\n", name, args[0], sub.usage)
+		flags.PrintDefaults()
+	}
+	// flags may come before or after the positional arguments
+	var positional []string
+	rest := args[1:]
+	for {
+		if err := flags.Parse(rest); errors.Is(err, flag.ErrHelp) {
+			return 0
+		} else if err != nil {
+			return 2
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		rest = flags.Args()[1:]
+	}
+	if len(positional) < sub.minArgs || len(positional) > sub.maxArgs {
+		flags.Usage()
+		return 2
+	}
+
+	s, closeDB, err := openStores()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to %s %s: %v\n", args[0], name, err)
+		return 1
+	}
+	defer closeDB()
+	if err := sub.run(s, output{w: stdout, json: *jsonOutput}, positional); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to %s %s: %v\n", args[0], name, err)
+		return 1
+	}
+	return 0
+}
+
+// == MAPS ========
+
+func mapsCommand(args []string) int {
+	return storeCommand("maps", map[string]subcommand{
+		"list":   {"", 0, 0, listMaps},
+		"show":   {"<id>", 1, 1, showMap},
+		"delete": {"<id>", 1, 1, deleteMap},
+	}, args)
+}
+
+func listMaps(s stores, out output, args []string) error {
+	maps, err := s.maps.GetAll()
+	if err != nil {
+		return err
+	}
+	sort.Slice(maps, func(i, j int) bool {
+		return maps[i].Name < maps[j].Name
+	})
+	var rows [][]string
+	for _, m := range maps {
+		challengeIDs, err := s.challenges.GetList(m.MapID)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, []string{m.MapID, m.Name, strconv.Itoa(m.NumRounds), strconv.Itoa(len(challengeIDs))})
+	}
+	return out.print(maps, []string{"ID", "NAME", "ROUNDS", "CHALLENGES"}, rows)
+}
+
+func showMap(s stores, out output, args []string) error {
+	m, err := s.maps.Get(args[0])
+	if err != nil {
+		return err
+	}
+	challengeIDs, err := s.challenges.GetList(m.MapID)
+	if err != nil {
+		return err
+	}
+	sort.Strings(challengeIDs)
+	timeLimit := "none"
+	if m.TimeLimit > 0 {
+		timeLimit = (time.Duration(m.TimeLimit) * time.Second).String()
+	}
+	return out.print(m, nil, [][]string{
+		{"ID", m.MapID},
+		{"Name", m.Name},
+		{"Rounds", strconv.Itoa(m.NumRounds)},
+		{"Time limit", timeLimit},
+		{"Grace distance", fmt.Sprintf("%d m", m.GraceDistance)},
+		{"Population density", fmt.Sprintf("%d-%d", m.MinDensity, m.MaxDensity)},
+		{"Connectedness", m.Connectedness.String()},
+		{"Copyright", m.Copyright.String()},
+		{"Source", m.Source.String()},
+		{"Labels", strconv.FormatBool(m.ShowLabels)},
+		{"Locations", strings.Join(m.LocStrings, "; ")},
+		{"Challenges", strings.Join(challengeIDs, " ")},
+	})
+}
+
+func deleteMap(s stores, out output, args []string) error {
+	m, err := s.maps.Get(args[0])
+	if err != nil {
+		return err
+	}
+	challengeIDs, err := s.challenges.GetList(m.MapID)
+	if err != nil {
+		return err
+	}
+	if err := domain.DeleteMap(s.maps, s.challenges, s.results, m.MapID); err != nil {
+		return err
+	}
+	fmt.Fprintf(out.w, "Deleted map %s '%s' and its %d challenges\n", m.MapID, m.Name, len(challengeIDs))
+	return nil
+}
+
+// == CHALLENGES ========
+
+func challengesCommand(args []string) int {
+	return storeCommand("challenges", map[string]subcommand{
+		"list":   {"[<map id>]", 0, 1, listChallenges},
+		"show":   {"<id>", 1, 1, showChallenge},
+		"delete": {"<id>", 1, 1, deleteChallenge},
+	}, args)
+}
+
+func listChallenges(s stores, out output, args []string) error {
+	var mapIDs []string
+	if len(args) > 0 {
+		mapIDs = args
+	} else {
+		maps, err := s.maps.GetAll()
+		if err != nil {
+			return err
+		}
+		for _, m := range maps {
+			mapIDs = append(mapIDs, m.MapID)
+		}
+	}
+	challenges := []domain.Challenge{}
+	for _, mapID := range mapIDs {
+		mapChallenges, err := s.challenges.GetAll(mapID)
+		if err != nil {
+			return err
+		}
+		challenges = append(challenges, mapChallenges...)
+	}
+	sort.Slice(challenges, func(i, j int) bool {
+		if challenges[i].MapID != challenges[j].MapID {
+			return challenges[i].MapID < challenges[j].MapID
+		}
+		return challenges[i].ChallengeID < challenges[j].ChallengeID
+	})
+	var rows [][]string
+	for _, c := range challenges {
+		results, err := s.results.GetAll(c.ChallengeID)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, []string{c.ChallengeID, c.MapID, strconv.Itoa(len(c.Places)), strconv.Itoa(len(results))})
+	}
+	return out.print(challenges, []string{"ID", "MAP", "ROUNDS", "RESULTS"}, rows)
+}
+
+func showChallenge(s stores, out output, args []string) error {
+	c, err := s.challenges.Get(args[0])
+	if err != nil {
+		return err
+	}
+	var rows [][]string
+	for _, place := range c.Places {
+		var country, city string
+		if place.Info != nil {
+			country, city = place.Info.Country, place.Info.City
+		}
+		rows = append(rows, []string{
+			strconv.Itoa(place.RoundNum + 1),
+			strconv.FormatFloat(place.Location.Lat, 'f', 6, 64),
+			strconv.FormatFloat(place.Location.Lng, 'f', 6, 64),
+			country,
+			city,
+		})
+	}
+	return out.print(c, []string{"ROUND", "LAT", "LNG", "COUNTRY", "CITY"}, rows)
+}
+
+func deleteChallenge(s stores, out output, args []string) error {
+	c, err := s.challenges.Get(args[0])
+	if err != nil {
+		return err
+	}
+	results, err := s.results.GetAll(c.ChallengeID)
+	if err != nil {
+		return err
+	}
+	if err := domain.DeleteChallenge(s.challenges, s.results, c.ChallengeID); err != nil {
+		return err
+	}
+	fmt.Fprintf(out.w, "Deleted challenge %s and its %d results\n", c.ChallengeID, len(results))
+	return nil
+}
+
+// == RESULTS ========
+
+func resultsCommand(args []string) int {
+	return storeCommand("results", map[string]subcommand{
+		"list":   {"<challenge id>", 1, 1, listResults},
+		"delete": {"<id>", 1, 1, deleteResult},
+	}, args)
+}
+
+func listResults(s stores, out output, args []string) error {
+	if _, err := s.challenges.Get(args[0]); err != nil {
+		return err
+	}
+	results, err := s.results.GetAll(args[0])
+	if err != nil {
+		return err
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].CreatedAt.Before(results[j].CreatedAt)
+	})
+	var rows [][]string
+	for _, result := range results {
+		rows = append(rows, []string{
+			result.ChallengeResultID,
+			result.Nickname,
+			result.UserID,
+			strconv.Itoa(len(result.Guesses)),
+			result.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	return out.print(results, []string{"ID", "NICKNAME", "USER", "GUESSES", "CREATED"}, rows)
+}
+
+func deleteResult(s stores, out output, args []string) error {
+	result, err := s.results.Get(args[0])
+	if err != nil {
+		return err
+	}
+	if err := s.results.Delete(result.ChallengeResultID); err != nil {
+		return err
+	}
+	fmt.Fprintf(out.w, "Deleted result %s of '%s' in challenge %s\n", result.ChallengeResultID, result.Nickname, result.ChallengeID)
+	return nil
+}
+
+// == USERS ========
+
+func usersCommand(args []string) int {
+	return storeCommand("users", map[string]subcommand{
+		"list":    {"", 0, 0, listUsers},
+		"promote": {"<username> [role]", 1, 2, promoteUser},
+	}, args)
+}
+
+func listUsers(s stores, out output, args []string) error {
+	users, err := s.users.GetAll()
+	if err != nil {
+		return err
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].CreatedAt.Before(users[j].CreatedAt)
+	})
+	var rows [][]string
+	for _, user := range users {
+		rows = append(rows, []string{user.UserID, user.Username, user.Role.String(), user.CreatedAt.Format(time.RFC3339)})
+	}
+	return out.print(users, []string{"ID", "USERNAME", "ROLE", "CREATED"}, rows)
+}
+
+// promoteUser to admin, or the given role.  This is how the first admin is
+// made, later ones can also be promoted by admins via the API.
+func promoteUser(s stores, out output, args []string) error {
+	role := domain.RoleAdmin
+	if len(args) > 1 {
+		var err error
+		role, err = domain.ParseRole(args[1])
+		if err != nil {
+			return err
+		}
+	}
+	user, err := s.users.GetByUsername(args[0])
+	if err != nil {
+		return err
+	}
+	user.Role = role
+	if err := s.users.Insert(user); err != nil {
+		return err
+	}
+	fmt.Fprintf(out.w, "%s (%s) is now %s\n", user.Username, user.UserID, role)
+	return nil
+}
+
+// == DB ========
+
+func dbCommand(args []string) int {
+	return storeCommand("db", map[string]subcommand{
+		"stats": {"", 0, 0, showStats},
+	}, args)
+}
+
+func showStats(s stores, out output, args []string) error {
+	stats, err := s.stats()
+	if err != nil {
+		return err
+	}
+	rows := [][]string{
+		{"Maps", strconv.Itoa(stats.Maps)},
+		{"Challenges", strconv.Itoa(stats.Challenges)},
+		{"Challenge results", strconv.Itoa(stats.ChallengeResults)},
+		{"LSM size", fmt.Sprintf("%d bytes", stats.LSMSize)},
+		{"Value log size", fmt.Sprintf("%d bytes", stats.ValueLogSize)},
+	}
+	var prefixes []string
+	for prefix := range stats.Keys {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		rows = append(rows, []string{"Keys " + prefix, strconv.Itoa(stats.Keys[prefix])})
+	}
+	return out.print(stats, nil, rows)
+}
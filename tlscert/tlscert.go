@@ -0,0 +1,141 @@
+// Package tlscert serves HTTPS with a certificate which can be replaced while
+// running, e.g. when it's renewed by certbot, without dropping connections.
+package tlscert
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader holds the certificate loaded from a cert and key file, and loads it
+// again when they change
+type Reloader struct {
+	certPath string
+	keyPath  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	// of the files cert was loaded from
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// NewReloader loads the PEM encoded certificate (chain) at certPath and its
+// private key at keyPath
+func NewReloader(certPath string, keyPath string) (*Reloader, error) {
+	reloader := &Reloader{certPath: certPath, keyPath: keyPath}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload the certificate.  If that fails, the old one is kept.
+func (reloader *Reloader) Reload() error {
+	// stat first, so that a change while loading is noticed next time
+	certModTime, keyModTime, err := reloader.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(reloader.certPath, reloader.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate '%s' with key '%s': %v", reloader.certPath, reloader.keyPath, err)
+	}
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+	reloader.cert = &cert
+	reloader.certModTime = certModTime
+	reloader.keyModTime = keyModTime
+	return nil
+}
+
+// GetCertificate returns the current certificate, see tls.Config
+func (reloader *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	return reloader.cert, nil
+}
+
+// Changed returns whether the cert or key file has been modified since the
+// certificate was loaded
+func (reloader *Reloader) Changed() bool {
+	certModTime, keyModTime, err := reloader.modTimes()
+	if err != nil {
+		// e.g. in the middle of being replaced, look again later
+		return false
+	}
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+	return !certModTime.Equal(reloader.certModTime) || !keyModTime.Equal(reloader.keyModTime)
+}
+
+// Watch reloads the certificate when its files change, which is checked every
+// interval, and whenever something is received from reload (e.g. SIGHUP via
+// signal.Notify), until ctx is done
+func (reloader *Reloader) Watch(ctx context.Context, interval time.Duration, reload <-chan os.Signal) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !reloader.Changed() {
+				continue
+			}
+		case <-reload:
+		}
+		if err := reloader.Reload(); err != nil {
+			log.Printf("Failed to reload TLS certificate, keeping the old one: %v\n", err)
+			continue
+		}
+		log.Printf("Reloaded TLS certificate from '%s'\n", reloader.certPath)
+	}
+}
+
+func (reloader *Reloader) modTimes() (certModTime time.Time, keyModTime time.Time, err error) {
+	certInfo, err := os.Stat(reloader.certPath)
+	if err != nil {
+		return certModTime, keyModTime, fmt.Errorf("failed to stat certificate: %v", err)
+	}
+	keyInfo, err := os.Stat(reloader.keyPath)
+	if err != nil {
+		return certModTime, keyModTime, fmt.Errorf("failed to stat key: %v", err)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// LoadCertPool loads the PEM encoded CA certificates at path
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificates: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM encoded certificates in '%s'", path)
+	}
+	return pool, nil
+}
+
+// ServerConfig serves reloader's certificate.  If clientCAs isn't nil, clients
+// may present a certificate signed by one of them, which is then verified
+// (see http.Request.TLS.VerifiedChains); connections without one are allowed.
+func ServerConfig(reloader *Reloader, clientCAs *x509.CertPool) *tls.Config {
+	conf := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCAs != nil {
+		conf.ClientCAs = clientCAs
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return conf
+}
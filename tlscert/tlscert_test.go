@@ -0,0 +1,197 @@
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newCert returns a certificate for localhost signed by parent (self-signed if
+// nil), and its key
+func newCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{"localhost"},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writeCert writes cert and key as PEM files into dir, modified at modTime
+func writeCert(t *testing.T, dir string, cert *x509.Certificate, key *ecdsa.PrivateKey, modTime time.Time) (certPath string, keyPath string) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath = filepath.Join(dir, "cert.pem")
+	keyPath = filepath.Join(dir, "key.pem")
+	for path, block := range map[string]*pem.Block{
+		certPath: {Type: "CERTIFICATE", Bytes: cert.Raw},
+		keyPath:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certPath, keyPath
+}
+
+func servedName(t *testing.T, reloader *Reloader) string {
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now().Add(-time.Minute)
+	cert, key := newCert(t, "first", false, nil, nil)
+	certPath, keyPath := writeCert(t, dir, cert, key, start)
+
+	reloader, err := NewReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, reloader); name != "first" {
+		t.Fatal("expected the first certificate, got", name)
+	}
+	if reloader.Changed() {
+		t.Error("expected no change right after loading")
+	}
+
+	// renewed
+	cert, key = newCert(t, "second", false, nil, nil)
+	writeCert(t, dir, cert, key, start.Add(time.Second))
+	if !reloader.Changed() {
+		t.Error("expected the new files to be noticed")
+	}
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := servedName(t, reloader); name != "second" {
+		t.Error("expected the second certificate, got", name)
+	}
+
+	// broken, e.g. only half written
+	if err := ioutil.WriteFile(certPath, []byte("-----BEGIN CERTIFICATE-----\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Error("expected a broken certificate not to load")
+	}
+	if name := servedName(t, reloader); name != "second" {
+		t.Error("expected the old certificate to be kept, got", name)
+	}
+
+	if _, err := NewReloader(filepath.Join(dir, "missing.pem"), keyPath); err == nil {
+		t.Error("expected a missing certificate to be an error")
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(path, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCertPool(path); err == nil {
+		t.Error("expected a file without certificates to be rejected")
+	}
+	if _, err := LoadCertPool(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("expected a missing file to be an error")
+	}
+}
+
+func TestClientCerts(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCert(t, "ca", true, nil, nil)
+	serverCert, serverKey := newCert(t, "server", false, ca, caKey)
+	clientCert, clientKey := newCert(t, "client", false, ca, caKey)
+	stranger, strangerKey := newCert(t, "stranger", false, nil, nil)
+
+	certPath, keyPath := writeCert(t, dir, serverCert, serverKey, time.Now())
+	reloader, err := NewReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.Itoa(len(r.TLS.VerifiedChains))))
+	}))
+	server.TLS = ServerConfig(reloader, pool)
+	server.StartTLS()
+	defer server.Close()
+
+	get := func(cert *x509.Certificate, key *ecdsa.PrivateKey) (string, error) {
+		clientTLS := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+		if cert != nil {
+			// sent even if it isn't signed by one of the server's CAs
+			clientTLS.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key}, nil
+			}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+		res, err := client.Get(server.URL)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	if chains, err := get(nil, nil); err != nil || chains != "0" {
+		t.Errorf("expected connections without a client certificate to be allowed unverified, got %s, %v", chains, err)
+	}
+	if chains, err := get(clientCert, clientKey); err != nil || chains != "1" {
+		t.Errorf("expected the client certificate to be verified, got %s, %v", chains, err)
+	}
+	if _, err := get(stranger, strangerKey); err == nil {
+		t.Error("expected an untrusted client certificate to be rejected")
+	}
+}